@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const DEFAULT_CONCURRENCY = 4
+
+// forEachConcurrently calls fn with every index from 0 to n-1, running at most limit
+// calls at once. The error of each call is returned at its index, so callers can
+// report errors in a deterministic order.
+func forEachConcurrently(n int, limit int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > n {
+		limit = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < limit; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs
+}
+
+// combineErrors returns a single error listing every failed item in order, or nil if
+// none failed. names holds the name of each item, at the same index as its error.
+func combineErrors(names []string, errs []error) error {
+	var (
+		failed   int
+		messages []string
+	)
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			messages = append(messages, fmt.Sprintf("%s: %s", names[i], err))
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("%d of %d failed: %s", failed, len(errs), strings.Join(messages, "; "))
+}
+
+// s3ClientPool creates a single S3 client per region and shares it between objects,
+// invocations and goroutines.
+type s3ClientPool struct {
+	new func(awsRegion string) s3iface.S3API
+
+	mu      sync.Mutex
+	clients map[string]s3iface.S3API
+}
+
+var s3Clients = &s3ClientPool{
+	new: func(awsRegion string) s3iface.S3API { return newS3Client(awsRegion) },
+}
+
+func (sp *s3ClientPool) get(awsRegion string) s3iface.S3API {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.clients == nil {
+		sp.clients = make(map[string]s3iface.S3API)
+	}
+	client, ok := sp.clients[awsRegion]
+	if !ok {
+		client = sp.new(awsRegion)
+		sp.clients[awsRegion] = client
+	}
+	return client
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestForEachConcurrently(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, peak int
+	)
+	errs := forEachConcurrently(20, 3, func(i int) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if i%5 == 0 {
+			return fmt.Errorf("failed %d", i)
+		}
+		return nil
+	})
+
+	if peak > 3 {
+		t.Fatalf("Expected at most 3 calls at once, got %d", peak)
+	}
+	for i, err := range errs {
+		if (i%5 == 0) != (err != nil) {
+			t.Fatalf("Unexpected error at index %d: %v", i, err)
+		}
+	}
+}
+
+func TestStreamS3EventAggregatesErrors(t *testing.T) {
+	fs := &fakeS3{objects: map[string][]byte{
+		"a": []byte(`{"Records":[{"eventID":"a"}]}`),
+		"c": []byte(`{"Records":[{"eventID":"c"}]}`),
+	}}
+	var (
+		mu    sync.Mutex
+		sinks []*fakeSink
+	)
+	s := &Streamer{
+		sinks: func() ([]*streamerSink, error) {
+			sink := &fakeSink{}
+			mu.Lock()
+			sinks = append(sinks, sink)
+			mu.Unlock()
+			return []*streamerSink{{"fake", sink}}, nil
+		},
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+		concurrency: 2,
+		slots:       make(chan struct{}, 2),
+	}
+
+	var s3Event events.S3Event
+	for _, key := range []string{"a", "b", "c", "d"} {
+		var record events.S3EventRecord
+		record.AWSRegion = "us-east-1"
+		record.S3.Bucket.Name = "bucket"
+		record.S3.Object.Key = key
+		s3Event.Records = append(s3Event.Records, record)
+	}
+
+	err := streamS3Event(s, s3Event)
+	expected := "2 of 4 failed: bucket/b: no such key b; bucket/d: no such key d"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected error %q, got %v", expected, err)
+	}
+	// Failing objects don't stop the others from being streamed, and every object that
+	// could be fetched is streamed to sinks of its own
+	if len(sinks) != 2 {
+		t.Fatalf("Expected sinks for each of the 2 objects fetched, got %d", len(sinks))
+	}
+	for _, sink := range sinks {
+		if len(sink.sent) != 1 || !sink.closed {
+			t.Fatalf("Expected 1 record sent to each closed sink, got %q", sink.sent)
+		}
+	}
+}
+
+func TestS3ClientPool(t *testing.T) {
+	var created []string
+	sp := &s3ClientPool{new: func(awsRegion string) s3iface.S3API {
+		created = append(created, awsRegion)
+		return &fakeS3{}
+	}}
+
+	east := sp.get("us-east-1")
+	sp.get("us-west-2")
+	if sp.get("us-east-1") != east {
+		t.Fatal("Expected the client to be reused")
+	}
+	if len(created) != 2 {
+		t.Fatalf("Expected a client per region, got %v", created)
+	}
+}
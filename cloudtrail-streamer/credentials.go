@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/decrypt"
+)
+
+const DEFAULT_GCP_CREDENTIALS_FILE = "./gcp_credentials.json"
+
+// gcpCredentialSources are the settings GCP credentials can be read from. At most one
+// of them may be set; the credentials file in the Lambda code bundle is used if none are.
+var gcpCredentialSources = []string{
+	"CT_GCP_CREDENTIALS",
+	"CT_GCP_CREDENTIALS_FILE",
+	"CT_GCP_CREDENTIALS_SECRET",
+	"CT_GCP_CREDENTIALS_PARAMETER",
+}
+
+// getGcpCredentials returns the GCP credentials JSON, decrypting it if it is
+// encrypted with sops. The credentials are only read once and then reused, so secrets
+// are not fetched again for every GCP client.
+func (c *Config) getGcpCredentials() ([]byte, error) {
+	if c.gcpCredentials != nil {
+		return c.gcpCredentials, nil
+	}
+
+	data, err := c.readGcpCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := decrypt.Data(data, "json")
+	if err != nil {
+		if err.Error() == sops.MetadataNotFound.Error() {
+			// not an encrypted file
+			credentials = data
+		} else {
+			return nil, err
+		}
+	}
+
+	// Both service account keys and workload identity federation configs, which let
+	// the function exchange its AWS role for GCP credentials, are passed on as they are
+	var parsed struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(credentials, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("GCP credentials are not valid JSON: %s", err)
+	}
+	log.Debugf("Using GCP credentials of type %s", parsed.Type)
+
+	c.gcpCredentials = credentials
+	return credentials, nil
+}
+
+// readGcpCredentials reads the GCP credentials from the configured source.
+func (c *Config) readGcpCredentials() ([]byte, error) {
+	var set []string
+	for _, name := range gcpCredentialSources {
+		if os.Getenv(name) != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 1 {
+		return nil, fmt.Errorf("Only one of %s may be set, got %s", strings.Join(gcpCredentialSources, ", "), strings.Join(set, " and "))
+	}
+
+	if v := os.Getenv("CT_GCP_CREDENTIALS"); v != "" {
+		log.Debug("Accessing gcp credentials from CT_GCP_CREDENTIALS")
+		return decodeCredentials(v)
+	}
+	if name := os.Getenv("CT_GCP_CREDENTIALS_SECRET"); name != "" {
+		log.Debugf("Accessing gcp credentials from secret %s", name)
+		return getSecret(c.getSecretsManagerClient(), name)
+	}
+	if name := os.Getenv("CT_GCP_CREDENTIALS_PARAMETER"); name != "" {
+		log.Debugf("Accessing gcp credentials from parameter %s", name)
+		return getParameter(c.getSSMClient(), name)
+	}
+
+	path := os.Getenv("CT_GCP_CREDENTIALS_FILE")
+	if path == "" {
+		path = DEFAULT_GCP_CREDENTIALS_FILE
+	}
+	log.Debugf("Accessing gcp credentials from %s", path)
+	return ioutil.ReadFile(path)
+}
+
+// decodeCredentials returns credentials set in the environment, which may be base64
+// encoded to keep them on a single line.
+func decodeCredentials(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		return []byte(v), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("CT_GCP_CREDENTIALS must be JSON or base64 encoded JSON: %s", err)
+	}
+	return data, nil
+}
+
+func (c *Config) getSecretsManagerClient() secretsmanageriface.SecretsManagerAPI {
+	if c.secretsManagerClient == nil {
+		c.secretsManagerClient = secretsmanager.New(c.awsSession)
+	}
+	return c.secretsManagerClient
+}
+
+func (c *Config) getSSMClient() ssmiface.SSMAPI {
+	if c.ssmClient == nil {
+		c.ssmClient = ssm.New(c.awsSession)
+	}
+	return c.ssmClient
+}
+
+// getSecret returns the current value of a Secrets Manager secret, given its name or ARN.
+func getSecret(client secretsmanageriface.SecretsManagerAPI, name string) ([]byte, error) {
+	out, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting secret %s. Err: %s", name, err)
+	}
+	if out.SecretString != nil {
+		return []byte(*out.SecretString), nil
+	}
+	if out.SecretBinary != nil {
+		return out.SecretBinary, nil
+	}
+	return nil, fmt.Errorf("Secret %s has no value", name)
+}
+
+// getParameter returns the value of an SSM parameter, decrypting SecureString parameters.
+func getParameter(client ssmiface.SSMAPI, name string) ([]byte, error) {
+	out, err := client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting parameter %s. Err: %s", name, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return nil, fmt.Errorf("Parameter %s has no value", name)
+	}
+	return []byte(*out.Parameter.Value), nil
+}
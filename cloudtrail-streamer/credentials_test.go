@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+const (
+	testServiceAccount  = `{"type": "service_account", "project_id": "test"}`
+	testExternalAccount = `{"type": "external_account", "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/aws/providers/aws", "credential_source": {"environment_id": "aws1"}}`
+)
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+
+	secrets map[string]string
+	calls   int
+}
+
+func (fs *fakeSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	fs.calls++
+	secret, ok := fs.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secret)}, nil
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+
+	parameters map[string]string
+}
+
+func (fs *fakeSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	if !aws.BoolValue(input.WithDecryption) {
+		return nil, errors.New("expected parameter to be decrypted")
+	}
+	value, ok := fs.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+func setCredentialSource(name string, value string) {
+	for _, source := range gcpCredentialSources {
+		os.Unsetenv(source)
+	}
+	if name != "" {
+		os.Setenv(name, value)
+	}
+}
+
+func TestGetGcpCredentials(t *testing.T) {
+	defer setCredentialSource("", "")
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gcp_credentials.json")
+	err = ioutil.WriteFile(path, []byte(testServiceAccount), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &fakeSecretsManager{secrets: map[string]string{"gcp-credentials": testExternalAccount}}
+	params := &fakeSSM{parameters: map[string]string{"/cloudtrail-streamer/gcp": testServiceAccount}}
+
+	tests := []struct {
+		name     string
+		source   string
+		value    string
+		expected string
+		err      bool
+	}{
+		{name: "file", source: "CT_GCP_CREDENTIALS_FILE", value: path, expected: testServiceAccount},
+		{name: "missing file", source: "CT_GCP_CREDENTIALS_FILE", value: filepath.Join(dir, "missing.json"), err: true},
+		{name: "env", source: "CT_GCP_CREDENTIALS", value: testServiceAccount, expected: testServiceAccount},
+		{name: "base64 env", source: "CT_GCP_CREDENTIALS", value: base64.StdEncoding.EncodeToString([]byte(testExternalAccount)), expected: testExternalAccount},
+		{name: "invalid env", source: "CT_GCP_CREDENTIALS", value: "not json", err: true},
+		{name: "secret", source: "CT_GCP_CREDENTIALS_SECRET", value: "gcp-credentials", expected: testExternalAccount},
+		{name: "missing secret", source: "CT_GCP_CREDENTIALS_SECRET", value: "missing", err: true},
+		{name: "parameter", source: "CT_GCP_CREDENTIALS_PARAMETER", value: "/cloudtrail-streamer/gcp", expected: testServiceAccount},
+		{name: "missing parameter", source: "CT_GCP_CREDENTIALS_PARAMETER", value: "/missing", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setCredentialSource(test.source, test.value)
+			c := &Config{secretsManagerClient: sm, ssmClient: params}
+			credentials, err := c.getGcpCredentials()
+			if test.err {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(credentials) != test.expected {
+				t.Fatalf("Expected credentials %s, got %s", test.expected, credentials)
+			}
+		})
+	}
+}
+
+func TestGetGcpCredentialsReadsOnce(t *testing.T) {
+	setCredentialSource("CT_GCP_CREDENTIALS_SECRET", "gcp-credentials")
+	defer setCredentialSource("", "")
+
+	sm := &fakeSecretsManager{secrets: map[string]string{"gcp-credentials": testServiceAccount}}
+	c := &Config{secretsManagerClient: sm}
+	for i := 0; i < 2; i++ {
+		_, err := c.getGcpCredentials()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sm.calls != 1 {
+		t.Fatalf("Expected the secret to be fetched once, got %d", sm.calls)
+	}
+}
+
+func TestGetGcpCredentialsSingleSource(t *testing.T) {
+	setCredentialSource("CT_GCP_CREDENTIALS", testServiceAccount)
+	os.Setenv("CT_GCP_CREDENTIALS_SECRET", "gcp-credentials")
+	defer setCredentialSource("", "")
+
+	c := &Config{secretsManagerClient: &fakeSecretsManager{}}
+	_, err := c.getGcpCredentials()
+	if err == nil {
+		t.Fatal("Expected an error with more than one credentials source set")
+	}
+}
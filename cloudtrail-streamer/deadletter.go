@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DEAD_LETTER_TIME_FORMAT = "20060102T150405.000000000Z"
+
+// deadLetter holds an object that could not be read, or the records of an object that
+// could never be delivered, along with why. Records are stored as they were sent to the
+// sinks, after filtering, enrichment and redaction.
+type deadLetter struct {
+	Region  string              `json:"region,omitempty"`
+	Bucket  string              `json:"bucket,omitempty"` // Empty for local files
+	Key     string              `json:"key"`
+	ETag    string              `json:"etag,omitempty"`
+	Reason  string              `json:"reason,omitempty"` // Why the object could not be read, empty if it was
+	Time    time.Time           `json:"time"`
+	Records []*deadLetterRecord `json:"records,omitempty"`
+}
+
+type deadLetterRecord struct {
+	Sink   string          `json:"sink,omitempty"` // Sink that rejected the record, empty if it never reached the sinks
+	Reason string          `json:"reason"`
+	Record json.RawMessage `json:"record"`
+}
+
+func newDeadLetter(source recordSource) *deadLetter {
+	return &deadLetter{
+		Region: source.Region,
+		Bucket: source.Bucket,
+		Key:    source.Key,
+		ETag:   source.ETag,
+		Time:   time.Now().UTC(),
+	}
+}
+
+func (dl *deadLetter) isEmpty() bool {
+	return dl.Reason == "" && len(dl.Records) == 0
+}
+
+// name returns a name for the dead letter that sorts by time and is unique per object.
+func (dl *deadLetter) name() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s@%s", dl.Bucket, dl.Key, dl.ETag)))
+	return fmt.Sprintf("%s-%s.json", dl.Time.Format(DEAD_LETTER_TIME_FORMAT), hex.EncodeToString(sum[:8]))
+}
+
+// DeadLetterStore keeps dead letters until they are re-driven.
+type DeadLetterStore interface {
+	Put(name string, data []byte) error
+	// List returns the names of the stored dead letters, oldest first.
+	List() ([]string, error)
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+}
+
+// loadDeadLetterStore returns the store configured with CT_DEAD_LETTER, an S3 URL or a
+// local directory, or nil if it is not set.
+func loadDeadLetterStore() (DeadLetterStore, error) {
+	location := os.Getenv("CT_DEAD_LETTER")
+	if location == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("CT_DEAD_LETTER is set to an invalid value, %s, must be s3://bucket/prefix or a directory", location)
+		}
+		region := os.Getenv("CT_DEAD_LETTER_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		var prefix string
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		return NewS3DeadLetterStore(s3Clients.get(region), parts[0], prefix), nil
+	}
+
+	return NewDirDeadLetterStore(location)
+}
+
+// DirDeadLetterStore keeps dead letters as files in a local directory.
+type DirDeadLetterStore struct {
+	dir string
+}
+
+func NewDirDeadLetterStore(dir string) (*DirDeadLetterStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating dead letter directory %s: %s", dir, err)
+	}
+	return &DirDeadLetterStore{dir: dir}, nil
+}
+
+func (ds *DirDeadLetterStore) Put(name string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(ds.dir, name), data, 0600)
+}
+
+func (ds *DirDeadLetterStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ds *DirDeadLetterStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(ds.dir, name))
+}
+
+func (ds *DirDeadLetterStore) Delete(name string) error {
+	return os.Remove(filepath.Join(ds.dir, name))
+}
+
+// S3DeadLetterStore keeps dead letters as objects under a prefix of a bucket.
+type S3DeadLetterStore struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func NewS3DeadLetterStore(client s3iface.S3API, bucket string, prefix string) *S3DeadLetterStore {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3DeadLetterStore{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (ss *S3DeadLetterStore) Put(name string, data []byte) error {
+	_, err := ss.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(ss.bucket),
+		Key:         aws.String(ss.prefix + name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (ss *S3DeadLetterStore) List() ([]string, error) {
+	var names []string
+	err := ss.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(ss.bucket),
+		Prefix: aws.String(ss.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), ss.prefix)
+			if !strings.Contains(name, "/") && strings.HasSuffix(name, ".json") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (ss *S3DeadLetterStore) Get(name string) ([]byte, error) {
+	object, err := fetchLogFromS3(ss.client, ss.bucket, ss.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+	return ioutil.ReadAll(object.Body)
+}
+
+func (ss *S3DeadLetterStore) Delete(name string) error {
+	_, err := ss.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.prefix + name),
+	})
+	return err
+}
+
+// writeDeadLetter stores a dead letter, unless it is empty.
+func (s *Streamer) writeDeadLetter(dl *deadLetter) error {
+	if dl.isEmpty() {
+		return nil
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	name := dl.name()
+	err = s.deadLetters.Put(name, data)
+	if err != nil {
+		return fmt.Errorf("Error writing dead letter %s. Err: %s", name, err)
+	}
+	if dl.Reason != "" {
+		log.Warnf("Dead-lettered %s/%s as %s: %s", dl.Bucket, dl.Key, name, dl.Reason)
+	} else {
+		log.Warnf("Dead-lettered %d records of %s/%s as %s", len(dl.Records), dl.Bucket, dl.Key, name)
+	}
+	return nil
+}
+
+// deadLetterObject stores an object that could not be read. It returns the original
+// error if there is no dead-letter store, so the object is retried instead.
+func (s *Streamer) deadLetterObject(source recordSource, readErr error) error {
+	if s.deadLetters == nil {
+		return readErr
+	}
+	dl := newDeadLetter(source)
+	dl.Reason = readErr.Error()
+	err := s.writeDeadLetter(dl)
+	if err != nil {
+		return fmt.Errorf("%s; %s", readErr, err)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func (fs *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	fs.objects[aws.StringValue(input.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (fs *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(fs.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// rejectingSink rejects records with the eventID "reject".
+type rejectingSink struct {
+	*fakeSink
+}
+
+func (rs *rejectingSink) Send(record map[string]interface{}, encodedRecord []byte) error {
+	if record["eventID"] == "reject" {
+		return &recordRejectedError{"record rejected"}
+	}
+	return rs.fakeSink.Send(record, encodedRecord)
+}
+
+func testDeadLetterStore(t *testing.T) (*DirDeadLetterStore, func()) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewDirDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func readDeadLetters(t *testing.T, store DeadLetterStore) []*deadLetter {
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dls []*deadLetter
+	for _, name := range names {
+		data, err := store.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dl deadLetter
+		err = json.Unmarshal(data, &dl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dls = append(dls, &dl)
+	}
+	return dls
+}
+
+func TestStreamDeadLettersUnreadableObject(t *testing.T) {
+	store, cleanup := testDeadLetterStore(t)
+	defer cleanup()
+
+	fs := &fakeS3{objects: map[string][]byte{"bad.json": []byte(`{"Records": [{"eventID": "1"}, not json`)}}
+	ledger := NewMemoryLedger()
+	s := &Streamer{
+		sinks:       fixedSinks([]*streamerSink{{"fake", &fakeSink{}}}),
+		ledger:      ledger,
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+	}
+
+	err := s.Stream("us-east-1", "bucket", "bad.json", "")
+	if err == nil {
+		t.Fatal("Expected an error without a dead-letter store")
+	}
+
+	s.deadLetters = store
+	err = s.Stream("us-east-1", "bucket", "bad.json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dls := readDeadLetters(t, store)
+	if len(dls) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(dls))
+	}
+	if dls[0].Region != "us-east-1" || dls[0].Bucket != "bucket" || dls[0].Key != "bad.json" || dls[0].ETag == "" || dls[0].Reason == "" {
+		t.Fatalf("Unexpected dead letter %+v", dls[0])
+	}
+	processed, _ := ledger.IsProcessed(objectRef{Bucket: "bucket", Key: "bad.json", ETag: dls[0].ETag})
+	if !processed {
+		t.Fatal("Expected the dead-lettered object to be marked as processed")
+	}
+}
+
+func TestStreamToServicesDeadLettersRejectedRecords(t *testing.T) {
+	store, cleanup := testDeadLetterStore(t)
+	defer cleanup()
+
+	rejecting := &rejectingSink{&fakeSink{}}
+	other := &fakeSink{}
+	s := &Streamer{
+		sinks:       fixedSinks([]*streamerSink{{"rejecting", rejecting}, {"other", other}, {"limited", &limitedSink{&fakeSink{}, 100}}}),
+		deadLetters: store,
+	}
+
+	// A record of many small fields can't be truncated to fit the limited sink
+	tooLarge := map[string]interface{}{"eventID": "2"}
+	for i := 0; i < 20; i++ {
+		tooLarge[fmt.Sprintf("field%d", i)] = "x"
+	}
+	records := &sliceRecordReader{records: []map[string]interface{}{
+		{"eventID": "1"},
+		{"eventID": "reject"},
+		tooLarge,
+	}}
+	err := s.streamToServices(openSinks(t, s.sinks), records, recordSource{Bucket: "bucket", Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejecting.sent) != 1 || len(other.sent) != 2 {
+		t.Fatalf("Expected records to reach the sinks that accept them, got %d and %d", len(rejecting.sent), len(other.sent))
+	}
+
+	dls := readDeadLetters(t, store)
+	if len(dls) != 1 || len(dls[0].Records) != 2 {
+		t.Fatalf("Expected a dead letter with 2 records, got %+v", dls)
+	}
+	rejected, dropped := dls[0].Records[0], dls[0].Records[1]
+	if rejected.Sink != "rejecting" || rejected.Reason != "record rejected" || string(rejected.Record) != `{"eventID":"reject"}` {
+		t.Fatalf("Unexpected rejected record %+v", rejected)
+	}
+	if dropped.Sink != "" || !strings.Contains(dropped.Reason, "over the limit") || !strings.Contains(string(dropped.Record), `"field19":"x"`) {
+		t.Fatalf("Unexpected dropped record %+v", dropped)
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	store, cleanup := testDeadLetterStore(t)
+	defer cleanup()
+
+	fs := &fakeS3{objects: map[string][]byte{"good.json": []byte(`{"Records": [{"eventID": "1"}, {"eventID": "2"}]}`)}}
+	for _, dl := range []*deadLetter{
+		{Region: "us-east-1", Bucket: "bucket", Key: "good.json", Reason: "read failed"},
+		{Bucket: "bucket", Key: "other.json", Records: []*deadLetterRecord{
+			{Sink: "first", Reason: "rejected", Record: json.RawMessage(`{"eventID":"3"}`)},
+			{Reason: "too large", Record: json.RawMessage(`{"eventID":"4"}`)},
+		}},
+	} {
+		data, _ := json.Marshal(dl)
+		err := store.Put(dl.Key+".json", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := &fakeSink{}, &fakeSink{}
+	s := &Streamer{
+		sinks:       fixedSinks([]*streamerSink{{"first", first}, {"second", second}}),
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+	}
+	names, _ := store.List()
+	for _, name := range names {
+		err := s.redrive(store, name, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(first.sent) != 4 || len(second.sent) != 3 {
+		t.Fatalf("Expected 4 and 3 records sent, got %d and %d", len(first.sent), len(second.sent))
+	}
+	names, _ = store.List()
+	if len(names) != 0 {
+		t.Fatalf("Expected re-driven dead letters to be deleted, got %v", names)
+	}
+}
+
+func TestS3DeadLetterStore(t *testing.T) {
+	fs := &fakeS3{objects: map[string][]byte{"other/object.json": []byte("{}")}}
+	store := NewS3DeadLetterStore(fs, "bucket", "dead-letters")
+
+	for _, name := range []string{"b.json", "a.json"} {
+		err := store.Put(name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a.json,b.json" {
+		t.Fatalf("Unexpected dead letters %v", names)
+	}
+	data, err := store.Get("a.json")
+	if err != nil || string(data) != "a.json" {
+		t.Fatalf("Unexpected dead letter %s, %v", data, err)
+	}
+	err = store.Delete("a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.objects["dead-letters/a.json"]; ok {
+		t.Fatal("Expected the dead letter to be deleted")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const DEFAULT_DEDUP_MAX_EVENTS = 200000
+
+// recordDeduper remembers the eventID of records streamed within a time window, so
+// records that appear in more than one log file are only streamed once. It is kept in
+// memory, so it only dedups records seen by the same Lambda container.
+type recordDeduper struct {
+	window    time.Duration
+	maxEvents int
+	now       func() time.Time
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string // Event IDs in the order they were added, for expiry
+}
+
+func newRecordDeduper(window time.Duration, maxEvents int) *recordDeduper {
+	return &recordDeduper{
+		window:    window,
+		maxEvents: maxEvents,
+		now:       time.Now,
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// contains returns whether the event ID was added within the window.
+func (rd *recordDeduper) contains(eventID string) bool {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.expire()
+	_, ok := rd.seen[eventID]
+	return ok
+}
+
+// add remembers event IDs once their records have been successfully streamed. Adding
+// them any earlier would drop the records when a failed log file is retried.
+func (rd *recordDeduper) add(eventIDs []string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	now := rd.now()
+	for _, id := range eventIDs {
+		if _, ok := rd.seen[id]; ok {
+			continue
+		}
+		rd.seen[id] = now
+		rd.order = append(rd.order, id)
+	}
+	rd.expire()
+}
+
+// expire forgets event IDs that are older than the window, and the oldest event IDs
+// while there are more than maxEvents.
+func (rd *recordDeduper) expire() {
+	cutoff := rd.now().Add(-rd.window)
+	for len(rd.order) > 0 {
+		oldest := rd.order[0]
+		if len(rd.order) <= rd.maxEvents && !rd.seen[oldest].Before(cutoff) {
+			break
+		}
+		delete(rd.seen, oldest)
+		rd.order = rd.order[1:]
+	}
+}
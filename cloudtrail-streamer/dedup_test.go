@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordDeduperExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	rd := newRecordDeduper(time.Minute, 2)
+	rd.now = func() time.Time { return now }
+
+	rd.add([]string{"1"})
+	now = now.Add(30 * time.Second)
+	rd.add([]string{"2"})
+	if !rd.contains("1") || !rd.contains("2") {
+		t.Fatal("Expected both events within the window")
+	}
+
+	now = now.Add(45 * time.Second)
+	if rd.contains("1") {
+		t.Fatal("Expected event 1 to have expired")
+	}
+	if !rd.contains("2") {
+		t.Fatal("Expected event 2 to still be within the window")
+	}
+
+	rd.add([]string{"3", "4"})
+	if rd.contains("2") || !rd.contains("3") || !rd.contains("4") {
+		t.Fatal("Expected the oldest event to be dropped over maxEvents")
+	}
+}
+
+func TestStreamToServicesDedupsRecords(t *testing.T) {
+	sink := &fakeSink{}
+	s := &Streamer{
+		sinks:         fixedSinks([]*streamerSink{{"fake", sink}}),
+		recordDeduper: newRecordDeduper(time.Hour, DEFAULT_DEDUP_MAX_EVENTS),
+	}
+	records := func() *sliceRecordReader {
+		return &sliceRecordReader{records: []map[string]interface{}{
+			{"eventID": "1"}, {"eventID": "2"}, {"eventID": "1"}, {"noEventID": true},
+		}}
+	}
+
+	// Event IDs are not remembered when sending fails, so a retry sends them again
+	sink.flushErr = errors.New("flush failed")
+	err := s.streamToServices(openSinks(t, s.sinks), records(), recordSource{})
+	if err == nil {
+		t.Fatal("Expected error from failing sink")
+	}
+	if len(sink.sent) != 3 {
+		t.Fatalf("Expected 3 records sent, got %d", len(sink.sent))
+	}
+
+	sink.flushErr = nil
+	err = s.streamToServices(openSinks(t, s.sinks), records(), recordSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 6 {
+		t.Fatalf("Expected 6 records sent, got %d", len(sink.sent))
+	}
+
+	// Only the record without an eventID gets through now
+	err = s.streamToServices(openSinks(t, s.sinks), records(), recordSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 7 {
+		t.Fatalf("Expected 7 records sent, got %d", len(sink.sent))
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/yaml"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ALERT_SEVERITY_INFO     = "info"
+	ALERT_SEVERITY_WARN     = "warn"
+	ALERT_SEVERITY_CRITICAL = "critical"
+
+	ALERT_FIELD_UNKNOWN = "unknown" // Placeholder for template fields missing from the record
+)
+
+// DEFAULT_DETECTIONS are the detections run when detections are enabled, for events that
+// warrant an alert as soon as they are seen. Configured detections with the same name
+// replace them.
+const DEFAULT_DETECTIONS = `
+rules:
+  - name: root-console-login
+    severity: critical
+    category: aws_root_console_login
+    summary: "Root console login to AWS account {recipientAccountId} from {sourceIPAddress}"
+    match:
+      eventName: ConsoleLogin
+      userIdentity.type: Root
+      responseElements.ConsoleLogin: Success
+    metadata:
+      account: recipientAccountId
+      sourceaddress: sourceIPAddress
+      user_agent: userAgent
+
+  - name: cloudtrail-logging-stopped
+    severity: critical
+    category: aws_cloudtrail_logging_stopped
+    summary: "{eventName} of trail {requestParameters.name} in AWS account {recipientAccountId} by {userIdentity.arn}"
+    match:
+      eventSource: cloudtrail.amazonaws.com
+      eventName: /^(StopLogging|DeleteTrail)$/
+    metadata:
+      account: recipientAccountId
+      trail: requestParameters.name
+      username: userIdentity.arn
+      sourceaddress: sourceIPAddress
+      error_code: errorCode
+
+  - name: public-bucket-policy
+    severity: critical
+    category: aws_public_bucket_policy
+    summary: "Bucket {requestParameters.bucketName} in AWS account {recipientAccountId} made public by {userIdentity.arn}"
+    match:
+      eventName: PutBucketPolicy
+    elements:
+      requestParameters.bucketPolicy.Statement:
+        match:
+          Effect: Allow
+        any:
+          - match: {Principal: "*"}
+          - match: {Principal.AWS: "*"}
+    metadata:
+      account: recipientAccountId
+      bucket: requestParameters.bucketName
+      username: userIdentity.arn
+      sourceaddress: sourceIPAddress
+      error_code: errorCode
+
+  - name: root-access-key-created
+    severity: critical
+    category: aws_root_access_key_created
+    summary: "Access key created for the root user of AWS account {recipientAccountId}"
+    match:
+      eventName: CreateAccessKey
+      userIdentity.type: Root
+    not:
+      match:
+        requestParameters.userName: "*"
+    metadata:
+      account: recipientAccountId
+      sourceaddress: sourceIPAddress
+      error_code: errorCode
+`
+
+// alert has the schema of the alerts of the foxsec pipeline, common.Alert in the parent
+// module, whose fields it must be kept in sync with. The common package can't be imported,
+// even with a replace directive: it imports cloud.google.com/go/kms/apiv1, which is no
+// longer part of the cloud.google.com/go version the streamer's GCP clients select, and
+// the package target builds in a container that only holds this directory.
+type alert struct {
+	Id        string       `json:"id"`
+	Severity  string       `json:"severity"`
+	Category  string       `json:"category"`
+	Summary   string       `json:"summary"`
+	Payload   string       `json:"payload"`
+	Metadata  []*alertMeta `json:"metadata"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+type alertMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// DetectionConfig holds the rules that records are checked against as they are read.
+// An alert is emitted for every rule a record matches.
+type DetectionConfig struct {
+	Rules []*DetectionRule `yaml:"rules"`
+
+	topicId string // PubSub topic alerts are published to
+}
+
+// DetectionRule matches records with the conditions of a filter rule. The summary and
+// payload of its alerts are templates, where {path} is replaced by the value of the
+// field at that path in the record. If no payload is set, the record itself is used.
+// Metadata maps alert metadata keys to the record fields they are taken from.
+type DetectionRule struct {
+	Name     string            `yaml:"name"`
+	Severity string            `yaml:"severity"`
+	Category string            `yaml:"category"`
+	Summary  string            `yaml:"summary"`
+	Payload  string            `yaml:"payload"`
+	Metadata map[string]string `yaml:"metadata"`
+	Disabled bool              `yaml:"disabled"`
+
+	FilterRule `yaml:",inline"`
+
+	metadataKeys []string
+}
+
+var templateFieldRegexp = regexp.MustCompile(`\{([^{}\s]+)\}`)
+
+// loadDetectionConfig reads detections from CT_DETECTIONS_FILE and CT_DETECTIONS, which
+// are added to the default detections. Detections are only run when CT_DETECTION_TOPIC_ID
+// is set, otherwise nil is returned.
+func loadDetectionConfig() (*DetectionConfig, error) {
+	topicId := os.Getenv("CT_DETECTION_TOPIC_ID")
+	if topicId == "" {
+		return nil, nil
+	}
+	dc := &DetectionConfig{topicId: topicId}
+
+	if path := os.Getenv("CT_DETECTIONS_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = dc.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_DETECTIONS_FILE %s: %s", path, err)
+		}
+	}
+
+	if rules := os.Getenv("CT_DETECTIONS"); rules != "" {
+		err := dc.parse([]byte(rules))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_DETECTIONS: %s", err)
+		}
+	}
+
+	err := dc.parse([]byte(DEFAULT_DETECTIONS))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing default detections: %s", err)
+	}
+
+	err = dc.compile()
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (dc *DetectionConfig) parse(data []byte) error {
+	var parsed DetectionConfig
+	err := yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		return err
+	}
+	dc.Rules = append(dc.Rules, parsed.Rules...)
+	return nil
+}
+
+func (dc *DetectionConfig) compile() error {
+	var rules []*DetectionRule
+	seen := make(map[string]bool)
+	for _, r := range dc.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("Detection has no name")
+		}
+		// A configured detection overrides the default detection with the same name
+		if seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		if r.Disabled {
+			continue
+		}
+
+		if r.Severity == "" {
+			r.Severity = ALERT_SEVERITY_CRITICAL
+		}
+		if r.Severity != ALERT_SEVERITY_INFO && r.Severity != ALERT_SEVERITY_WARN && r.Severity != ALERT_SEVERITY_CRITICAL {
+			return fmt.Errorf("Detection %s has an invalid severity, %s, must be one of '%s', '%s' or '%s'", r.Name, r.Severity, ALERT_SEVERITY_INFO, ALERT_SEVERITY_WARN, ALERT_SEVERITY_CRITICAL)
+		}
+		if r.Category == "" {
+			r.Category = r.Name
+		}
+		if r.Summary == "" {
+			return fmt.Errorf("Detection %s has no summary", r.Name)
+		}
+		err := r.FilterRule.compileDetection()
+		if err != nil {
+			return fmt.Errorf("Detection %s is invalid: %s", r.Name, err)
+		}
+
+		r.metadataKeys = nil
+		for key := range r.Metadata {
+			r.metadataKeys = append(r.metadataKeys, key)
+		}
+		sort.Strings(r.metadataKeys)
+		rules = append(rules, r)
+	}
+	dc.Rules = rules
+	return nil
+}
+
+// Detect returns an alert for each rule that the record matches.
+func (dc *DetectionConfig) Detect(record map[string]interface{}) []*alert {
+	var alerts []*alert
+	for _, r := range dc.Rules {
+		if r.Matches(record) {
+			alerts = append(alerts, r.alert(record))
+		}
+	}
+	return alerts
+}
+
+func (r *DetectionRule) alert(record map[string]interface{}) *alert {
+	a := &alert{
+		Id:        alertId(r.Name, record),
+		Severity:  r.Severity,
+		Category:  r.Category,
+		Summary:   expandTemplate(r.Summary, record),
+		Timestamp: time.Now().UTC(),
+		Metadata:  []*alertMeta{{Key: "detection", Value: r.Name}},
+	}
+	if eventTime, ok := record["eventTime"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, eventTime); err == nil {
+			a.Timestamp = t.UTC()
+		}
+	}
+	if eventID, ok := record["eventID"].(string); ok {
+		a.Metadata = append(a.Metadata, &alertMeta{Key: "event_id", Value: eventID})
+	}
+	for _, key := range r.metadataKeys {
+		if value, ok := lookupField(record, strings.Split(r.Metadata[key], ".")); ok && value != "" {
+			a.Metadata = append(a.Metadata, &alertMeta{Key: key, Value: value})
+		}
+	}
+
+	if r.Payload != "" {
+		a.Payload = expandTemplate(r.Payload, record)
+	} else if data, err := json.Marshal(record); err == nil {
+		a.Payload = string(data)
+	}
+	return a
+}
+
+// alertId derives the id of an alert from the detection and the record, so a record
+// that is streamed again, such as by a replay, raises an alert with the same id.
+func alertId(detection string, record map[string]interface{}) string {
+	key, ok := record["eventID"].(string)
+	if !ok || key == "" {
+		data, _ := json.Marshal(record)
+		key = string(data)
+	}
+	sum := sha256.Sum256([]byte(detection + "/" + key))
+	// Formatted as a version 5 style UUID, like the ids of other foxsec alerts
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// expandTemplate replaces each {path} in tmpl with the value of the field at that path
+// in the record.
+func expandTemplate(tmpl string, record map[string]interface{}) string {
+	return templateFieldRegexp.ReplaceAllStringFunc(tmpl, func(field string) string {
+		value, ok := lookupField(record, strings.Split(field[1:len(field)-1], "."))
+		if !ok || value == "" {
+			return ALERT_FIELD_UNKNOWN
+		}
+		return value
+	})
+}
+
+// Detector runs the detections on records and publishes their alerts.
+type Detector struct {
+	config *DetectionConfig
+	sink   Sink // Where alerts are published, or nil to only log them
+}
+
+func NewDetector(config *DetectionConfig, sink Sink) *Detector {
+	return &Detector{config: config, sink: sink}
+}
+
+// Detect runs the detections on a record and queues its alerts for publishing.
+func (d *Detector) Detect(record map[string]interface{}) error {
+	var errs []string
+	for _, a := range d.config.Detect(record) {
+		log.Warnf("Raised %s alert %s: %s", a.Severity, a.Category, a.Summary)
+		if d.sink == nil {
+			continue
+		}
+		data, err := json.Marshal(a)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		err = d.sink.Send(nil, data)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Error publishing alerts: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (d *Detector) Flush() error {
+	if d.sink == nil {
+		return nil
+	}
+	return d.sink.Flush()
+}
+
+func (d *Detector) Close() error {
+	if d.sink == nil {
+		return nil
+	}
+	return d.sink.Close()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+var detectionTestRecords = map[string]string{
+	"rootLogin": `{"eventID": "1", "eventTime": "2026-10-16T12:00:00Z", "eventSource": "signin.amazonaws.com",
+		"eventName": "ConsoleLogin", "userIdentity": {"type": "Root", "arn": "arn:aws:iam::123456789012:root"},
+		"sourceIPAddress": "192.0.2.1", "recipientAccountId": "123456789012", "responseElements": {"ConsoleLogin": "Success"}}`,
+	"failedRootLogin": `{"eventID": "2", "eventSource": "signin.amazonaws.com", "eventName": "ConsoleLogin",
+		"userIdentity": {"type": "Root"}, "responseElements": {"ConsoleLogin": "Failure"}}`,
+	"stopLogging": `{"eventID": "3", "eventSource": "cloudtrail.amazonaws.com", "eventName": "StopLogging",
+		"userIdentity": {"type": "IAMUser", "arn": "arn:aws:iam::123456789012:user/mallory"},
+		"requestParameters": {"name": "main"}, "recipientAccountId": "123456789012"}`,
+	"publicPolicy": `{"eventID": "4", "eventSource": "s3.amazonaws.com", "eventName": "PutBucketPolicy",
+		"requestParameters": {"bucketName": "assets", "bucketPolicy": {"Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": "*"}, "Action": "s3:GetObject"}]}}}`,
+	"publicPolicyList": `{"eventID": "9", "eventSource": "s3.amazonaws.com", "eventName": "PutBucketPolicy",
+		"requestParameters": {"bucketName": "assets", "bucketPolicy": {"Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": ["arn:aws:iam::123456789012:root", "*"]}, "Action": "s3:GetObject"}]}}}`,
+	"denyPolicy": `{"eventID": "5", "eventSource": "s3.amazonaws.com", "eventName": "PutBucketPolicy",
+		"requestParameters": {"bucketName": "logs", "bucketPolicy": {"Statement": [
+			{"Effect": "Deny", "Principal": "*", "Action": "s3:*"},
+			{"Effect": "Allow", "Principal": {"Service": "cloudtrail.amazonaws.com"}, "Action": "s3:PutObject"}]}}}`,
+	"rootAccessKey": `{"eventID": "6", "eventSource": "iam.amazonaws.com", "eventName": "CreateAccessKey",
+		"userIdentity": {"type": "Root"}, "requestParameters": {}}`,
+	"userAccessKey": `{"eventID": "7", "eventSource": "iam.amazonaws.com", "eventName": "CreateAccessKey",
+		"userIdentity": {"type": "Root"}, "requestParameters": {"userName": "alice"}}`,
+	"describe": `{"eventID": "8", "eventSource": "cloudtrail.amazonaws.com", "eventName": "DescribeTrails"}`,
+}
+
+func decodeDetectionTestRecord(t *testing.T, name string) map[string]interface{} {
+	var record map[string]interface{}
+	err := json.Unmarshal([]byte(detectionTestRecords[name]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func newTestDetectionConfig(t *testing.T, rules string) *DetectionConfig {
+	os.Setenv("CT_DETECTION_TOPIC_ID", "alerts")
+	os.Setenv("CT_DETECTIONS", rules)
+	defer func() {
+		os.Unsetenv("CT_DETECTION_TOPIC_ID")
+		os.Unsetenv("CT_DETECTIONS")
+	}()
+
+	dc, err := loadDetectionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestDefaultDetections(t *testing.T) {
+	dc := newTestDetectionConfig(t, "")
+	for name, expected := range map[string]string{
+		"rootLogin":       "aws_root_console_login",
+		"failedRootLogin": "",
+		"stopLogging":     "aws_cloudtrail_logging_stopped",
+		"publicPolicy":    "aws_public_bucket_policy",
+		"denyPolicy":      "",
+		"rootAccessKey":   "aws_root_access_key_created",
+		"userAccessKey":   "",
+		"describe":        "",
+	} {
+		alerts := dc.Detect(decodeDetectionTestRecord(t, name))
+		var category string
+		if len(alerts) > 1 {
+			t.Errorf("Expected at most 1 alert for %s, got %d", name, len(alerts))
+		}
+		if len(alerts) == 1 {
+			category = alerts[0].Category
+		}
+		if category != expected {
+			t.Errorf("Expected alert %q for %s, got %q", expected, name, category)
+		}
+	}
+}
+
+func TestDetectionAlert(t *testing.T) {
+	dc := newTestDetectionConfig(t, "")
+	record := decodeDetectionTestRecord(t, "rootLogin")
+	alerts := dc.Detect(record)
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	a := alerts[0]
+	if a.Severity != ALERT_SEVERITY_CRITICAL || a.Summary != "Root console login to AWS account 123456789012 from 192.0.2.1" {
+		t.Fatalf("Unexpected alert %+v", a)
+	}
+	if !a.Timestamp.Equal(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected the alert to have the time of the event, got %s", a.Timestamp)
+	}
+	metadata := make(map[string]string)
+	for _, am := range a.Metadata {
+		metadata[am.Key] = am.Value
+	}
+	for key, value := range map[string]string{
+		"detection":     "root-console-login",
+		"event_id":      "1",
+		"account":       "123456789012",
+		"sourceaddress": "192.0.2.1",
+	} {
+		if metadata[key] != value {
+			t.Errorf("Expected metadata %s to be %q, got %q", key, value, metadata[key])
+		}
+	}
+	if _, ok := metadata["user_agent"]; ok {
+		t.Error("Expected metadata of missing fields to be left out")
+	}
+
+	var payload map[string]interface{}
+	err := json.Unmarshal([]byte(a.Payload), &payload)
+	if err != nil || payload["eventID"] != "1" {
+		t.Fatalf("Expected the record as the payload, got %s", a.Payload)
+	}
+
+	again := dc.Detect(decodeDetectionTestRecord(t, "rootLogin"))
+	if again[0].Id != a.Id || len(a.Id) != 36 {
+		t.Fatalf("Expected a stable id for the alert of a record, got %s and %s", a.Id, again[0].Id)
+	}
+	if dc.Detect(decodeDetectionTestRecord(t, "stopLogging"))[0].Id == a.Id {
+		t.Fatal("Expected alerts of different records to have different ids")
+	}
+
+	// The alert has the schema of foxsec alerts
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	for _, field := range []string{"id", "severity", "category", "summary", "payload", "metadata", "timestamp"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("Expected alert field %s", field)
+		}
+	}
+}
+
+func TestConfiguredDetections(t *testing.T) {
+	dc := newTestDetectionConfig(t, `
+rules:
+  - name: root-console-login
+    disabled: true
+  - name: cloudtrail-logging-stopped
+    severity: warn
+    summary: "{eventName} by {userIdentity.arn} from {sourceIPAddress}"
+    payload: "Trail {requestParameters.name} was stopped"
+    match:
+      eventName: StopLogging
+  - name: describe-trails
+    severity: info
+    summary: Trails described
+    match:
+      eventName: DescribeTrails
+`)
+	// One default detection is disabled and another detection is added
+	if len(dc.Rules) != len(newTestDetectionConfig(t, "").Rules) {
+		t.Fatalf("Unexpected number of detections, %d", len(dc.Rules))
+	}
+	if len(dc.Detect(decodeDetectionTestRecord(t, "rootLogin"))) != 0 {
+		t.Fatal("Expected a disabled detection not to run")
+	}
+
+	alerts := dc.Detect(decodeDetectionTestRecord(t, "stopLogging"))
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	a := alerts[0]
+	if a.Severity != ALERT_SEVERITY_WARN || a.Category != "cloudtrail-logging-stopped" ||
+		a.Summary != "StopLogging by arn:aws:iam::123456789012:user/mallory from unknown" ||
+		a.Payload != "Trail main was stopped" {
+		t.Fatalf("Unexpected alert %+v", a)
+	}
+	if len(dc.Detect(decodeDetectionTestRecord(t, "describe"))) != 1 {
+		t.Fatal("Expected a configured detection to run")
+	}
+
+	for _, rules := range []string{
+		"rules: [{summary: x, match: {eventName: x}}]",
+		"rules: [{name: x, summary: x}]",
+		"rules: [{name: x, match: {eventName: x}}]",
+		"rules: [{name: x, summary: x, severity: high, match: {eventName: x}}]",
+	} {
+		os.Setenv("CT_DETECTION_TOPIC_ID", "alerts")
+		os.Setenv("CT_DETECTIONS", rules)
+		_, err := loadDetectionConfig()
+		if err == nil {
+			t.Errorf("Expected an error loading %s", rules)
+		}
+	}
+	os.Unsetenv("CT_DETECTION_TOPIC_ID")
+	os.Unsetenv("CT_DETECTIONS")
+
+	dc, err := loadDetectionConfig()
+	if dc != nil || err != nil {
+		t.Fatal("Expected detections to be disabled without CT_DETECTION_TOPIC_ID")
+	}
+}
+
+func TestDetectionArrays(t *testing.T) {
+	dc := newTestDetectionConfig(t, `
+rules:
+  - name: any-principal
+    summary: Policy allows any principal
+    match:
+      requestParameters.bucketPolicy.Statement.Principal.AWS: "*"
+`)
+	// Unlike filter rules, arrays along the path of a field are passed through
+	for _, name := range []string{"publicPolicy", "publicPolicyList"} {
+		var matched bool
+		for _, a := range dc.Detect(decodeDetectionTestRecord(t, name)) {
+			matched = matched || a.Category == "any-principal"
+		}
+		if !matched {
+			t.Errorf("Expected %s to raise an any-principal alert", name)
+		}
+	}
+}
+
+func TestStreamToServicesDetections(t *testing.T) {
+	alerts := &fakeSink{}
+	sink := &fakeSink{}
+	s := &Streamer{
+		sinks:      fixedSinks([]*streamerSink{{"fake", sink}}),
+		detections: newTestDetectionConfig(t, ""),
+		alerts:     func() (Sink, error) { return alerts, nil },
+	}
+	globalConfig.filters = newTestFilterConfig(t, "deny: [{match: {eventSource: cloudtrail.amazonaws.com}}]")
+	defer func() { globalConfig.filters = nil }()
+
+	records := &sliceRecordReader{records: []map[string]interface{}{
+		decodeDetectionTestRecord(t, "stopLogging"),
+		decodeDetectionTestRecord(t, "rootLogin"),
+		decodeDetectionTestRecord(t, "describe"),
+	}}
+	err := s.streamToServices(openSinks(t, s.sinks), records, recordSource{Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 {
+		t.Fatalf("Expected 1 record streamed, got %d", len(sink.sent))
+	}
+	if len(alerts.sent) != 2 || alerts.flushed == 0 {
+		t.Fatalf("Expected 2 alerts published, including one for a filtered record, got %d", len(alerts.sent))
+	}
+	var a alert
+	err = json.Unmarshal(alerts.sent[0], &a)
+	if err != nil || a.Category != "aws_cloudtrail_logging_stopped" {
+		t.Fatalf("Unexpected alert %s", alerts.sent[0])
+	}
+
+	alerts.flushErr = errors.New("publish failed")
+	err = s.streamToServices(openSinks(t, s.sinks), &sliceRecordReader{records: []map[string]interface{}{
+		decodeDetectionTestRecord(t, "rootLogin"),
+	}}, recordSource{Key: "key"})
+	if err == nil {
+		t.Fatal("Expected an error when alerts fail to publish")
+	}
+}
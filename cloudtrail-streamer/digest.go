@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DIGEST_VALIDATION_TAG    = "tag"
+	DIGEST_VALIDATION_REJECT = "reject"
+
+	DIGEST_VALID   = "valid"
+	DIGEST_INVALID = "invalid"
+	DIGEST_MISSING = "missing"
+
+	DEFAULT_DIGEST_CHAIN_DEPTH = 1
+
+	// Digest files are delivered hourly, covering the log files delivered in the hour before
+	DIGEST_SEARCH_WINDOW = 2 * time.Hour
+	DIGEST_TIME_FORMAT   = "20060102T150405Z"
+	DIGEST_CACHE_SIZE    = 256
+
+	DIGEST_EVENT_SOURCE = "cloudtrail-streamer"
+	DIGEST_EVENT_NAME   = "LogFileValidationFailed"
+)
+
+var (
+	// AWSLogs/[o-orgid/]111122223333/CloudTrail/us-east-1/2026/10/16/<file>
+	logFileKeyRegex = regexp.MustCompile(`^(.*)/CloudTrail/([^/]+)/\d{4}/\d{2}/\d{2}/[^/]+$`)
+	digestTimeRegex = regexp.MustCompile(`_(\d{8}T\d{6}Z)\.json\.gz$`)
+)
+
+// digestFile is the content of a CloudTrail digest file. Fields that are null in the
+// first digest of a chain are left empty.
+type digestFile struct {
+	DigestStartTime            string `json:"digestStartTime"`
+	DigestEndTime              string `json:"digestEndTime"`
+	DigestS3Bucket             string `json:"digestS3Bucket"`
+	DigestS3Object             string `json:"digestS3Object"`
+	DigestPublicKeyFingerprint string `json:"digestPublicKeyFingerprint"`
+	DigestSignatureAlgorithm   string `json:"digestSignatureAlgorithm"`
+	PreviousDigestS3Bucket     string `json:"previousDigestS3Bucket"`
+	PreviousDigestS3Object     string `json:"previousDigestS3Object"`
+	PreviousDigestHashValue    string `json:"previousDigestHashValue"`
+	PreviousDigestSignature    string `json:"previousDigestSignature"`
+	LogFiles                   []struct {
+		S3Bucket  string `json:"s3Bucket"`
+		S3Object  string `json:"s3Object"`
+		HashValue string `json:"hashValue"`
+	} `json:"logFiles"`
+}
+
+// digest is a digest file along with the hash of its content and its signature, which
+// CloudTrail stores in the object metadata.
+type digest struct {
+	file      digestFile
+	hash      string
+	signature string
+	verified  bool
+}
+
+// signingString returns the string CloudTrail signs for a digest file.
+func (d *digest) signingString() string {
+	previousSignature := d.file.PreviousDigestSignature
+	if previousSignature == "" {
+		previousSignature = "null"
+	}
+	return fmt.Sprintf("%s\n%s/%s\n%s\n%s",
+		d.file.DigestEndTime, d.file.DigestS3Bucket, d.file.DigestS3Object, d.hash, previousSignature)
+}
+
+// validationResult is the outcome of validating a log file against its digest.
+type validationResult struct {
+	status string
+	reason string
+}
+
+// publicKeyCache holds the public keys CloudTrail signs digest files with, by fingerprint.
+// Keys that are not in the cache are fetched with the ListPublicKeys API of the region.
+type publicKeyCache struct {
+	mu    sync.Mutex
+	keys  map[string]*rsa.PublicKey
+	fetch func(awsRegion string) ([]*cloudtrail.PublicKey, error)
+}
+
+// publicKeyList is the output of `aws cloudtrail list-public-keys`.
+type publicKeyList struct {
+	PublicKeyList []struct {
+		Fingerprint string `json:"Fingerprint"`
+		Value       []byte `json:"Value"`
+	} `json:"PublicKeyList"`
+}
+
+func newPublicKeyCache(path string, fetch func(awsRegion string) ([]*cloudtrail.PublicKey, error)) (*publicKeyCache, error) {
+	pc := &publicKeyCache{keys: make(map[string]*rsa.PublicKey), fetch: fetch}
+	if path == "" {
+		return pc, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list publicKeyList
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading public keys from %s: %s", path, err)
+	}
+	for _, pk := range list.PublicKeyList {
+		err = pc.add(pk.Fingerprint, pk.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading public key %s from %s: %s", pk.Fingerprint, path, err)
+		}
+	}
+	return pc, nil
+}
+
+func (pc *publicKeyCache) add(fingerprint string, der []byte) error {
+	key, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return err
+	}
+	pc.keys[fingerprint] = key
+	return nil
+}
+
+func (pc *publicKeyCache) get(awsRegion string, fingerprint string) (*rsa.PublicKey, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if key, ok := pc.keys[fingerprint]; ok {
+		return key, nil
+	}
+	if pc.fetch != nil {
+		keys, err := pc.fetch(awsRegion)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing CloudTrail public keys in %s: %s", awsRegion, err)
+		}
+		for _, pk := range keys {
+			err = pc.add(aws.StringValue(pk.Fingerprint), pk.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if key, ok := pc.keys[fingerprint]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("No public key with fingerprint %s", fingerprint)
+}
+
+// digestValidator validates log files against the CloudTrail digest files delivered
+// alongside them: the log file hash must match the one in the digest, the digest must
+// be signed by CloudTrail, and the chain of previous digests must be intact up to
+// chainDepth digests back.
+type digestValidator struct {
+	mode       string
+	chainDepth int
+	keys       *publicKeyCache
+
+	mu      sync.Mutex
+	digests map[string]*digest // By bucket/key
+}
+
+func newDigestValidator(mode string, chainDepth int, keys *publicKeyCache) *digestValidator {
+	return &digestValidator{
+		mode:       mode,
+		chainDepth: chainDepth,
+		keys:       keys,
+		digests:    make(map[string]*digest),
+	}
+}
+
+// loadDigestValidator returns the digest validator configured in the environment, or
+// nil if validation is disabled.
+func loadDigestValidator() (*digestValidator, error) {
+	mode := os.Getenv("CT_DIGEST_VALIDATION")
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != DIGEST_VALIDATION_TAG && mode != DIGEST_VALIDATION_REJECT {
+		return nil, fmt.Errorf("CT_DIGEST_VALIDATION is set to an invalid value, %s, must be one of 'tag' or 'reject'", mode)
+	}
+
+	chainDepth := DEFAULT_DIGEST_CHAIN_DEPTH
+	if v := os.Getenv("CT_DIGEST_CHAIN_DEPTH"); v != "" {
+		var err error
+		chainDepth, err = strconv.Atoi(v)
+		if err != nil || chainDepth < 0 {
+			return nil, fmt.Errorf("CT_DIGEST_CHAIN_DEPTH must be a non-negative integer, got %s", v)
+		}
+	}
+
+	keys, err := newPublicKeyCache(os.Getenv("CT_DIGEST_PUBLIC_KEYS"), func(awsRegion string) ([]*cloudtrail.PublicKey, error) {
+		client := cloudtrail.New(globalConfig.awsSession, aws.NewConfig().WithRegion(awsRegion))
+		out, err := client.ListPublicKeys(&cloudtrail.ListPublicKeysInput{})
+		if err != nil {
+			return nil, err
+		}
+		return out.PublicKeyList, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newDigestValidator(mode, chainDepth, keys), nil
+}
+
+// validate checks a log file against the digest files in its bucket. logFileHash returns
+// the hash of the uncompressed content of the log file, and is only called once the
+// digest listing it has been found. An error is returned when validation could not be
+// completed, e.g. because S3 could not be reached.
+func (dv *digestValidator) validate(s3Client s3iface.S3API, ref objectRef, logFileHash func() (string, error)) (validationResult, error) {
+	match := logFileKeyRegex.FindStringSubmatch(ref.Key)
+	timeMatch := logFileTimeRegex.FindStringSubmatch(ref.Key)
+	if match == nil || timeMatch == nil {
+		return validationResult{DIGEST_MISSING, "not a CloudTrail log file"}, nil
+	}
+	awsRegion := match[2]
+	delivered, err := time.Parse(LOG_FILE_TIME_FORMAT, timeMatch[1])
+	if err != nil {
+		return validationResult{DIGEST_MISSING, "not a CloudTrail log file"}, nil
+	}
+
+	keys, err := listDigestFiles(s3Client, ref.Bucket, match[1], awsRegion, delivered)
+	if err != nil {
+		return validationResult{}, err
+	}
+	for _, key := range keys {
+		d, err := dv.getDigest(s3Client, ref.Bucket, key)
+		if err != nil {
+			return validationResult{}, err
+		}
+		for _, lf := range d.file.LogFiles {
+			if lf.S3Bucket != ref.Bucket || lf.S3Object != ref.Key {
+				continue
+			}
+			reason, err := dv.verifyDigest(s3Client, awsRegion, d, dv.chainDepth)
+			if err != nil {
+				return validationResult{}, err
+			}
+			if reason != "" {
+				return validationResult{DIGEST_INVALID, fmt.Sprintf("digest %s: %s", key, reason)}, nil
+			}
+			hash, err := logFileHash()
+			if err != nil {
+				return validationResult{}, err
+			}
+			if lf.HashValue != hash {
+				return validationResult{DIGEST_INVALID, fmt.Sprintf("hash does not match digest %s", key)}, nil
+			}
+			return validationResult{DIGEST_VALID, ""}, nil
+		}
+	}
+
+	return validationResult{DIGEST_MISSING, "not listed in any digest file yet"}, nil
+}
+
+// listDigestFiles returns the keys of the digest files that may list a log file delivered
+// at the given time, oldest first.
+func listDigestFiles(s3Client s3iface.S3API, bucket string, prefix string, awsRegion string, delivered time.Time) ([]string, error) {
+	var keys []string
+	last := delivered.Add(DIGEST_SEARCH_WINDOW)
+	days := []time.Time{delivered}
+	if last.Format("2006/01/02") != delivered.Format("2006/01/02") {
+		days = append(days, last)
+	}
+
+	for _, day := range days {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(fmt.Sprintf("%s/CloudTrail-Digest/%s/%s/", prefix, awsRegion, day.Format("2006/01/02"))),
+		}
+		err := s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				key := aws.StringValue(object.Key)
+				match := digestTimeRegex.FindStringSubmatch(key)
+				if match == nil {
+					continue
+				}
+				t, err := time.Parse(DIGEST_TIME_FORMAT, match[1])
+				if err != nil || t.Before(delivered) || t.After(last) {
+					continue
+				}
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing digest files in %s: %s", bucket, err)
+		}
+	}
+
+	// The timestamp is at the same position in every digest file name of a trail
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// getDigest fetches and parses a digest file, caching it so consecutive log files
+// listed in the same digest only fetch it once.
+func (dv *digestValidator) getDigest(s3Client s3iface.S3API, bucket string, key string) (*digest, error) {
+	id := bucket + "/" + key
+	dv.mu.Lock()
+	d, ok := dv.digests[id]
+	dv.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	object, err := fetchLogFromS3(s3Client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readDecompressed(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading digest file %s: %s", key, err)
+	}
+
+	d = &digest{signature: metadataValue(object.Metadata, "signature")}
+	hash := sha256.Sum256(data)
+	d.hash = hex.EncodeToString(hash[:])
+	err = json.Unmarshal(data, &d.file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing digest file %s: %s", key, err)
+	}
+
+	dv.mu.Lock()
+	if len(dv.digests) >= DIGEST_CACHE_SIZE {
+		dv.digests = make(map[string]*digest)
+	}
+	dv.digests[id] = d
+	dv.mu.Unlock()
+	return d, nil
+}
+
+// verifyDigest checks the signature of a digest and of up to depth previous digests in
+// its chain. It returns why the chain is invalid, or an empty string if it is valid.
+func (dv *digestValidator) verifyDigest(s3Client s3iface.S3API, awsRegion string, d *digest, depth int) (string, error) {
+	dv.mu.Lock()
+	verified := d.verified
+	dv.mu.Unlock()
+	if verified {
+		return "", nil
+	}
+
+	if d.file.DigestSignatureAlgorithm != "SHA256withRSA" {
+		return fmt.Sprintf("unsupported signature algorithm %s", d.file.DigestSignatureAlgorithm), nil
+	}
+	key, err := dv.keys.get(awsRegion, d.file.DigestPublicKeyFingerprint)
+	if err != nil {
+		return "", err
+	}
+	signature, err := hex.DecodeString(d.signature)
+	if err != nil || len(signature) == 0 {
+		return "missing or malformed signature", nil
+	}
+	hashed := sha256.Sum256([]byte(d.signingString()))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return "signature does not match", nil
+	}
+
+	if depth > 0 && d.file.PreviousDigestS3Object != "" {
+		previous, err := dv.getDigest(s3Client, d.file.PreviousDigestS3Bucket, d.file.PreviousDigestS3Object)
+		if err != nil {
+			return "", err
+		}
+		if previous.hash != d.file.PreviousDigestHashValue {
+			return fmt.Sprintf("hash of previous digest %s does not match", d.file.PreviousDigestS3Object), nil
+		}
+		if previous.signature != d.file.PreviousDigestSignature {
+			return fmt.Sprintf("signature of previous digest %s does not match", d.file.PreviousDigestS3Object), nil
+		}
+		reason, err := dv.verifyDigest(s3Client, awsRegion, previous, depth-1)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	dv.mu.Lock()
+	d.verified = true
+	dv.mu.Unlock()
+	return "", nil
+}
+
+// metadataValue looks up S3 object metadata, whose keys the SDK canonicalizes.
+func metadataValue(metadata map[string]*string, name string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, name) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// readDecompressed reads a whole, possibly compressed, object.
+func readDecompressed(body io.ReadCloser) ([]byte, error) {
+	closers := []io.Closer{body}
+	defer closeAll(closers)
+	r, err := decompress(body, &closers)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// hashLogFile returns the hash of the uncompressed content of a log file, which is hashed
+// as it is read rather than held in memory. It closes body.
+func hashLogFile(body io.ReadCloser) (string, error) {
+	closers := []io.Closer{body}
+	defer closeAll(closers)
+	r, err := decompress(body, &closers)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// validateLogFile validates a log file against its digest before it is streamed, and
+// sets the status records are tagged with on source. Hashing the log file reads its
+// body, so the body is replaced with that of the object fetched again when its records
+// are to be streamed. It returns whether the records of the log file should be streamed.
+func (s *Streamer) validateLogFile(awsRegion string, ref objectRef, object *s3.GetObjectOutput, sinks []*streamerSink, source *recordSource) (bool, error) {
+	s3Client := s.s3ClientFor(awsRegion)
+	hashed := false
+	result, err := s.digestValidator.validate(s3Client, ref, func() (string, error) {
+		hashed = true
+		hash, err := hashLogFile(object.Body)
+		if err != nil {
+			return "", fmt.Errorf("Error reading %s: %s", ref.id(), err)
+		}
+		return hash, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error validating %s: %s", ref.id(), err)
+	}
+	source.Validation = result.status
+
+	switch result.status {
+	case DIGEST_INVALID:
+		log.Errorf("Log file %s failed digest validation: %s", ref.id(), result.reason)
+		err = s.sendEvent(sinks, logFileValidationEvent(ref, result.reason))
+		if err != nil {
+			return false, err
+		}
+		if s.digestValidator.mode == DIGEST_VALIDATION_REJECT {
+			log.Warnf("Rejected records from %s", ref.id())
+			return false, nil
+		}
+	case DIGEST_MISSING:
+		log.Warnf("Log file %s can't be validated: %s", ref.id(), result.reason)
+		if s.digestValidator.mode == DIGEST_VALIDATION_REJECT {
+			if s.deadLetters == nil {
+				// Only dry runs reject without a dead-letter store
+				log.Warnf("Rejected records from %s", ref.id())
+				return false, nil
+			}
+			// Keep the log file in the dead-letter store, so it is validated again when it
+			// is re-driven once its digest has been delivered
+			return false, s.deadLetterObject(*source, fmt.Errorf("Log file can't be validated: %s", result.reason))
+		}
+	}
+
+	if hashed {
+		// Stream the records of the object that was hashed, failing if it was replaced since
+		refetched, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(ref.Bucket),
+			Key:     aws.String(ref.Key),
+			IfMatch: object.ETag,
+		})
+		if err != nil {
+			return false, fmt.Errorf("Error fetching %s again after validating it: %s", ref.id(), err)
+		}
+		object.Body = refetched.Body
+	}
+	return true, nil
+}
+
+// logFileValidationEvent returns the security event sent when a log file fails
+// validation. It is shaped like a CloudTrail record, so it can be filtered and
+// alerted on like one.
+func logFileValidationEvent(ref objectRef, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"eventVersion": "1.0",
+		"eventSource":  DIGEST_EVENT_SOURCE,
+		"eventName":    DIGEST_EVENT_NAME,
+		"eventType":    "SecurityEvent",
+		"eventTime":    time.Now().UTC().Format(time.RFC3339),
+		"errorMessage": reason,
+		"requestParameters": map[string]interface{}{
+			"bucketName": ref.Bucket,
+			"key":        ref.Key,
+			"eTag":       ref.ETag,
+		},
+	}
+}
+
+// sendEvent sends a single record generated by the streamer to the sinks of an object,
+// bypassing filters and enrichment.
+func (s *Streamer) sendEvent(sinks []*streamerSink, record map[string]interface{}) error {
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var errs sinkErrors
+	for _, ss := range sinks {
+		errs.add(ss.name, ss.sink.Send(record, encodedRecord))
+	}
+	for _, ss := range sinks {
+		errs.add(ss.name, ss.sink.Flush())
+	}
+	return errs.err()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	testLogKey            = "AWSLogs/111122223333/CloudTrail/us-east-1/2026/10/16/111122223333_CloudTrail_us-east-1_20261016T2305Z_abc.json.gz"
+	testDigestKey         = "AWSLogs/111122223333/CloudTrail-Digest/us-east-1/2026/10/17/111122223333_CloudTrail-Digest_us-east-1_trail_us-east-1_20261017T000000Z.json.gz"
+	testPreviousDigestKey = "AWSLogs/111122223333/CloudTrail-Digest/us-east-1/2026/10/16/111122223333_CloudTrail-Digest_us-east-1_trail_us-east-1_20261016T230000Z.json.gz"
+	testFingerprint       = "0123456789abcdef0123456789abcdef"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+func hexSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// addDigest signs a digest file and adds it to the fake S3 bucket, returning its hash
+// and signature.
+func addDigest(t *testing.T, fs *fakeS3, key *rsa.PrivateKey, objectKey string, file digestFile) (string, string) {
+	file.DigestS3Bucket = "bucket"
+	file.DigestS3Object = objectKey
+	file.DigestPublicKeyFingerprint = testFingerprint
+	file.DigestSignatureAlgorithm = "SHA256withRSA"
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &digest{file: file, hash: hexSHA256(data)}
+	hashed := sha256.Sum256([]byte(d.signingString()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.objects[objectKey] = gzipBytes(t, data)
+	fs.metadata[objectKey] = map[string]*string{
+		"Signature":           aws.String(hex.EncodeToString(signature)),
+		"Signature-Algorithm": aws.String("SHA256withRSA"),
+	}
+	return d.hash, hex.EncodeToString(signature)
+}
+
+// newDigestTestBucket returns a bucket with a log file and a chain of two digest files,
+// the second of which lists the log file.
+func newDigestTestBucket(t *testing.T, key *rsa.PrivateKey) *fakeS3 {
+	fs := &fakeS3{objects: make(map[string][]byte), metadata: make(map[string]map[string]*string)}
+	logFile := []byte(`{"Records":[{"eventID":"1","eventName":"GetObject"}]}`)
+	fs.objects[testLogKey] = gzipBytes(t, logFile)
+
+	previousHash, previousSignature := addDigest(t, fs, key, testPreviousDigestKey, digestFile{
+		DigestStartTime: "2026-10-16T22:00:00Z",
+		DigestEndTime:   "2026-10-16T23:00:00Z",
+	})
+	file := digestFile{
+		DigestStartTime:         "2026-10-16T23:00:00Z",
+		DigestEndTime:           "2026-10-17T00:00:00Z",
+		PreviousDigestS3Bucket:  "bucket",
+		PreviousDigestS3Object:  testPreviousDigestKey,
+		PreviousDigestHashValue: previousHash,
+		PreviousDigestSignature: previousSignature,
+	}
+	file.LogFiles = append(file.LogFiles, struct {
+		S3Bucket  string `json:"s3Bucket"`
+		S3Object  string `json:"s3Object"`
+		HashValue string `json:"hashValue"`
+	}{"bucket", testLogKey, hexSHA256(logFile)})
+	addDigest(t, fs, key, testDigestKey, file)
+	return fs
+}
+
+func newDigestTestStreamer(fs *fakeS3, key *rsa.PrivateKey, mode string) (*Streamer, *fakeSink) {
+	keys := &publicKeyCache{keys: map[string]*rsa.PublicKey{testFingerprint: &key.PublicKey}}
+	sink := &fakeSink{}
+	return &Streamer{
+		sinks:           fixedSinks([]*streamerSink{{"fake", sink}}),
+		digestValidator: newDigestValidator(mode, DEFAULT_DIGEST_CHAIN_DEPTH, keys),
+		s3ClientFor:     func(awsRegion string) s3iface.S3API { return fs },
+	}, sink
+}
+
+// noHash is passed to validate when the hash of the log file should not matter.
+func noHash() (string, error) {
+	return "", nil
+}
+
+func TestDigestValidation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newDigestTestBucket(t, key)
+	s, sink := newDigestTestStreamer(fs, key, DIGEST_VALIDATION_TAG)
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || !strings.Contains(string(sink.sent[0]), `"logFileValidation":"valid"`) {
+		t.Fatalf("Expected a record tagged as valid, got %q", sink.sent)
+	}
+
+	// A log file that was modified after delivery is tagged, and reported
+	fs.objects[testLogKey] = gzipBytes(t, []byte(`{"Records":[{"eventID":"2","eventName":"GetObject"}]}`))
+	s, sink = newDigestTestStreamer(fs, key, DIGEST_VALIDATION_TAG)
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 2 || !strings.Contains(string(sink.sent[0]), DIGEST_EVENT_NAME) ||
+		!strings.Contains(string(sink.sent[1]), `"logFileValidation":"invalid"`) {
+		t.Fatalf("Expected a validation event and a record tagged as invalid, got %q", sink.sent)
+	}
+
+	// In reject mode only the validation event is sent
+	s, sink = newDigestTestStreamer(fs, key, DIGEST_VALIDATION_REJECT)
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || !strings.Contains(string(sink.sent[0]), DIGEST_EVENT_NAME) {
+		t.Fatalf("Expected only a validation event, got %q", sink.sent)
+	}
+}
+
+func TestDigestValidationBrokenChain(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A digest signed with another key
+	fs := newDigestTestBucket(t, key)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newDigestTestStreamer(fs, other, DIGEST_VALIDATION_TAG)
+	result, err := s.digestValidator.validate(fs, objectRef{Bucket: "bucket", Key: testLogKey}, noHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.status != DIGEST_INVALID || !strings.Contains(result.reason, "signature does not match") {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	// A previous digest that was replaced
+	fs = newDigestTestBucket(t, key)
+	addDigest(t, fs, key, testPreviousDigestKey, digestFile{DigestEndTime: "2026-10-16T23:00:00Z"})
+	s, _ = newDigestTestStreamer(fs, key, DIGEST_VALIDATION_TAG)
+	result, err = s.digestValidator.validate(fs, objectRef{Bucket: "bucket", Key: testLogKey}, noHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.status != DIGEST_INVALID || !strings.Contains(result.reason, "hash of previous digest") {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+}
+
+func TestDigestValidationMissingDigest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newDigestTestBucket(t, key)
+	delete(fs.objects, testDigestKey)
+
+	s, sink := newDigestTestStreamer(fs, key, DIGEST_VALIDATION_TAG)
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || !strings.Contains(string(sink.sent[0]), `"logFileValidation":"missing"`) {
+		t.Fatalf("Expected a record tagged as missing, got %q", sink.sent)
+	}
+
+	// Rejecting without a dead-letter store, as dry runs do, drops the records
+	s, sink = newDigestTestStreamer(fs, key, DIGEST_VALIDATION_REJECT)
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 0 {
+		t.Fatalf("Expected no records, got %q", sink.sent)
+	}
+}
+
+func TestDigestValidationRejectRequiresDeadLetter(t *testing.T) {
+	os.Setenv("CT_DIGEST_VALIDATION", DIGEST_VALIDATION_REJECT)
+	os.Setenv("CT_KINESIS_STREAM", "stream")
+	defer func() {
+		os.Unsetenv("CT_DIGEST_VALIDATION")
+		os.Unsetenv("CT_KINESIS_STREAM")
+	}()
+
+	c := &Config{}
+	err := c.init()
+	if err == nil || !strings.Contains(err.Error(), "CT_DEAD_LETTER") {
+		t.Fatalf("Expected an error requiring CT_DEAD_LETTER, got %v", err)
+	}
+}
+
+func TestDigestValidationDefersMissingDigest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newDigestTestBucket(t, key)
+	digest := fs.objects[testDigestKey]
+	delete(fs.objects, testDigestKey)
+
+	store, cleanup := testDeadLetterStore(t)
+	defer cleanup()
+	s, sink := newDigestTestStreamer(fs, key, DIGEST_VALIDATION_REJECT)
+	s.deadLetters = store
+	s.ledger = NewMemoryLedger()
+
+	// The log file is kept in the dead-letter store until its digest is delivered
+	err = s.Stream("us-east-1", "bucket", testLogKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 0 {
+		t.Fatalf("Expected no records, got %q", sink.sent)
+	}
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("Expected a dead letter, got %v", names)
+	}
+
+	fs.objects[testDigestKey] = digest
+	s.ledger = nil
+	err = s.redrive(store, names[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || !strings.Contains(string(sink.sent[0]), `"logFileValidation":"valid"`) {
+		t.Fatalf("Expected a record tagged as valid, got %q", sink.sent)
+	}
+}
+
+func TestPublicKeyCache(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "public_keys.json")
+	data := fmt.Sprintf(`{"PublicKeyList": [{"Fingerprint": "%s", "Value": "%s"}]}`,
+		testFingerprint, base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&key.PublicKey)))
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := newPublicKeyCache(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := pc.get("us-east-1", testFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.N.Cmp(key.PublicKey.N) != 0 {
+		t.Fatal("Unexpected public key")
+	}
+	_, err = pc.get("us-east-1", "unknown")
+	if err == nil {
+		t.Fatal("Expected error getting an unknown public key")
+	}
+}
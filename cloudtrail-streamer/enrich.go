@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/yaml"
+	"github.com/oschwald/maxminddb-golang"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ENRICHMENT_FIELD is the top level field of a record that enrichers add their fields
+// to, so they never collide with fields of the record itself.
+const ENRICHMENT_FIELD = "enrichment"
+
+// recordSource identifies the log file a record was read from.
+type recordSource struct {
+	Region     string
+	Bucket     string
+	Key        string
+	ETag       string
+	Validation string // Digest validation status of the log file, if validation is enabled
+}
+
+// Enricher adds context to records before they are sent to the sinks. Enrichment is
+// best effort, a record that can't be enriched is still streamed.
+type Enricher interface {
+	Enrich(record map[string]interface{}, source recordSource)
+}
+
+// loadEnrichers returns the enrichers enabled in the environment, in the order they run.
+func loadEnrichers() ([]Enricher, error) {
+	var enrichers []Enricher
+
+	if path := os.Getenv("CT_ENRICH_ACCOUNT_ALIASES"); path != "" {
+		e, err := newAccountAliasEnricher(path)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, e)
+	}
+
+	if paths := os.Getenv("CT_ENRICH_GEOIP_DBS"); paths != "" {
+		e, err := newGeoIPEnricher(strings.Split(paths, ","))
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, e)
+	}
+
+	if os.Getenv("CT_ENRICH_SOURCE") == "1" {
+		enrichers = append(enrichers, sourceEnricher{})
+	}
+
+	if os.Getenv("CT_ENRICH_INGESTION_TIME") == "1" {
+		enrichers = append(enrichers, ingestionTimeEnricher{now: time.Now})
+	}
+
+	return enrichers, nil
+}
+
+// enrichmentFields returns the map enrichers add their fields to, creating it if needed.
+func enrichmentFields(record map[string]interface{}) map[string]interface{} {
+	fields, ok := record[ENRICHMENT_FIELD].(map[string]interface{})
+	if !ok {
+		fields = make(map[string]interface{})
+		record[ENRICHMENT_FIELD] = fields
+	}
+	return fields
+}
+
+// accountAliasEnricher adds the aliases of the account the record was delivered for
+// and of the account of the identity that made the call, from a YAML map of account
+// IDs to aliases.
+type accountAliasEnricher struct {
+	aliases map[string]string
+}
+
+func newAccountAliasEnricher(path string) (*accountAliasEnricher, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &accountAliasEnricher{}
+	err = yaml.Unmarshal(data, &e.aliases)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing account aliases from %s: %s", path, err)
+	}
+	return e, nil
+}
+
+func (e *accountAliasEnricher) Enrich(record map[string]interface{}, source recordSource) {
+	if accountId, ok := record["recipientAccountId"].(string); ok {
+		if alias, ok := e.aliases[accountId]; ok {
+			enrichmentFields(record)["accountAlias"] = alias
+		}
+	}
+	if identity, ok := record["userIdentity"].(map[string]interface{}); ok {
+		if accountId, ok := identity["accountId"].(string); ok {
+			if alias, ok := e.aliases[accountId]; ok {
+				enrichmentFields(record)["userIdentityAccountAlias"] = alias
+			}
+		}
+	}
+}
+
+// ipLookup is implemented by maxminddb.Reader.
+type ipLookup interface {
+	Lookup(ip net.IP, result interface{}) error
+}
+
+// geoIPRecord holds the fields read from MaxMind City and ASN databases. Fields missing
+// from a database are left empty.
+type geoIPRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIPEnricher adds the location and ASN of sourceIPAddress, merging the results of
+// every configured database.
+type geoIPEnricher struct {
+	dbs []ipLookup
+}
+
+func newGeoIPEnricher(paths []string) (*geoIPEnricher, error) {
+	e := &geoIPEnricher{}
+	for _, path := range paths {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening GeoIP database %s: %s", path, err)
+		}
+		e.dbs = append(e.dbs, db)
+	}
+	return e, nil
+}
+
+func (e *geoIPEnricher) Enrich(record map[string]interface{}, source recordSource) {
+	// sourceIPAddress holds a service name rather than an address for calls made by AWS services
+	address, _ := record["sourceIPAddress"].(string)
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	}
+
+	var result geoIPRecord
+	for _, db := range e.dbs {
+		err := db.Lookup(ip, &result)
+		if err != nil {
+			log.Debugf("Error looking up %s in GeoIP database: %s", address, err)
+		}
+	}
+
+	fields := make(map[string]interface{})
+	if result.Country.ISOCode != "" {
+		fields["country"] = result.Country.ISOCode
+	}
+	if city := result.City.Names["en"]; city != "" {
+		fields["city"] = city
+	}
+	if result.Location.Latitude != 0 || result.Location.Longitude != 0 {
+		fields["latitude"] = result.Location.Latitude
+		fields["longitude"] = result.Location.Longitude
+	}
+	if result.AutonomousSystemNumber != 0 {
+		fields["asn"] = result.AutonomousSystemNumber
+		fields["asOrganization"] = result.AutonomousSystemOrganization
+	}
+	if len(fields) > 0 {
+		enrichmentFields(record)["sourceIPAddress"] = fields
+	}
+}
+
+// sourceEnricher adds the bucket and key of the log file the record was read from.
+type sourceEnricher struct{}
+
+func (sourceEnricher) Enrich(record map[string]interface{}, source recordSource) {
+	fields := enrichmentFields(record)
+	if source.Bucket != "" {
+		fields["s3Bucket"] = source.Bucket
+	}
+	fields["s3Key"] = source.Key
+}
+
+// ingestionTimeEnricher adds the time the record was streamed.
+type ingestionTimeEnricher struct {
+	now func() time.Time
+}
+
+func (e ingestionTimeEnricher) Enrich(record map[string]interface{}, source recordSource) {
+	enrichmentFields(record)["ingestionTime"] = e.now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeGeoIPDB struct {
+	records map[string]func(*geoIPRecord)
+}
+
+func (fdb *fakeGeoIPDB) Lookup(ip net.IP, result interface{}) error {
+	if fill, ok := fdb.records[ip.String()]; ok {
+		fill(result.(*geoIPRecord))
+	}
+	return nil
+}
+
+func TestAccountAliasEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aliases.yaml")
+	err = ioutil.WriteFile(path, []byte("\"111122223333\": prod\n\"444455556666\": security\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newAccountAliasEnricher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{
+		"recipientAccountId": "111122223333",
+		"userIdentity":       map[string]interface{}{"accountId": "444455556666"},
+	}
+	e.Enrich(record, recordSource{})
+	expected := map[string]interface{}{"accountAlias": "prod", "userIdentityAccountAlias": "security"}
+	if !reflect.DeepEqual(record[ENRICHMENT_FIELD], expected) {
+		t.Fatalf("Unexpected enrichment %v", record[ENRICHMENT_FIELD])
+	}
+
+	// Unknown accounts are left alone
+	record = map[string]interface{}{"recipientAccountId": "999999999999"}
+	e.Enrich(record, recordSource{})
+	if _, ok := record[ENRICHMENT_FIELD]; ok {
+		t.Fatalf("Unexpected enrichment %v", record[ENRICHMENT_FIELD])
+	}
+}
+
+func TestGeoIPEnricher(t *testing.T) {
+	city := &fakeGeoIPDB{records: map[string]func(*geoIPRecord){
+		"203.0.113.10": func(r *geoIPRecord) {
+			r.Country.ISOCode = "US"
+			r.City.Names = map[string]string{"en": "Portland"}
+			r.Location.Latitude = 45.5
+			r.Location.Longitude = -122.6
+		},
+	}}
+	asn := &fakeGeoIPDB{records: map[string]func(*geoIPRecord){
+		"203.0.113.10": func(r *geoIPRecord) {
+			r.AutonomousSystemNumber = 64496
+			r.AutonomousSystemOrganization = "Example"
+		},
+	}}
+	e := &geoIPEnricher{dbs: []ipLookup{city, asn}}
+
+	record := map[string]interface{}{"sourceIPAddress": "203.0.113.10"}
+	e.Enrich(record, recordSource{})
+	expected := map[string]interface{}{
+		"country":        "US",
+		"city":           "Portland",
+		"latitude":       45.5,
+		"longitude":      -122.6,
+		"asn":            uint(64496),
+		"asOrganization": "Example",
+	}
+	if !reflect.DeepEqual(enrichmentFields(record)["sourceIPAddress"], expected) {
+		t.Fatalf("Unexpected enrichment %v", record[ENRICHMENT_FIELD])
+	}
+
+	// Calls made by AWS services have a service name instead of an address
+	for _, address := range []string{"ec2.amazonaws.com", "AWS Internal", "198.51.100.1"} {
+		record = map[string]interface{}{"sourceIPAddress": address}
+		e.Enrich(record, recordSource{})
+		if _, ok := record[ENRICHMENT_FIELD]; ok {
+			t.Fatalf("Unexpected enrichment for %s: %v", address, record[ENRICHMENT_FIELD])
+		}
+	}
+}
+
+func TestLoadEnrichers(t *testing.T) {
+	os.Setenv("CT_ENRICH_SOURCE", "1")
+	os.Setenv("CT_ENRICH_INGESTION_TIME", "1")
+	defer os.Unsetenv("CT_ENRICH_SOURCE")
+	defer os.Unsetenv("CT_ENRICH_INGESTION_TIME")
+
+	enrichers, err := loadEnrichers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrichers) != 2 {
+		t.Fatalf("Expected 2 enrichers, got %d", len(enrichers))
+	}
+
+	os.Setenv("CT_ENRICH_GEOIP_DBS", "testdata/missing.mmdb")
+	defer os.Unsetenv("CT_ENRICH_GEOIP_DBS")
+	_, err = loadEnrichers()
+	if err == nil {
+		t.Fatal("Expected error opening a missing GeoIP database")
+	}
+}
+
+func TestStreamFileEnrichment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	s := &Streamer{
+		sinks:     fixedSinks([]*streamerSink{{"stdout", NewStdoutStreamer(buf)}}),
+		enrichers: []Enricher{sourceEnricher{}, ingestionTimeEnricher{now: func() time.Time { return now }}},
+	}
+
+	err := s.StreamFile("testdata/example.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(lines))
+	}
+	expected := `{"enrichment":{"ingestionTime":"2026-10-16T12:00:00Z","s3Key":"testdata/example.json.gz"},"event":1}`
+	if lines[0] != expected {
+		t.Fatalf("Unexpected output %s", lines[0])
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/yaml"
+)
+
+// FilterConfig holds the rules deciding which records are streamed. If any allow
+// rules are set, only records matching at least one of them are streamed. Records
+// matching any deny rule are never streamed, even if they also match an allow rule.
+type FilterConfig struct {
+	Allow []*FilterRule `yaml:"allow"`
+	Deny  []*FilterRule `yaml:"deny"`
+}
+
+// FilterRule matches a record when all of its conditions match:
+//   - every field in Match matches its pattern
+//   - every array in Elements has an element matching its rule
+//   - every rule in All matches
+//   - at least one rule in Any matches, if Any is set
+//   - the rule in Not does not match, if Not is set
+//
+// Fields are dot separated paths into the record, e.g. userIdentity.type. Patterns
+// are globs, where * matches any run of characters and ? matches a single character,
+// or regular expressions when wrapped in slashes, e.g. /^(Describe|List)/. Booleans
+// and numbers are matched against their JSON representation. A field that is missing
+// from the record, or that holds an object or array, never matches. In the rules of
+// detections, arrays along the path are passed through instead, so a field matches if
+// any of the values at its path does.
+//
+// Rules in Elements are matched against each object of the array at their path, so
+// that several fields can be required to match in the same element, e.g. the Effect
+// and Principal of a single policy statement.
+type FilterRule struct {
+	Match    map[string]string      `yaml:"match"`
+	Elements map[string]*FilterRule `yaml:"elements"`
+	All      []*FilterRule          `yaml:"all"`
+	Any      []*FilterRule          `yaml:"any"`
+	Not      *FilterRule            `yaml:"not"`
+
+	matchers        []*fieldMatcher
+	elementMatchers []*elementMatcher
+}
+
+type fieldMatcher struct {
+	path    []string
+	pattern *regexp.Regexp
+	arrays  bool // Whether arrays along the path are passed through
+}
+
+type elementMatcher struct {
+	path []string
+	rule *FilterRule
+}
+
+// loadFilterConfig builds the filter config from the environment. Rules are read from the
+// YAML file at CT_FILTER_FILE and the YAML in CT_FILTER_RULES, and each legacy
+// CT_EVENT_FILTERS entry is added as a deny rule.
+func loadFilterConfig() (*FilterConfig, error) {
+	fc := &FilterConfig{}
+
+	if path := os.Getenv("CT_FILTER_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = fc.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_FILTER_FILE %s: %s", path, err)
+		}
+	}
+
+	if rules := os.Getenv("CT_FILTER_RULES"); rules != "" {
+		err := fc.parse([]byte(rules))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_FILTER_RULES: %s", err)
+		}
+	}
+
+	if filters := os.Getenv("CT_EVENT_FILTERS"); filters != "" {
+		for _, ef := range parseFilters(filters) {
+			fc.Deny = append(fc.Deny, ef.rule())
+		}
+	}
+
+	err := fc.compile()
+	if err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// parse adds the rules in the YAML document data to fc.
+func (fc *FilterConfig) parse(data []byte) error {
+	var parsed FilterConfig
+	err := yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		return err
+	}
+	fc.Allow = append(fc.Allow, parsed.Allow...)
+	fc.Deny = append(fc.Deny, parsed.Deny...)
+	return nil
+}
+
+func (fc *FilterConfig) compile() error {
+	for _, rules := range [][]*FilterRule{fc.Allow, fc.Deny} {
+		for _, rule := range rules {
+			err := rule.compile()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fc *FilterConfig) isEmpty() bool {
+	return len(fc.Allow) == 0 && len(fc.Deny) == 0
+}
+
+// Drop returns true if the record should not be streamed.
+func (fc *FilterConfig) Drop(record map[string]interface{}) bool {
+	if len(fc.Allow) > 0 && !anyRuleMatches(fc.Allow, record) {
+		return true
+	}
+	return anyRuleMatches(fc.Deny, record)
+}
+
+func anyRuleMatches(rules []*FilterRule, record map[string]interface{}) bool {
+	for _, rule := range rules {
+		if rule.Matches(record) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fr *FilterRule) compile() error {
+	return fr.compileMatching(false)
+}
+
+// compileDetection compiles the rule of a detection, whose fields match any of the
+// values in arrays along their path.
+func (fr *FilterRule) compileDetection() error {
+	return fr.compileMatching(true)
+}
+
+func (fr *FilterRule) compileMatching(arrays bool) error {
+	if fr == nil || (len(fr.Match) == 0 && len(fr.Elements) == 0 && len(fr.All) == 0 && len(fr.Any) == 0 && fr.Not == nil) {
+		return fmt.Errorf("filter rule has no conditions")
+	}
+
+	fr.matchers = nil
+	for field, pattern := range fr.Match {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q for field %s: %s", pattern, field, err)
+		}
+		fr.matchers = append(fr.matchers, &fieldMatcher{path: strings.Split(field, "."), pattern: re, arrays: arrays})
+	}
+
+	fr.elementMatchers = nil
+	for field, rule := range fr.Elements {
+		err := rule.compileMatching(arrays)
+		if err != nil {
+			return err
+		}
+		fr.elementMatchers = append(fr.elementMatchers, &elementMatcher{path: strings.Split(field, "."), rule: rule})
+	}
+
+	for _, rules := range [][]*FilterRule{fr.All, fr.Any} {
+		for _, rule := range rules {
+			err := rule.compileMatching(arrays)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if fr.Not != nil {
+		return fr.Not.compileMatching(arrays)
+	}
+	return nil
+}
+
+// compilePattern turns a filter pattern into a regular expression. Patterns wrapped in
+// slashes are used as is, anything else is treated as a glob matching the whole value.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+	return regexp.Compile("^" + quoted + "$")
+}
+
+func (fr *FilterRule) Matches(record map[string]interface{}) bool {
+	for _, fm := range fr.matchers {
+		if !fm.matches(record) {
+			return false
+		}
+	}
+	for _, em := range fr.elementMatchers {
+		if !anyElementMatches(record, em.path, em.rule) {
+			return false
+		}
+	}
+	for _, rule := range fr.All {
+		if !rule.Matches(record) {
+			return false
+		}
+	}
+	if len(fr.Any) > 0 && !anyRuleMatches(fr.Any, record) {
+		return false
+	}
+	if fr.Not != nil && fr.Not.Matches(record) {
+		return false
+	}
+	return true
+}
+
+// lookupField returns the value at path in record formatted as a string, and whether
+// there is a scalar value at that path.
+func lookupField(record map[string]interface{}, path []string) (string, bool) {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = m[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	return scalarString(value)
+}
+
+// scalarString formats a string, boolean or number from a record as a string.
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+func (fm *fieldMatcher) matches(record map[string]interface{}) bool {
+	if fm.arrays {
+		return anyValueMatches(record, fm.path, fm.pattern)
+	}
+	value, ok := lookupField(record, fm.path)
+	return ok && fm.pattern.MatchString(value)
+}
+
+// anyValueMatches returns true if any of the scalar values at path in value matches
+// the pattern, passing through arrays along the way.
+func anyValueMatches(value interface{}, path []string, pattern *regexp.Regexp) bool {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			if anyValueMatches(element, path, pattern) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return false
+		}
+		return anyValueMatches(v[path[0]], path[1:], pattern)
+	default:
+		if len(path) > 0 {
+			return false
+		}
+		s, ok := scalarString(v)
+		return ok && pattern.MatchString(s)
+	}
+}
+
+// anyElementMatches returns true if the array at path in record holds an object that
+// the rule matches. An object in place of the array is matched as its only element.
+func anyElementMatches(record map[string]interface{}, path []string, rule *FilterRule) bool {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		value = m[key]
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		return rule.Matches(m)
+	}
+	elements, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, element := range elements {
+		if m, ok := element.(map[string]interface{}); ok && rule.Matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventFilter is a legacy CT_EVENT_FILTERS entry, matching records with both
+// the given event name and event source.
+type EventFilter struct {
+	EventName   string
+	EventSource string
+}
+
+func parseFilters(filters string) []*EventFilter {
+	var eventFilters []*EventFilter
+	for _, filter := range strings.Split(filters, ",") {
+		event_filter := strings.Split(filter, ":")
+		if len(event_filter) != 2 {
+			continue
+		}
+		eventFilters = append(eventFilters, newEventFilter(event_filter[0], event_filter[1]))
+	}
+	return eventFilters
+}
+
+func newEventFilter(source, name string) *EventFilter {
+	return &EventFilter{EventName: name, EventSource: fmt.Sprintf("%s.amazonaws.com", source)}
+}
+
+func (ef *EventFilter) rule() *FilterRule {
+	return &FilterRule{Match: map[string]string{
+		"eventName":   ef.EventName,
+		"eventSource": ef.EventSource,
+	}}
+}
+
+func doFiltersMatch(record map[string]interface{}) bool {
+	if globalConfig.filters == nil {
+		return false
+	}
+	return globalConfig.filters.Drop(record)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var filterTestRecords = map[string]string{
+	"describeStream": `{"eventSource": "kinesis.amazonaws.com", "eventName": "DescribeStream", "readOnly": true,
+		"userIdentity": {"type": "AssumedRole"}}`,
+	"putRecords": `{"eventSource": "kinesis.amazonaws.com", "eventName": "PutRecords", "readOnly": false,
+		"userIdentity": {"type": "AWSService"}}`,
+	"listClusters": `{"eventSource": "elasticmapreduce.amazonaws.com", "eventName": "ListClusters", "readOnly": true,
+		"userIdentity": {"type": "IAMUser"}, "errorCode": "AccessDenied"}`,
+	"consoleLogin": `{"eventSource": "signin.amazonaws.com", "eventName": "ConsoleLogin", "awsRegion": "us-east-1",
+		"userIdentity": {"type": "Root"}}`,
+}
+
+func decodeFilterTestRecord(t *testing.T, name string) map[string]interface{} {
+	var record map[string]interface{}
+	err := json.Unmarshal([]byte(filterTestRecords[name]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func newTestFilterConfig(t *testing.T, rules string) *FilterConfig {
+	fc := &FilterConfig{}
+	err := fc.parse([]byte(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fc.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc
+}
+
+func assertDropped(t *testing.T, fc *FilterConfig, expected map[string]bool) {
+	for name, drop := range expected {
+		if fc.Drop(decodeFilterTestRecord(t, name)) != drop {
+			t.Errorf("Expected Drop(%s) to be %v", name, drop)
+		}
+	}
+}
+
+func TestLegacyFiltersMatchSourceAndName(t *testing.T) {
+	fc := &FilterConfig{}
+	for _, ef := range parseFilters(testFilters) {
+		fc.Deny = append(fc.Deny, ef.rule())
+	}
+	err := fc.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDropped(t, fc, map[string]bool{
+		"describeStream": true,
+		"putRecords":     false,
+		"listClusters":   true,
+		"consoleLogin":   false,
+	})
+}
+
+func TestFilterPatterns(t *testing.T) {
+	fc := newTestFilterConfig(t, `
+deny:
+  - match:
+      eventSource: "kinesis.*"
+      eventName: "Describe*"
+  - match:
+      eventName: "/^List(Clusters|Steps)$/"
+`)
+	assertDropped(t, fc, map[string]bool{
+		"describeStream": true,
+		"putRecords":     false,
+		"listClusters":   true,
+		"consoleLogin":   false,
+	})
+}
+
+func TestFilterNestedFieldsAndScalars(t *testing.T) {
+	fc := newTestFilterConfig(t, `
+deny:
+  - match:
+      userIdentity.type: AWSService
+  - match:
+      readOnly: true
+      errorCode: "*"
+`)
+	assertDropped(t, fc, map[string]bool{
+		"describeStream": false,
+		"putRecords":     true,
+		"listClusters":   true,
+		"consoleLogin":   false,
+	})
+}
+
+func TestFilterParsedRecords(t *testing.T) {
+	// Numbers of records parsed from other log formats are matched like those of JSON records
+	records := readFormat(t, LOG_FORMAT_ALB, `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 502 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - -
+http 2018-07-02T22:23:01.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - -
+`)
+	fc := newTestFilterConfig(t, `
+deny:
+  - match:
+      elbStatusCode: "5*"
+      targetProcessingTime: "0.001"
+`)
+	if len(records) != 2 || !fc.Drop(records[0]) || fc.Drop(records[1]) {
+		t.Fatalf("Expected only the record with a 5xx status to be dropped, got %v", records)
+	}
+}
+
+func TestFilterAllowDenyAndLogic(t *testing.T) {
+	fc := newTestFilterConfig(t, `
+allow:
+  - any:
+      - match: {eventSource: kinesis.amazonaws.com}
+      - match: {awsRegion: us-east-1}
+deny:
+  - all:
+      - match: {readOnly: "true"}
+    not:
+      match: {userIdentity.type: IAMUser}
+`)
+	assertDropped(t, fc, map[string]bool{
+		"describeStream": true,  // allowed, but denied as a read only non IAMUser event
+		"putRecords":     false, // allowed
+		"listClusters":   true,  // not allowed
+		"consoleLogin":   false, // allowed by region
+	})
+}
+
+func TestFilterArraysAndElements(t *testing.T) {
+	var public, publicList, denyOnly map[string]interface{}
+	err := json.Unmarshal([]byte(`{"eventName": "PutBucketPolicy", "requestParameters": {"bucketPolicy": {"Statement": [
+		{"Effect": "Deny", "Principal": "*"},
+		{"Effect": "Allow", "Principal": {"AWS": "*"}}]}}}`), &public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(`{"eventName": "PutBucketPolicy", "requestParameters": {"bucketPolicy": {"Statement": [
+		{"Effect": "Allow", "Principal": {"AWS": ["arn:aws:iam::123456789012:root", "*"]}}]}}}`), &publicList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(`{"eventName": "PutBucketPolicy", "requestParameters": {"bucketPolicy": {"Statement":
+		{"Effect": "Deny", "Principal": "*"}}}}`), &denyOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := newTestFilterConfig(t, `
+deny:
+  - match:
+      requestParameters.bucketPolicy.Statement.Principal.AWS: "*"
+`)
+	if fc.Drop(public) || fc.Drop(publicList) {
+		t.Fatal("Expected fields with arrays along their path never to match")
+	}
+	fc = newTestFilterConfig(t, `
+deny:
+  - match:
+      requestParameters.bucketPolicy.Statement: "*"
+`)
+	if fc.Drop(public) {
+		t.Fatal("Expected fields holding arrays never to match")
+	}
+
+	fc = newTestFilterConfig(t, `
+deny:
+  - elements:
+      requestParameters.bucketPolicy.Statement:
+        match: {Effect: Allow}
+        any:
+          - match: {Principal: "*"}
+          - match: {Principal.AWS: "*"}
+`)
+	if !fc.Drop(public) || fc.Drop(denyOnly) {
+		t.Fatal("Expected elements to match a single statement")
+	}
+	if fc.Drop(publicList) {
+		t.Fatal("Expected fields within elements holding arrays never to match")
+	}
+	denyOnly["requestParameters"].(map[string]interface{})["bucketPolicy"].(map[string]interface{})["Statement"].(map[string]interface{})["Effect"] = "Allow"
+	if !fc.Drop(denyOnly) {
+		t.Fatal("Expected elements to match an object in place of an array")
+	}
+}
+
+func TestFilterRuleWithoutConditions(t *testing.T) {
+	fc := &FilterConfig{}
+	err := fc.parse([]byte("deny:\n  - any: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.compile() == nil {
+		t.Fatal("Expected an error compiling a rule without conditions")
+	}
+
+	fc = &FilterConfig{}
+	err = fc.parse([]byte("deny:\n  - match: {eventName: \"/(/\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.compile() == nil {
+		t.Fatal("Expected an error compiling an invalid regular expression")
+	}
+}
+
+func TestLoadFilterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "filters.yaml")
+	err = ioutil.WriteFile(path, []byte("deny:\n  - match: {eventName: PutRecords}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CT_FILTER_FILE", path)
+	os.Setenv("CT_FILTER_RULES", `{"deny": [{"match": {"eventName": "ConsoleLogin"}}]}`)
+	os.Setenv("CT_EVENT_FILTERS", "elasticmapreduce:ListClusters")
+	defer func() {
+		os.Unsetenv("CT_FILTER_FILE")
+		os.Unsetenv("CT_FILTER_RULES")
+		os.Unsetenv("CT_EVENT_FILTERS")
+	}()
+
+	fc, err := loadFilterConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Deny) != 3 {
+		t.Fatalf("Expected 3 deny rules, got %d", len(fc.Deny))
+	}
+	assertDropped(t, fc, map[string]bool{
+		"describeStream": false,
+		"putRecords":     true,
+		"listClusters":   true,
+		"consoleLogin":   true,
+	})
+}
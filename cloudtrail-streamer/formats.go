@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	LOG_FORMAT_VPC_FLOW  = "vpcflow"   // VPC Flow Logs, space separated fields named by a header line
+	LOG_FORMAT_ALB       = "alb"       // Application Load Balancer access logs
+	LOG_FORMAT_S3_ACCESS = "s3access"  // S3 server access logs
+	LOG_FORMAT_GUARDDUTY = "guardduty" // GuardDuty findings exported to S3, one JSON object per line
+
+	MAX_LOG_LINE_BYTES = 1024 * 1024
+)
+
+// formatRegistry holds a constructor for the RecordReader of each log format, by name.
+var formatRegistry = make(map[string]func(r *bufio.Reader, closers []io.Closer) (RecordReader, error))
+
+// registerFormat makes a log format available to CT_LOG_FORMAT and to the format of routes.
+func registerFormat(name string, newReader func(r *bufio.Reader, closers []io.Closer) (RecordReader, error)) {
+	if _, ok := formatRegistry[name]; ok {
+		panic(fmt.Sprintf("log format %s registered twice", name))
+	}
+	formatRegistry[name] = newReader
+}
+
+func formatNames() []string {
+	var names []string
+	for name := range formatRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerFormat(LOG_FORMAT_CLOUDTRAIL, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newCloudTrailReader(r, closers)
+	})
+	registerFormat(LOG_FORMAT_NDJSON, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newNDJSONReader(r, closers), nil
+	})
+	registerFormat(LOG_FORMAT_GUARDDUTY, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newNDJSONReader(r, closers), nil
+	})
+	registerFormat(LOG_FORMAT_VPC_FLOW, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newLineReader(r, closers, &vpcFlowParser{}), nil
+	})
+	registerFormat(LOG_FORMAT_ALB, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newLineReader(r, closers, albParser), nil
+	})
+	registerFormat(LOG_FORMAT_S3_ACCESS, func(r *bufio.Reader, closers []io.Closer) (RecordReader, error) {
+		return newLineReader(r, closers, s3AccessParser), nil
+	})
+}
+
+// lineParser turns a line of a text log file into a record. It returns a nil record for
+// lines that hold no record, such as headers.
+type lineParser interface {
+	parse(line string) (map[string]interface{}, error)
+}
+
+// lineReader reads text log files holding one record per line.
+type lineReader struct {
+	scanner *bufio.Scanner
+	closers []io.Closer
+	parser  lineParser
+	line    int
+}
+
+func newLineReader(r io.Reader, closers []io.Closer, parser lineParser) *lineReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LOG_LINE_BYTES)
+	return &lineReader{scanner: scanner, closers: closers, parser: parser}
+}
+
+func (lr *lineReader) Next() (map[string]interface{}, error) {
+	for lr.scanner.Scan() {
+		lr.line++
+		line := strings.TrimSpace(lr.scanner.Text())
+		if line == "" {
+			continue
+		}
+		record, err := lr.parser.parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lr.line, err)
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+	if err := lr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (lr *lineReader) Close() error {
+	return closeAll(lr.closers)
+}
+
+// splitFields splits a line on spaces, keeping together fields that are quoted, in which
+// quotes are escaped with a backslash, or wrapped in square brackets.
+func splitFields(line string) ([]string, error) {
+	var (
+		fields []string
+		field  strings.Builder
+	)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == ' ':
+			continue
+		case c == '"':
+			field.Reset()
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				field.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted field")
+			}
+			fields = append(fields, field.String())
+		case c == '[':
+			end := strings.IndexByte(line[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracketed field")
+			}
+			fields = append(fields, line[i+1:i+end])
+			i += end
+		default:
+			end := strings.IndexByte(line[i:], ' ')
+			if end < 0 {
+				end = len(line) - i
+			}
+			fields = append(fields, line[i:i+end])
+			i += end
+		}
+	}
+	return fields, nil
+}
+
+// camelCase turns the field names of AWS log formats, such as account-id or
+// elb_status_code, into the camel case used by CloudTrail records.
+func camelCase(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		if r == '-' || r == '_' || r == ':' {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// fieldParser parses lines with a fixed list of fields. Fields that are "-" are left
+// out, and numeric fields are parsed as numbers. Fields past the end of the list, which
+// AWS adds to formats over time, are ignored.
+type fieldParser struct {
+	names      []string
+	numeric    map[string]bool
+	timeField  string // Field holding the time of the event
+	timeLayout string
+}
+
+func (fp *fieldParser) parse(line string) (map[string]interface{}, error) {
+	fields, err := splitFields(line)
+	if err != nil {
+		return nil, err
+	}
+	return fp.record(fields)
+}
+
+func (fp *fieldParser) record(fields []string) (map[string]interface{}, error) {
+	if len(fields) > len(fp.names) {
+		fields = fields[:len(fp.names)]
+	}
+	record := make(map[string]interface{}, len(fields)+1)
+	for i, value := range fields {
+		if value == "-" || value == "" {
+			continue
+		}
+		name := fp.names[i]
+		record[name] = value
+		// Numbers are float64, as in records decoded from JSON, so they are matched by
+		// filters and formatted the same way
+		if fp.numeric[name] {
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				record[name] = f
+			}
+		}
+	}
+
+	// Records are given an eventTime like CloudTrail records, so sinks timestamp them
+	// with the time of the event
+	if value, ok := record[fp.timeField]; ok {
+		var (
+			t   time.Time
+			err error
+		)
+		if n, ok := value.(float64); ok && fp.timeLayout == "" {
+			t = time.Unix(int64(n), 0)
+		} else {
+			t, err = time.Parse(fp.timeLayout, fmt.Sprint(value))
+		}
+		if err == nil {
+			record["eventTime"] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	return record, nil
+}
+
+func numericFields(names ...string) map[string]bool {
+	numeric := make(map[string]bool)
+	for _, name := range names {
+		numeric[name] = true
+	}
+	return numeric
+}
+
+// vpcFlowParser names the fields of VPC Flow Logs from the header line that starts each
+// log file, as custom formats choose which fields are logged and in what order.
+type vpcFlowParser struct {
+	*fieldParser
+}
+
+var vpcFlowNumericFields = numericFields("version", "srcport", "dstport", "protocol", "packets", "bytes", "start", "end", "tcpFlags", "trafficPath")
+
+func (vp *vpcFlowParser) parse(line string) (map[string]interface{}, error) {
+	fields := strings.Fields(line)
+	if vp.fieldParser == nil {
+		var names []string
+		for _, field := range fields {
+			names = append(names, camelCase(field))
+		}
+		vp.fieldParser = &fieldParser{names: names, numeric: vpcFlowNumericFields, timeField: "start"}
+		return nil, nil
+	}
+	if len(fields) != len(vp.names) {
+		return nil, fmt.Errorf("expected %d fields, found %d", len(vp.names), len(fields))
+	}
+	return vp.record(fields)
+}
+
+var albParser = &fieldParser{
+	names: []string{
+		"type", "time", "elb", "client", "target", "requestProcessingTime", "targetProcessingTime",
+		"responseProcessingTime", "elbStatusCode", "targetStatusCode", "receivedBytes", "sentBytes",
+		"request", "userAgent", "sslCipher", "sslProtocol", "targetGroupArn", "traceId", "domainName",
+		"chosenCertArn", "matchedRulePriority", "requestCreationTime", "actionsExecuted", "redirectUrl",
+		"errorReason", "targetList", "targetStatusCodeList", "classification", "classificationReason",
+		"connTraceId",
+	},
+	numeric: numericFields("requestProcessingTime", "targetProcessingTime", "responseProcessingTime",
+		"elbStatusCode", "targetStatusCode", "receivedBytes", "sentBytes", "matchedRulePriority"),
+	timeField:  "time",
+	timeLayout: time.RFC3339Nano,
+}
+
+var s3AccessParser = &fieldParser{
+	names: []string{
+		"bucketOwner", "bucket", "time", "remoteIp", "requester", "requestId", "operation", "key",
+		"requestUri", "httpStatus", "errorCode", "bytesSent", "objectSize", "totalTime",
+		"turnAroundTime", "referer", "userAgent", "versionId", "hostId", "signatureVersion",
+		"cipherSuite", "authenticationType", "hostHeader", "tlsVersion", "accessPointArn",
+		"aclRequired",
+	},
+	numeric:    numericFields("httpStatus", "bytesSent", "objectSize", "totalTime", "turnAroundTime"),
+	timeField:  "time",
+	timeLayout: "02/Jan/2006:15:04:05 -0700",
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func readFormat(t *testing.T, format string, data string) []map[string]interface{} {
+	reader, err := newRecordReader(ioutil.NopCloser(bytes.NewBufferString(data)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	records, err := readAllRecords(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestVPCFlowFormat(t *testing.T) {
+	records := readFormat(t, LOG_FORMAT_VPC_FLOW, `version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status
+2 012345678910 eni-1235b8ca123456789 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK
+2 012345678910 eni-1235b8ca123456789 - - - - - - - 1431280876 1431280934 - NODATA
+`)
+	expected := []map[string]interface{}{
+		{
+			"version": float64(2), "accountId": "012345678910", "interfaceId": "eni-1235b8ca123456789",
+			"srcaddr": "172.31.16.139", "dstaddr": "172.31.16.21", "srcport": float64(20641), "dstport": float64(22),
+			"protocol": float64(6), "packets": float64(20), "bytes": float64(4249), "start": float64(1418530010),
+			"end": float64(1418530070), "action": "ACCEPT", "logStatus": "OK", "eventTime": "2014-12-14T04:06:50Z",
+		},
+		{
+			"version": float64(2), "accountId": "012345678910", "interfaceId": "eni-1235b8ca123456789",
+			"start": float64(1431280876), "end": float64(1431280934), "logStatus": "NODATA", "eventTime": "2015-05-10T18:01:16Z",
+		},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Expected records %v, got %v", expected, records)
+	}
+
+	reader, err := newRecordReader(ioutil.NopCloser(bytes.NewBufferString("version account-id\n2\n")), LOG_FORMAT_VPC_FLOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAllRecords(reader)
+	if err == nil {
+		t.Fatal("Expected an error reading a line missing fields")
+	}
+}
+
+func TestALBFormat(t *testing.T) {
+	records := readFormat(t, LOG_FORMAT_ALB, `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0 \"quoted\"" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234 "a future field"
+`)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	r := records[0]
+	for field, value := range map[string]interface{}{
+		"type":                  "http",
+		"client":                "192.168.131.39:2817",
+		"targetProcessingTime":  0.001,
+		"elbStatusCode":         float64(200),
+		"sentBytes":             float64(366),
+		"request":               "GET http://www.example.com:80/ HTTP/1.1",
+		"userAgent":             `curl/7.46.0 "quoted"`,
+		"matchedRulePriority":   float64(0),
+		"actionsExecuted":       "forward",
+		"targetStatusCodeList":  "200",
+		"connTraceId":           "TID_1234",
+		"eventTime":             "2018-07-02T22:23:00Z",
+		"requestProcessingTime": float64(0),
+	} {
+		if !reflect.DeepEqual(r[field], value) {
+			t.Errorf("Expected %s to be %#v, got %#v", field, value, r[field])
+		}
+	}
+	for _, field := range []string{"sslCipher", "domainName", "redirectUrl"} {
+		if _, ok := r[field]; ok {
+			t.Errorf("Expected empty field %s to be left out", field)
+		}
+	}
+}
+
+func TestS3AccessFormat(t *testing.T) {
+	records := readFormat(t, LOG_FORMAT_S3_ACCESS, `79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be DOC-EXAMPLE-BUCKET1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3 79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be 3E57427F3EXAMPLE REST.GET.VERSIONING - "GET /DOC-EXAMPLE-BUCKET1?versioning HTTP/1.1" 200 - 113 - 7 - "-" "S3Console/0.4" - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234= SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader DOC-EXAMPLE-BUCKET1.s3.us-west-1.amazonaws.com TLSV1.2 arn:aws:s3:us-west-1:123456789012:accesspoint/example-AP Yes
+`)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	r := records[0]
+	for field, value := range map[string]interface{}{
+		"bucket":     "DOC-EXAMPLE-BUCKET1",
+		"time":       "06/Feb/2019:00:00:38 +0000",
+		"operation":  "REST.GET.VERSIONING",
+		"requestUri": "GET /DOC-EXAMPLE-BUCKET1?versioning HTTP/1.1",
+		"httpStatus": float64(200),
+		"bytesSent":  float64(113),
+		"totalTime":  float64(7),
+		"userAgent":  "S3Console/0.4",
+		"tlsVersion": "TLSV1.2",
+		"eventTime":  "2019-02-06T00:00:38Z",
+	} {
+		if !reflect.DeepEqual(r[field], value) {
+			t.Errorf("Expected %s to be %#v, got %#v", field, value, r[field])
+		}
+	}
+	if _, ok := r["key"]; ok {
+		t.Error("Expected empty key to be left out")
+	}
+}
+
+func TestGuardDutyFormat(t *testing.T) {
+	records := readFormat(t, LOG_FORMAT_GUARDDUTY, `{"schemaVersion":"2.0","id":"1","type":"Recon:EC2/PortProbeUnprotectedPort"}
+{"schemaVersion":"2.0","id":"2","type":"UnauthorizedAccess:IAMUser/ConsoleLogin"}
+`)
+	if len(records) != 2 || records[1]["type"] != "UnauthorizedAccess:IAMUser/ConsoleLogin" {
+		t.Fatalf("Unexpected records %v", records)
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	fields, err := splitFields(`a  "b c" [d e] "" -`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, []string{"a", "b c", "d e", "", "-"}) {
+		t.Fatalf("Unexpected fields %q", fields)
+	}
+	for _, line := range []string{`a "b`, `a [b`} {
+		_, err = splitFields(line)
+		if err == nil {
+			t.Errorf("Expected an error splitting %s", line)
+		}
+	}
+}
+
+func TestDefaultFormatRoutes(t *testing.T) {
+	rc := &RouteConfig{Routes: defaultRoutes()}
+	err := rc.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Streamer{routes: rc}
+	for key, format := range map[string]string{
+		"AWSLogs/123456789012/vpcflowlogs/us-east-1/2026/10/16/123456789012_vpcflowlogs_us-east-1_fl-1234abcd_20261016T2305Z_hash.log.gz":                                       LOG_FORMAT_VPC_FLOW,
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-1/2026/10/16/123456789012_elasticloadbalancing_us-east-1_app.my-lb.1234567890abcdef_20261016T2305Z_1.2.3.4_x.log.gz": LOG_FORMAT_ALB,
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-1/2026/10/16/123456789012_elasticloadbalancing_us-east-1_net.my-lb.1234567890abcdef_20261016T2305Z_x.log.gz":         "",
+		"AWSLogs/123456789012/GuardDuty/us-east-1/2026/10/16/5b2f3d5e-2ea8-3d4d-9a36-3dd5e0e5b0c7.jsonl.gz":                                                                     LOG_FORMAT_GUARDDUTY,
+		testLogKey: "",
+	} {
+		if f := s.formatFor(key); f != format {
+			t.Errorf("Expected format %q for %s, got %q", format, key, f)
+		}
+	}
+
+	rc = &RouteConfig{Routes: []*Route{{Name: "bad", Key: "*", Format: "unknown"}}}
+	if rc.compile() == nil {
+		t.Fatal("Expected an error compiling a route with an unknown format")
+	}
+}
@@ -1,20 +1,38 @@
 module github.com/mozilla-services/cloudtrail-streamer
 
-go 1.13
+go 1.18
 
 require (
-	cloud.google.com/go v0.29.0
+	cloud.google.com/go/datastore v1.1.0
+	cloud.google.com/go/logging v1.0.0
+	cloud.google.com/go/pubsub v1.4.0
+	github.com/aws/aws-lambda-go v1.28.0
+	github.com/aws/aws-sdk-go v1.15.7
+	github.com/klauspost/compress v1.11.13
+	github.com/mozilla-services/yaml v0.0.0-20180922153656-28ffe5d0cafb
+	github.com/oschwald/maxminddb-golang v1.8.0
+	github.com/sirupsen/logrus v1.0.6
+	go.mozilla.org/mozlogrus v1.0.0
+	go.mozilla.org/sops v0.0.0-20181004100159-7c72237f5a49
+	google.golang.org/api v0.84.0
+	google.golang.org/grpc v1.47.0
+)
+
+require (
+	cloud.google.com/go v0.102.0 // indirect
+	cloud.google.com/go/compute v1.7.0 // indirect
+	cloud.google.com/go/iam v0.3.0 // indirect
 	github.com/Azure/azure-sdk-for-go v21.1.0+incompatible // indirect
 	github.com/Azure/go-autorest v11.1.0+incompatible // indirect
-	github.com/aws/aws-lambda-go v1.2.0
-	github.com/aws/aws-sdk-go v1.15.7
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/dimchansky/utfbom v1.0.0 // indirect
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/go-ini/ini v1.38.1 // indirect
-	github.com/google/go-cmp v0.3.1 // indirect
-	github.com/google/martian v2.1.0+incompatible // indirect
-	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/googleapis/enterprise-certificate-proxy v0.0.0-20220520183353-fd19c99a87aa // indirect
+	github.com/googleapis/gax-go/v2 v2.4.0 // indirect
 	github.com/goware/prefixer v0.0.0-20160118172347-395022866408 // indirect
 	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c // indirect
 	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
@@ -23,24 +41,23 @@ require (
 	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/mitchellh/go-homedir v1.0.0 // indirect
 	github.com/mitchellh/go-wordwrap v1.0.0 // indirect
-	github.com/mozilla-services/yaml v0.0.0-20180922153656-28ffe5d0cafb // indirect
-	github.com/onsi/ginkgo v1.10.2 // indirect
-	github.com/onsi/gomega v1.7.0 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
-	github.com/sirupsen/logrus v1.0.6
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
-	github.com/stretchr/testify v1.4.0 // indirect
 	go.mozilla.org/gopgagent v0.0.0-20170926210634-4d7ea76ff71a // indirect
 	go.mozilla.org/mozlog v0.0.0-20170222151521-4bb13139d403 // indirect
-	go.mozilla.org/mozlogrus v1.0.0
-	go.mozilla.org/sops v0.0.0-20181004100159-7c72237f5a49
-	go.opencensus.io v0.17.0 // indirect
-	golang.org/x/oauth2 v0.0.0-20181003184128-c57b0facaced // indirect
-	golang.org/x/vgo v0.0.0-20180912184537-9d567625acf4 // indirect
-	google.golang.org/api v0.0.0-20181007000908-c21459d81882
-	google.golang.org/genproto v0.0.0-20181004005441-af9cb2a35e7f // indirect
-	google.golang.org/grpc v1.15.0 // indirect
+	go.opencensus.io v0.23.0 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/net v0.1.0 // indirect
+	golang.org/x/oauth2 v0.1.0 // indirect
+	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f // indirect
+	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
+	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/genproto v0.0.0-20220616135557-88e70c0c3a90 // indirect
+	google.golang.org/protobuf v1.28.0 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 	gopkg.in/ini.v1 v1.49.0 // indirect
+	gopkg.in/yaml.v2 v2.2.3 // indirect
 )
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_HTTP_BATCH_SIZE  = 500
+	DEFAULT_HTTP_BATCH_BYTES = 1024 * 1024
+	DEFAULT_HTTP_MAX_RETRIES = 3
+	DEFAULT_HTTP_TIMEOUT     = 30 * time.Second
+
+	HTTP_MAX_RETRY_AFTER = 30 * time.Second // Longest Retry-After that is honoured
+)
+
+func init() {
+	registerSink(
+		"http",
+		func(c *Config) bool { return c.httpConfig != nil },
+		func(c *Config) (Sink, error) { return NewHTTPStreamer(c.httpConfig, nil), nil },
+	)
+}
+
+// httpSinkConfig holds the settings of a sink that posts batches of records to a URL.
+type httpSinkConfig struct {
+	url        string
+	header     http.Header
+	batchSize  int // Maximum number of records in a request
+	batchBytes int // Maximum size of a request body
+	maxRetries int
+	timeout    time.Duration
+}
+
+// loadHTTPSinkConfig reads the settings of an HTTP sink from the variables starting with
+// prefix, returning nil if <prefix>_URL is not set.
+func loadHTTPSinkConfig(prefix string) (*httpSinkConfig, error) {
+	hc := &httpSinkConfig{
+		url:        os.Getenv(prefix + "_URL"),
+		header:     make(http.Header),
+		batchSize:  DEFAULT_HTTP_BATCH_SIZE,
+		batchBytes: DEFAULT_HTTP_BATCH_BYTES,
+		maxRetries: DEFAULT_HTTP_MAX_RETRIES,
+		timeout:    DEFAULT_HTTP_TIMEOUT,
+	}
+	if hc.url == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(hc.url)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%s_URL is set to an invalid value, %s, must be an http or https URL", prefix, hc.url)
+	}
+
+	// Headers are comma separated Name:value pairs
+	if headers := os.Getenv(prefix + "_HEADERS"); headers != "" {
+		for _, h := range strings.Split(headers, ",") {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return nil, fmt.Errorf("%s_HEADERS is set to an invalid value, %s, must be comma separated Name:value pairs", prefix, headers)
+			}
+			hc.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+
+	for name, setting := range map[string]*int{
+		prefix + "_BATCH_SIZE":  &hc.batchSize,
+		prefix + "_BATCH_BYTES": &hc.batchBytes,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*setting, err = strconv.Atoi(v)
+			if err != nil || *setting < 1 {
+				return nil, fmt.Errorf("%s is set to an invalid value, %s, must be a positive integer", name, v)
+			}
+		}
+	}
+
+	if v := os.Getenv(prefix + "_MAX_RETRIES"); v != "" {
+		hc.maxRetries, err = strconv.Atoi(v)
+		if err != nil || hc.maxRetries < 0 {
+			return nil, fmt.Errorf("%s_MAX_RETRIES is set to an invalid value, %s, must be a non-negative integer", prefix, v)
+		}
+	}
+
+	if v := os.Getenv(prefix + "_TIMEOUT"); v != "" {
+		hc.timeout, err = time.ParseDuration(v)
+		if err != nil || hc.timeout <= 0 {
+			return nil, fmt.Errorf("%s_TIMEOUT is set to an invalid value, %s, must be a positive duration", prefix, v)
+		}
+	}
+
+	return hc, nil
+}
+
+// loadHTTPConfig returns the configuration of the generic HTTP sink, or nil if
+// CT_HTTP_URL is not set.
+func loadHTTPConfig() (*httpSinkConfig, error) {
+	hc, err := loadHTTPSinkConfig("CT_HTTP")
+	if err != nil || hc == nil {
+		return nil, err
+	}
+	if token := os.Getenv("CT_HTTP_AUTH_TOKEN"); token != "" {
+		hc.header.Set("Authorization", "Bearer "+token)
+	}
+	if basicAuth := os.Getenv("CT_HTTP_BASIC_AUTH"); basicAuth != "" {
+		parts := strings.SplitN(basicAuth, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("CT_HTTP_BASIC_AUTH must be set to user:password")
+		}
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(parts[0], parts[1])
+		hc.header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	return hc, nil
+}
+
+// HTTPStreamer posts records to a URL in batches, one JSON document per line. Requests
+// that fail with a network error, a 429 or a 5xx status are retried with exponential
+// backoff.
+type HTTPStreamer struct {
+	client     *http.Client
+	url        string
+	header     http.Header
+	batchSize  int
+	batchBytes int
+	maxRetries int
+	backoff    time.Duration // Base wait between retries of failed requests
+
+	maxRecordBytes int // Largest record that still fits in a batch once encoded
+
+	// encode returns the line sent for a record, the record itself if nil
+	encode func(record map[string]interface{}, encodedRecord []byte) ([]byte, error)
+
+	batch      bytes.Buffer
+	batchCount int
+}
+
+func NewHTTPStreamer(hc *httpSinkConfig, encode func(record map[string]interface{}, encodedRecord []byte) ([]byte, error)) *HTTPStreamer {
+	header := hc.header.Clone()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/x-ndjson")
+	}
+	return &HTTPStreamer{
+		client:     &http.Client{Timeout: hc.timeout},
+		url:        hc.url,
+		header:     header,
+		batchSize:  hc.batchSize,
+		batchBytes: hc.batchBytes,
+		maxRetries: hc.maxRetries,
+		backoff:    500 * time.Millisecond,
+		encode:     encode,
+
+		// Leave room for the newline, as a record has to fit in a batch on its own
+		maxRecordBytes: hc.batchBytes - 1,
+	}
+}
+
+func (hs *HTTPStreamer) MaxRecordBytes() int {
+	return hs.maxRecordBytes
+}
+
+func (hs *HTTPStreamer) Send(record map[string]interface{}, encodedRecord []byte) error {
+	line := encodedRecord
+	if hs.encode != nil {
+		var err error
+		line, err = hs.encode(record, encodedRecord)
+		if err != nil {
+			return err
+		}
+	}
+	if len(line)+1 > hs.batchBytes {
+		return &recordRejectedError{fmt.Sprintf("record is %d bytes, over the batch limit of %d bytes", len(line), hs.batchBytes)}
+	}
+
+	var err error
+	if hs.batchCount >= hs.batchSize || hs.batch.Len()+len(line)+1 > hs.batchBytes {
+		err = hs.Flush()
+	}
+
+	hs.batch.Write(line)
+	hs.batch.WriteByte('\n')
+	hs.batchCount++
+
+	return err
+}
+
+// Flush posts the current batch, retrying it up to maxRetries times.
+func (hs *HTTPStreamer) Flush() error {
+	if hs.batchCount == 0 {
+		return nil
+	}
+	body := make([]byte, hs.batch.Len())
+	copy(body, hs.batch.Bytes())
+	count := hs.batchCount
+	hs.batch.Reset()
+	hs.batchCount = 0
+
+	for attempt := 0; ; attempt++ {
+		wait, err := hs.post(body)
+		if err == nil {
+			return nil
+		}
+		if wait < 0 || attempt >= hs.maxRetries {
+			return fmt.Errorf("%d records failed to be posted to %s after %d retries: %s", count, hs.url, attempt, err)
+		}
+		if wait == 0 {
+			wait = hs.backoff * time.Duration(1<<uint(attempt))
+		}
+		log.Infof("Retrying post of %d records to %s in %s: %s", count, hs.url, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// post sends a single request. On failure it returns how long to wait before retrying,
+// 0 for the default backoff, or a negative duration if the request should not be retried.
+func (hs *HTTPStreamer) post(body []byte) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, hs.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header = hs.header.Clone()
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return -1, err
+	}
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+		wait := time.Duration(seconds) * time.Second
+		if wait > HTTP_MAX_RETRY_AFTER {
+			wait = HTTP_MAX_RETRY_AFTER
+		}
+		return wait, err
+	}
+	return 0, err
+}
+
+func (hs *HTTPStreamer) Close() error {
+	err := hs.Flush()
+	log.Debugf("HTTP Streamer for %s closed", hs.url)
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHTTPServer records the bodies it receives, replying with the given statuses in
+// order and then with 200.
+type fakeHTTPServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func newFakeHTTPServer(statuses ...int) *fakeHTTPServer {
+	fs := &fakeHTTPServer{statuses: statuses}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		fs.bodies = append(fs.bodies, string(body))
+		fs.headers = append(fs.headers, r.Header)
+		if len(fs.statuses) > 0 {
+			status := fs.statuses[0]
+			fs.statuses = fs.statuses[1:]
+			w.WriteHeader(status)
+			w.Write([]byte("failed"))
+		}
+	}))
+	return fs
+}
+
+func testHTTPStreamer(url string, batchSize int) *HTTPStreamer {
+	hs := NewHTTPStreamer(&httpSinkConfig{
+		url:        url,
+		header:     http.Header{"X-Team": []string{"secops"}},
+		batchSize:  batchSize,
+		batchBytes: DEFAULT_HTTP_BATCH_BYTES,
+		maxRetries: 2,
+		timeout:    time.Second,
+	}, nil)
+	hs.backoff = time.Millisecond
+	return hs
+}
+
+func TestHTTPStreamerBatches(t *testing.T) {
+	server := newFakeHTTPServer()
+	defer server.Close()
+
+	hs := testHTTPStreamer(server.URL, 2)
+	for _, r := range []string{`{"eventID":"1"}`, `{"eventID":"2"}`, `{"eventID":"3"}`} {
+		err := hs.Send(nil, []byte(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := hs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"{\"eventID\":\"1\"}\n{\"eventID\":\"2\"}\n", "{\"eventID\":\"3\"}\n"}
+	if len(server.bodies) != len(expected) {
+		t.Fatalf("Expected %d requests, got %d", len(expected), len(server.bodies))
+	}
+	for i := range expected {
+		if server.bodies[i] != expected[i] {
+			t.Fatalf("Expected body %q, got %q", expected[i], server.bodies[i])
+		}
+		if server.headers[i].Get("X-Team") != "secops" || server.headers[i].Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("Unexpected headers %v", server.headers[i])
+		}
+	}
+}
+
+func TestHTTPStreamerBatchBytes(t *testing.T) {
+	server := newFakeHTTPServer()
+	defer server.Close()
+
+	hs := testHTTPStreamer(server.URL, 100)
+	hs.batchBytes = 20
+	for _, r := range []string{`{"eventID":"1"}`, `{"eventID":"2"}`} {
+		err := hs.Send(nil, []byte(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := hs.Send(nil, []byte(`{"eventID":"far too long"}`))
+	if err == nil {
+		t.Fatal("Expected an error sending a record larger than a batch")
+	}
+	err = hs.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.bodies) != 2 {
+		t.Fatalf("Expected a request per record, got %d", len(server.bodies))
+	}
+}
+
+func TestHTTPStreamerRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		err      bool
+	}{
+		{name: "success", requests: 1},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, requests: 3},
+		{name: "retries exhausted", statuses: []int{500, 502, 503}, requests: 3, err: true},
+		{name: "not retried", statuses: []int{http.StatusBadRequest}, requests: 1, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeHTTPServer(test.statuses...)
+			defer server.Close()
+
+			hs := testHTTPStreamer(server.URL, 10)
+			err := hs.Send(nil, []byte(`{"eventID":"1"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = hs.Flush()
+			if test.err && err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !test.err && err != nil {
+				t.Fatal(err)
+			}
+			if len(server.bodies) != test.requests {
+				t.Fatalf("Expected %d requests, got %d", test.requests, len(server.bodies))
+			}
+		})
+	}
+}
+
+func TestHTTPStreamerNetworkError(t *testing.T) {
+	server := newFakeHTTPServer()
+	url := server.URL
+	server.Close()
+
+	hs := testHTTPStreamer(url, 10)
+	hs.Send(nil, []byte(`{"eventID":"1"}`))
+	err := hs.Flush()
+	if err == nil || !strings.Contains(err.Error(), "after 2 retries") {
+		t.Fatalf("Expected the request to be retried, got %v", err)
+	}
+}
+
+func TestLoadHTTPConfig(t *testing.T) {
+	for _, name := range []string{"CT_HTTP_URL", "CT_HTTP_HEADERS", "CT_HTTP_BASIC_AUTH", "CT_HTTP_BATCH_SIZE"} {
+		defer os.Unsetenv(name)
+	}
+
+	hc, err := loadHTTPConfig()
+	if err != nil || hc != nil {
+		t.Fatalf("Expected no HTTP sink without CT_HTTP_URL, got %v, %v", hc, err)
+	}
+
+	os.Setenv("CT_HTTP_URL", "https://example.com/cloudtrail")
+	os.Setenv("CT_HTTP_HEADERS", "X-Team: secops, X-Source:cloudtrail")
+	os.Setenv("CT_HTTP_BASIC_AUTH", "user:pass:word")
+	os.Setenv("CT_HTTP_BATCH_SIZE", "50")
+	hc, err = loadHTTPConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.header.Get("X-Team") != "secops" || hc.header.Get("X-Source") != "cloudtrail" {
+		t.Fatalf("Unexpected headers %v", hc.header)
+	}
+	if hc.header.Get("Authorization") != "Basic dXNlcjpwYXNzOndvcmQ=" {
+		t.Fatalf("Unexpected Authorization header %s", hc.header.Get("Authorization"))
+	}
+	if hc.batchSize != 50 || hc.batchBytes != DEFAULT_HTTP_BATCH_BYTES {
+		t.Fatalf("Unexpected batch limits %d and %d", hc.batchSize, hc.batchBytes)
+	}
+
+	for name, value := range map[string]string{
+		"CT_HTTP_URL":        "ftp://example.com",
+		"CT_HTTP_HEADERS":    "X-Team",
+		"CT_HTTP_BATCH_SIZE": "0",
+	} {
+		saved := os.Getenv(name)
+		os.Setenv(name, value)
+		_, err = loadHTTPConfig()
+		if err == nil {
+			t.Fatalf("Expected an error with %s set to %s", name, value)
+		}
+		os.Setenv(name, saved)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	KINESIS_MAX_BATCH_COUNT  = 500             // Max records in a single PutRecords call
+	KINESIS_MAX_BATCH_BYTES  = 5 * 1024 * 1024 // Max payload (data and partition keys) of a single PutRecords call
+	KINESIS_MAX_RECORD_BYTES = 1024 * 1024     // Max size of a single record (data and partition key)
+	KINESIS_MAX_RETRIES      = 3               // Number of times partially failed records are retried
+
+	KINESIS_MAX_PARTITION_KEY_BYTES = 256 // Max length of a partition key
+
+	DEFAULT_KINESIS_PARTITION_KEYS = "eventID"
+)
+
+func init() {
+	registerSink(
+		"kinesis",
+		func(c *Config) bool { return c.awsKinesisStream != "" },
+		func(c *Config) (Sink, error) {
+			return NewKinesisStreamer(c.kinesisClient, c.awsKinesisStream, c.awsKinesisBatchSize, c.awsKinesisPartitionKeys), nil
+		},
+	)
+}
+
+// kinesisPartitionKey returns the partition key for a record, using the value
+// of the first of fields that is present in the record. If none are present,
+// the md5 of the encoded record is used so records are still spread evenly
+// across shards. Values longer than a partition key allows are replaced by
+// their md5, as truncating them could split a multi-byte character.
+func kinesisPartitionKey(fields []string, record map[string]interface{}, encodedRecord []byte) string {
+	for _, field := range fields {
+		if v, ok := record[field].(string); ok && v != "" {
+			if len(v) > KINESIS_MAX_PARTITION_KEY_BYTES {
+				sum := md5.Sum([]byte(v))
+				return hex.EncodeToString(sum[:])
+			}
+			return v
+		}
+	}
+	sum := md5.Sum(encodedRecord)
+	return hex.EncodeToString(sum[:])
+}
+
+type KinesisStreamer struct {
+	client        kinesisiface.KinesisAPI
+	streamName    string
+	batchSize     int
+	partitionKeys []string      // Record fields tried, in order, for the partition key
+	backoff       time.Duration // Base wait between retries of failed records
+
+	batch      []*kinesis.PutRecordsRequestEntry
+	batchBytes int
+}
+
+func NewKinesisStreamer(client kinesisiface.KinesisAPI, streamName string, batchSize int, partitionKeys []string) *KinesisStreamer {
+	return &KinesisStreamer{
+		client:        client,
+		streamName:    streamName,
+		batchSize:     batchSize,
+		partitionKeys: partitionKeys,
+		backoff:       100 * time.Millisecond,
+	}
+}
+
+func (ks *KinesisStreamer) MaxRecordBytes() int {
+	return KINESIS_MAX_DATA_BYTES
+}
+
+func (ks *KinesisStreamer) Send(record map[string]interface{}, encodedRecord []byte) error {
+	partitionKey := kinesisPartitionKey(ks.partitionKeys, record, encodedRecord)
+	size := len(encodedRecord) + len(partitionKey)
+	if size > KINESIS_MAX_RECORD_BYTES {
+		return &recordRejectedError{fmt.Sprintf("record with partition key %s is %d bytes, over the Kinesis limit", partitionKey, size)}
+	}
+
+	var err error
+	if len(ks.batch) >= ks.batchSize || ks.batchBytes+size > KINESIS_MAX_BATCH_BYTES {
+		err = ks.Flush()
+	}
+
+	ks.batch = append(ks.batch, &kinesis.PutRecordsRequestEntry{
+		Data:         encodedRecord,
+		PartitionKey: aws.String(partitionKey),
+	})
+	ks.batchBytes += size
+
+	return err
+}
+
+// Flush puts the current batch to the stream. Records that fail (e.g. because a shard
+// was throttled) are retried with exponential backoff up to KINESIS_MAX_RETRIES times.
+func (ks *KinesisStreamer) Flush() error {
+	entries := ks.batch
+	ks.batch = nil
+	ks.batchBytes = 0
+
+	for attempt := 0; len(entries) > 0; attempt++ {
+		out, err := ks.client.PutRecords(&kinesis.PutRecordsInput{
+			Records:    entries,
+			StreamName: aws.String(ks.streamName),
+		})
+		if err != nil {
+			return err
+		}
+		if aws.Int64Value(out.FailedRecordCount) == 0 {
+			return nil
+		}
+
+		var failed []*kinesis.PutRecordsRequestEntry
+		for i, r := range out.Records {
+			if r.ErrorCode != nil {
+				log.Debugf("Kinesis record failed with %s: %s", aws.StringValue(r.ErrorCode), aws.StringValue(r.ErrorMessage))
+				failed = append(failed, entries[i])
+			}
+		}
+		if attempt >= KINESIS_MAX_RETRIES {
+			return fmt.Errorf("%d records failed to be put to stream %s after %d retries", len(failed), ks.streamName, attempt)
+		}
+
+		log.Infof("Retrying %d failed kinesis records", len(failed))
+		time.Sleep(ks.backoff * time.Duration(1<<uint(attempt)))
+		entries = failed
+	}
+
+	return nil
+}
+
+func (ks *KinesisStreamer) Close() error {
+	err := ks.Flush()
+	log.Debug("Kinesis Streamer closed")
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// fakeKinesis records PutRecords calls, failing the first failFirst entries of each
+// of the first failCalls calls.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+
+	failCalls int
+	failFirst int
+
+	calls [][]*kinesis.PutRecordsRequestEntry
+}
+
+func (fk *fakeKinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	fk.calls = append(fk.calls, input.Records)
+
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for i := range input.Records {
+		entry := &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1")}
+		if len(fk.calls) <= fk.failCalls && i < fk.failFirst {
+			entry = &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+				ErrorMessage: aws.String("slow down"),
+			}
+			*out.FailedRecordCount++
+		}
+		out.Records = append(out.Records, entry)
+	}
+	return out, nil
+}
+
+var testRecord = map[string]interface{}{"eventID": "key"}
+
+func newTestKinesisStreamer(fk *fakeKinesis, batchSize int) *KinesisStreamer {
+	ks := NewKinesisStreamer(fk, "test", batchSize, []string{"eventID"})
+	ks.backoff = 0
+	return ks
+}
+
+func TestKinesisBatching(t *testing.T) {
+	fk := &fakeKinesis{}
+	ks := newTestKinesisStreamer(fk, 2)
+
+	for i := 0; i < 5; i++ {
+		ks.Send(testRecord, []byte(`{"foo":"bar"}`))
+	}
+	ks.Close()
+
+	if len(fk.calls) != 3 {
+		t.Fatalf("Expected 3 PutRecords calls, got %d", len(fk.calls))
+	}
+	if len(fk.calls[2]) != 1 {
+		t.Fatalf("Expected last batch to have 1 record, got %d", len(fk.calls[2]))
+	}
+
+	// Batches are also split on the total payload size
+	fk = &fakeKinesis{}
+	ks = newTestKinesisStreamer(fk, KINESIS_MAX_BATCH_COUNT)
+	big := []byte(strings.Repeat("a", KINESIS_MAX_RECORD_BYTES-3))
+	for i := 0; i < 6; i++ {
+		ks.Send(testRecord, big)
+	}
+	ks.Close()
+
+	if len(fk.calls) != 2 || len(fk.calls[0]) != 5 {
+		t.Fatalf("Expected batches to be split at %d bytes", KINESIS_MAX_BATCH_BYTES)
+	}
+
+	// Records over the per-record limit are dropped
+	fk = &fakeKinesis{}
+	ks = newTestKinesisStreamer(fk, KINESIS_MAX_BATCH_COUNT)
+	err := ks.Send(testRecord, append(big, 'a'))
+	if err == nil {
+		t.Fatal("Expected error sending oversized record")
+	}
+	ks.Close()
+
+	if len(fk.calls) != 0 {
+		t.Fatal("Expected oversized record to be dropped")
+	}
+}
+
+func TestKinesisRetriesFailedRecords(t *testing.T) {
+	fk := &fakeKinesis{failCalls: 2, failFirst: 1}
+	ks := newTestKinesisStreamer(fk, KINESIS_MAX_BATCH_COUNT)
+
+	ks.Send(testRecord, []byte("1"))
+	ks.Send(testRecord, []byte("2"))
+	err := ks.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fk.calls) != 3 {
+		t.Fatalf("Expected 3 PutRecords calls, got %d", len(fk.calls))
+	}
+	if len(fk.calls[1]) != 1 || string(fk.calls[1][0].Data) != "1" {
+		t.Fatal("Expected only the failed record to be retried")
+	}
+
+	fk = &fakeKinesis{failCalls: KINESIS_MAX_RETRIES + 1, failFirst: 1}
+	ks = newTestKinesisStreamer(fk, KINESIS_MAX_BATCH_COUNT)
+	ks.Send(testRecord, []byte("1"))
+	err = ks.Flush()
+	if err == nil {
+		t.Fatal("Expected error after exhausting retries")
+	}
+}
+
+func TestKinesisPartitionKey(t *testing.T) {
+	fields := []string{"recipientAccountId", "eventID"}
+
+	key := kinesisPartitionKey(fields, map[string]interface{}{"eventID": "abc"}, nil)
+	if key != "abc" {
+		t.Fatalf("Expected partition key abc, got %s", key)
+	}
+
+	key = kinesisPartitionKey(fields, map[string]interface{}{"eventID": "abc", "recipientAccountId": "123"}, nil)
+	if key != "123" {
+		t.Fatalf("Expected partition key 123, got %s", key)
+	}
+
+	key = kinesisPartitionKey(fields, map[string]interface{}{"foo": "bar"}, []byte(`{"foo":"bar"}`))
+	if len(key) != 32 {
+		t.Fatalf("Expected md5 fallback partition key, got %s", key)
+	}
+
+	long := strings.Repeat("é", 200)
+	key = kinesisPartitionKey(fields, map[string]interface{}{"eventID": long}, nil)
+	if len(key) != 32 || !utf8.ValidString(key) {
+		t.Fatalf("Expected md5 of over-long partition key, got %s", key)
+	}
+	if key == kinesisPartitionKey(fields, map[string]interface{}{"eventID": long + "x"}, nil) {
+		t.Fatal("Expected over-long partition keys with the same prefix to differ")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	LEDGER_MEMORY    = "memory"
+	LEDGER_FILE      = "file"
+	LEDGER_DYNAMODB  = "dynamodb"
+	LEDGER_DATASTORE = "datastore"
+
+	LEDGER_KIND      = "ledger"
+	LEDGER_NAMESPACE = "cloudtrail-streamer"
+
+	DEFAULT_LEDGER_RETENTION = 30 * 24 * time.Hour
+)
+
+// objectRef identifies a single version of a log file. The ETag is included so an
+// object that is overwritten with different content is streamed again.
+type objectRef struct {
+	Bucket string
+	Key    string
+	ETag   string
+}
+
+func (o objectRef) id() string {
+	return fmt.Sprintf("%s/%s@%s", o.Bucket, o.Key, o.ETag)
+}
+
+// normalizeETag strips the quotes that GetObject and listings return ETags in, and that
+// S3 event notifications leave out, so ETags from any of them can be compared.
+func normalizeETag(eTag string) string {
+	return strings.Trim(eTag, `"`)
+}
+
+// Ledger records which log files have been completely streamed, so that a log file
+// which is delivered again, or retried after a later object in the same event failed,
+// is not streamed twice.
+type Ledger interface {
+	// IsProcessed returns whether the object has already been completely streamed.
+	IsProcessed(obj objectRef) (bool, error)
+	// MarkProcessed records that every record of the object has been streamed.
+	MarkProcessed(obj objectRef) error
+}
+
+// MemoryLedger keeps the ledger in memory. It only dedups objects within the lifetime
+// of a single process, and is meant for tests and the replay command.
+type MemoryLedger struct {
+	mu        sync.Mutex
+	processed map[string]time.Time
+}
+
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{processed: make(map[string]time.Time)}
+}
+
+func (ml *MemoryLedger) IsProcessed(obj objectRef) (bool, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	_, ok := ml.processed[obj.id()]
+	return ok, nil
+}
+
+func (ml *MemoryLedger) MarkProcessed(obj objectRef) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.processed[obj.id()] = time.Now()
+	return nil
+}
+
+// FileLedger is a MemoryLedger that is saved to a JSON file after every change, so
+// a backfill with the replay command can be resumed.
+type FileLedger struct {
+	*MemoryLedger
+	path string
+}
+
+func NewFileLedger(path string) (*FileLedger, error) {
+	fl := &FileLedger{MemoryLedger: NewMemoryLedger(), path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fl, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &fl.processed)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading ledger file %s: %s", path, err)
+	}
+	return fl, nil
+}
+
+func (fl *FileLedger) MarkProcessed(obj objectRef) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.processed[obj.id()] = time.Now()
+
+	data, err := json.Marshal(fl.processed)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so the ledger is never left half written
+	tmp, err := ioutil.TempFile(filepath.Dir(fl.path), filepath.Base(fl.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fl.path)
+}
+
+// DynamoDBLedger keeps the ledger in a DynamoDB table with a string partition key named
+// "id". Items carry an "expiresAt" epoch timestamp, which can be used as the TTL
+// attribute of the table.
+type DynamoDBLedger struct {
+	client    dynamodbiface.DynamoDBAPI
+	table     string
+	retention time.Duration
+}
+
+func NewDynamoDBLedger(client dynamodbiface.DynamoDBAPI, table string, retention time.Duration) *DynamoDBLedger {
+	return &DynamoDBLedger{client: client, table: table, retention: retention}
+}
+
+func (dl *DynamoDBLedger) IsProcessed(obj objectRef) (bool, error) {
+	out, err := dl.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(dl.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(obj.id())},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(out.Item) > 0, nil
+}
+
+func (dl *DynamoDBLedger) MarkProcessed(obj objectRef) error {
+	now := time.Now()
+	_, err := dl.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(dl.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":          {S: aws.String(obj.id())},
+			"processedAt": {S: aws.String(now.UTC().Format(time.RFC3339))},
+			"expiresAt":   {N: aws.String(strconv.FormatInt(now.Add(dl.retention).Unix(), 10))},
+		},
+	})
+	return err
+}
+
+// DatastoreLedger keeps the ledger in GCP Datastore, for deployments that already
+// use GCP for their sinks.
+type DatastoreLedger struct {
+	client *datastore.Client
+}
+
+type datastoreLedgerEntry struct {
+	ProcessedAt time.Time `datastore:"processed_at,noindex"`
+}
+
+func NewDatastoreLedger(client *datastore.Client) *DatastoreLedger {
+	return &DatastoreLedger{client: client}
+}
+
+func (dl *DatastoreLedger) key(obj objectRef) *datastore.Key {
+	nk := datastore.NameKey(LEDGER_KIND, obj.id(), nil)
+	nk.Namespace = LEDGER_NAMESPACE
+	return nk
+}
+
+func (dl *DatastoreLedger) IsProcessed(obj objectRef) (bool, error) {
+	var entry datastoreLedgerEntry
+	err := dl.client.Get(context.Background(), dl.key(obj), &entry)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (dl *DatastoreLedger) MarkProcessed(obj objectRef) error {
+	_, err := dl.client.Put(context.Background(), dl.key(obj), &datastoreLedgerEntry{ProcessedAt: time.Now()})
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (fd *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: fd.items[aws.StringValue(input.Key["id"].S)]}, nil
+}
+
+func (fd *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	fd.items[aws.StringValue(input.Item["id"].S)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func testLedger(t *testing.T, ledger Ledger) {
+	obj := objectRef{Bucket: "bucket", Key: "key", ETag: "1"}
+
+	processed, err := ledger.IsProcessed(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed {
+		t.Fatal("Expected object not to be processed yet")
+	}
+
+	err = ledger.MarkProcessed(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err = ledger.IsProcessed(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processed {
+		t.Fatal("Expected object to be processed")
+	}
+
+	// A new version of the object has a different ETag
+	processed, err = ledger.IsProcessed(objectRef{Bucket: "bucket", Key: "key", ETag: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed {
+		t.Fatal("Expected new version of object not to be processed")
+	}
+}
+
+func TestMemoryLedger(t *testing.T) {
+	testLedger(t, NewMemoryLedger())
+}
+
+func TestFileLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.json")
+
+	ledger, err := NewFileLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLedger(t, ledger)
+
+	// The ledger is loaded back from the file
+	ledger, err = NewFileLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := ledger.IsProcessed(objectRef{Bucket: "bucket", Key: "key", ETag: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processed {
+		t.Fatal("Expected object to be processed after reloading the ledger")
+	}
+}
+
+func TestDynamoDBLedger(t *testing.T) {
+	fd := &fakeDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	testLedger(t, NewDynamoDBLedger(fd, "ledger", DEFAULT_LEDGER_RETENTION))
+
+	item := fd.items["bucket/key@1"]
+	if item == nil || item["expiresAt"] == nil {
+		t.Fatal("Expected item with an expiresAt attribute")
+	}
+}
+
+func TestStreamSkipsProcessedObjects(t *testing.T) {
+	fs := &fakeS3{objects: map[string][]byte{"key": []byte(`{"Records": [{"eventID": "1"}]}`)}}
+	sink := &fakeSink{}
+	s := &Streamer{
+		sinks:       fixedSinks([]*streamerSink{{"fake", sink}}),
+		ledger:      NewMemoryLedger(),
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+	}
+
+	for i := 0; i < 2; i++ {
+		err := s.Stream("us-east-1", "bucket", "key", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.sent) != 1 {
+		t.Fatalf("Expected the object to be streamed once, sent %d records", len(sink.sent))
+	}
+
+	// Objects are only marked once every sink has succeeded
+	fs.objects["failing"] = []byte(`{"Records": [{"eventID": "2"}]}`)
+	sink.flushErr = os.ErrClosed
+	err := s.Stream("us-east-1", "bucket", "failing", "")
+	if err == nil {
+		t.Fatal("Expected error from failing sink")
+	}
+	sink.flushErr = nil
+	err = s.Stream("us-east-1", "bucket", "failing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 3 {
+		t.Fatalf("Expected the failed object to be streamed again, sent %d records", len(sink.sent))
+	}
+}
+
+func TestStreamChecksLedgerBeforeFetching(t *testing.T) {
+	data := []byte(`{"Records": [{"eventID": "1"}]}`)
+	fs := &fakeS3{objects: map[string][]byte{"key": data}}
+	sink := &fakeSink{}
+	var opened int
+	s := &Streamer{
+		sinks: func() ([]*streamerSink, error) {
+			opened++
+			return []*streamerSink{{"fake", sink}}, nil
+		},
+		ledger:      NewMemoryLedger(),
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+	}
+
+	// S3 events give the ETag without the quotes GetObject returns it in
+	eTag := fmt.Sprintf("%x", md5.Sum(data))
+	err := s.Stream("us-east-1", "bucket", "key", eTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once streamed, the object is neither fetched nor are sinks opened for it
+	delete(fs.objects, "key")
+	err = s.Stream("us-east-1", "bucket", "key", eTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || opened != 1 {
+		t.Fatalf("Expected the object to be streamed once, sent %d records from %d openings", len(sink.sent), opened)
+	}
+}
+
+func TestDryRunSkipsLedger(t *testing.T) {
+	os.Setenv("CT_LEDGER", LEDGER_MEMORY)
+	os.Setenv("CT_DEDUP_WINDOW", "1h")
+	defer func() {
+		os.Unsetenv("CT_LEDGER")
+		os.Unsetenv("CT_DEDUP_WINDOW")
+	}()
+
+	c := &Config{dryRun: true}
+	err := c.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ledger != nil || c.recordDeduper != nil {
+		t.Fatal("Expected a dry run not to use the ledger or dedup records")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LOG_FORMAT_AUTO       = "auto"       // Detect the format from the first key of the log file
+	LOG_FORMAT_CLOUDTRAIL = "cloudtrail" // A JSON object holding a Records array
+	LOG_FORMAT_NDJSON     = "ndjson"     // One JSON object per line
+
+	FORMAT_SNIFF_BYTES = 4096 // Bytes of a decompressed log file peeked at to detect its format
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// RecordReader returns the records of a log file one at a time, so a log file
+// never has to be held in memory all at once.
+type RecordReader interface {
+	// Next returns the next record, or io.EOF once every record has been read.
+	Next() (map[string]interface{}, error)
+	// Close releases the underlying object.
+	Close() error
+}
+
+// readLogFile returns a RecordReader for a log file stored in S3. The compression of
+// the object is detected from its magic bytes rather than its content type, as objects
+// copied by other tools often have a generic content type. The caller must close the
+// reader, which also closes the object body.
+func readLogFile(object *s3.GetObjectOutput, format string) (RecordReader, error) {
+	return newRecordReader(object.Body, format)
+}
+
+// newRecordReader returns a RecordReader for the log file read from body, in the given
+// format or, if it is empty, the format set with CT_LOG_FORMAT. Closing the
+// RecordReader closes body.
+func newRecordReader(body io.ReadCloser, format string) (RecordReader, error) {
+	closers := []io.Closer{body}
+
+	logFileBlob, err := decompress(body, &closers)
+	if err != nil {
+		closeAll(closers)
+		log.Errorf("Error decompressing log file: %s", err)
+		return nil, err
+	}
+
+	if format == "" {
+		format = globalConfig.logFormat
+	}
+	if format == "" || format == LOG_FORMAT_AUTO {
+		format = detectFormat(logFileBlob)
+	}
+
+	newReader, ok := formatRegistry[format]
+	if !ok {
+		closeAll(closers)
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+	reader, err := newReader(logFileBlob, closers)
+	if err != nil {
+		closeAll(closers)
+		log.Errorf("Error reading %s log file: %s", format, err)
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// decompress returns a reader of the decompressed contents of r, adding any
+// decompressors that need closing to closers.
+func decompress(r io.Reader, closers *[]io.Closer) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		*closers = append(*closers, gzipReader)
+		return bufio.NewReader(gzipReader), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		*closers = append(*closers, zstdCloser{zstdReader})
+		return bufio.NewReader(zstdReader), nil
+	default:
+		return br, nil
+	}
+}
+
+// zstdCloser adapts zstd.Decoder, whose Close does not return an error, to io.Closer.
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (zc zstdCloser) Close() error {
+	zc.Decoder.Close()
+	return nil
+}
+
+// detectFormat peeks at the start of a decompressed log file. CloudTrail log files are an
+// object whose first key is Records; any other leading object is taken to be the first
+// record of an NDJSON file.
+func detectFormat(br *bufio.Reader) string {
+	peeked, _ := br.Peek(FORMAT_SNIFF_BYTES)
+	dec := json.NewDecoder(bytes.NewReader(peeked))
+
+	tok, err := dec.Token()
+	if err != nil || tok != json.Delim('{') {
+		return LOG_FORMAT_CLOUDTRAIL
+	}
+	tok, err = dec.Token()
+	if err != nil {
+		return LOG_FORMAT_CLOUDTRAIL
+	}
+	if key, ok := tok.(string); ok && key != "Records" {
+		return LOG_FORMAT_NDJSON
+	}
+	return LOG_FORMAT_CLOUDTRAIL
+}
+
+func closeAll(closers []io.Closer) error {
+	var firstErr error
+	for i := len(closers) - 1; i >= 0; i-- {
+		err := closers[i].Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// cloudTrailReader walks the tokens of a CloudTrail log file, which is a JSON object
+// holding a "Records" array, decoding a single record at a time. Other top level keys
+// are skipped.
+type cloudTrailReader struct {
+	dec     *json.Decoder
+	closers []io.Closer
+
+	inRecords bool // The decoder is positioned inside the Records array
+	done      bool // The closing brace of the top level object has been read
+}
+
+func newCloudTrailReader(r io.Reader, closers []io.Closer) (*cloudTrailReader, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected log file to be a JSON object, found %v", tok)
+	}
+	return &cloudTrailReader{dec: dec, closers: closers}, nil
+}
+
+func (cr *cloudTrailReader) Next() (map[string]interface{}, error) {
+	for !cr.done {
+		if cr.inRecords {
+			if !cr.dec.More() {
+				// Consume the closing bracket of the Records array
+				_, err := cr.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				cr.inRecords = false
+				continue
+			}
+			var record map[string]interface{}
+			err := cr.dec.Decode(&record)
+			if err != nil {
+				return nil, err
+			}
+			if record == nil {
+				continue
+			}
+			return record, nil
+		}
+
+		if !cr.dec.More() {
+			// Consume the closing brace of the log file
+			_, err := cr.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			cr.done = true
+			break
+		}
+
+		tok, err := cr.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := tok.(string); ok && key == "Records" {
+			tok, err = cr.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if tok == nil {
+				continue
+			}
+			if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+				return nil, fmt.Errorf("expected Records to be an array, found %v", tok)
+			}
+			cr.inRecords = true
+			continue
+		}
+
+		var skipped json.RawMessage
+		err = cr.dec.Decode(&skipped)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, io.EOF
+}
+
+func (cr *cloudTrailReader) Close() error {
+	return closeAll(cr.closers)
+}
+
+// ndjsonReader decodes a log file holding one JSON object per line, as produced by
+// CloudTrail Lake exports and many log forwarders.
+type ndjsonReader struct {
+	dec     *json.Decoder
+	closers []io.Closer
+}
+
+func newNDJSONReader(r io.Reader, closers []io.Closer) *ndjsonReader {
+	return &ndjsonReader{dec: json.NewDecoder(r), closers: closers}
+}
+
+func (nr *ndjsonReader) Next() (map[string]interface{}, error) {
+	for {
+		var record map[string]interface{}
+		err := nr.dec.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+}
+
+func (nr *ndjsonReader) Close() error {
+	return closeAll(nr.closers)
+}
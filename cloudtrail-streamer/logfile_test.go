@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
+)
+
+// sliceRecordReader is a RecordReader over records already in memory.
+type sliceRecordReader struct {
+	records []map[string]interface{}
+}
+
+func (sr *sliceRecordReader) Next() (map[string]interface{}, error) {
+	if len(sr.records) == 0 {
+		return nil, io.EOF
+	}
+	record := sr.records[0]
+	sr.records = sr.records[1:]
+	return record, nil
+}
+
+func (sr *sliceRecordReader) Close() error {
+	return nil
+}
+
+func readAllRecords(reader RecordReader) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func newTestObject(data []byte) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{Body: BufferCloser{bytes.NewBuffer(data)}}
+}
+
+func TestCloudTrailReader(t *testing.T) {
+	tests := []struct {
+		data    string
+		records int
+		fails   bool
+	}{
+		{`{"Records": [{"event": 1}, {"event": 2}, {"event": 3}]}`, 3, false},
+		{`{"Before": {"Records": [{"event": 0}]}, "Records": [{"event": 1}], "After": [1, 2]}`, 1, false},
+		{`{"Records": [{"event": 1}, null]}`, 1, false},
+		{`{"Records": []}`, 0, false},
+		{`{"Records": null}`, 0, false},
+		{`{}`, 0, false},
+		{`[{"event": 1}]`, 0, true},
+		{`{"Records": {"event": 1}}`, 0, true},
+		{`{"Records": [{"event": 1}, {"event": `, 1, true},
+	}
+
+	globalConfig.logFormat = LOG_FORMAT_CLOUDTRAIL
+	defer func() { globalConfig.logFormat = "" }()
+
+	for _, test := range tests {
+		reader, err := readLogFile(newTestObject([]byte(test.data)), "")
+		var records []map[string]interface{}
+		if err == nil {
+			records, err = readAllRecords(reader)
+			reader.Close()
+		}
+		if test.fails != (err != nil) {
+			t.Errorf("Unexpected error result reading %s: %v", test.data, err)
+		}
+		if len(records) != test.records {
+			t.Errorf("Expected %d records reading %s, got %d", test.records, test.data, len(records))
+		}
+	}
+}
+
+func TestReadLogFileEncodings(t *testing.T) {
+	cloudTrail := []byte(`{"Records": [{"eventID": "1"}, {"eventID": "2"}]}`)
+	ndjson := []byte("{\"eventID\": \"1\"}\n\n{\"eventID\": \"2\"}\n")
+
+	gzipData := func(data []byte) []byte {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	zstdData := func(data []byte) []byte {
+		buf := &bytes.Buffer{}
+		zw, err := zstd.NewWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := map[string][]byte{
+		"plain cloudtrail": cloudTrail,
+		"gzip cloudtrail":  gzipData(cloudTrail),
+		"zstd cloudtrail":  zstdData(cloudTrail),
+		"plain ndjson":     ndjson,
+		"gzip ndjson":      gzipData(ndjson),
+		"zstd ndjson":      zstdData(ndjson),
+	}
+
+	for name, data := range tests {
+		// No content type is set, the encoding must be detected from the data
+		reader, err := readLogFile(newTestObject(data), "")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		records, err := readAllRecords(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(records) != 2 || records[1]["eventID"] != "2" {
+			t.Errorf("%s: unexpected records %v", name, records)
+		}
+	}
+}
+
+func TestReadLogFileForcedFormat(t *testing.T) {
+	// An NDJSON file whose records have a leading Records key can only be read
+	// when the format is configured
+	data := []byte("{\"Records\": 1, \"eventID\": \"1\"}\n{\"Records\": 2, \"eventID\": \"2\"}\n")
+
+	reader, err := readLogFile(newTestObject(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAllRecords(reader)
+	reader.Close()
+	if err == nil {
+		t.Fatal("Expected detected cloudtrail format to fail")
+	}
+
+	globalConfig.logFormat = LOG_FORMAT_NDJSON
+	defer func() { globalConfig.logFormat = "" }()
+
+	reader, err = readLogFile(newTestObject(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	records, err := readAllRecords(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+}
+
+func BenchmarkReadLogFile(b *testing.B) {
+	data, err := ioutil.ReadFile("testdata/example.json.gz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkReadLogFile(b, data, 3)
+}
+
+func BenchmarkReadLargeLogFile(b *testing.B) {
+	var records []string
+	for i := 0; i < 10000; i++ {
+		records = append(records, fmt.Sprintf(`{"eventID": "%d", "eventName": "DescribeStream", "requestParameters": {"streamName": "%s"}}`, i, strings.Repeat("a", 512)))
+	}
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(`{"Records": [` + strings.Join(records, ",") + `]}`))
+	if err != nil {
+		b.Fatal(err)
+	}
+	zw.Close()
+	benchmarkReadLogFile(b, buf.Bytes(), len(records))
+}
+
+func benchmarkReadLogFile(b *testing.B, data []byte, expected int) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		reader, err := readLogFile(newTestObject(data), "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		count := 0
+		for {
+			_, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			count++
+		}
+		reader.Close()
+		if count != expected {
+			b.Fatalf("Expected %d records, got %d", expected, count)
+		}
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -17,16 +17,20 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 
+	"cloud.google.com/go/datastore"
 	stackdriver "cloud.google.com/go/logging"
 	"cloud.google.com/go/pubsub"
 	"google.golang.org/api/option"
 
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/mozlogrus"
-	"go.mozilla.org/sops"
-	"go.mozilla.org/sops/decrypt"
 )
 
 func init() {
@@ -43,45 +47,58 @@ var (
 	globalConfig Config
 )
 
-const GZIP_CONTENT_TYPE = "application/x-gzip"
-
 type Config struct {
 	awsS3RoleArn string // Optional Role to assume for S3 operations
-	eventType    string // Whether to use the S3 or SNS event handler. Default is S3.
+	eventType    string // Whether to use the S3, SNS or SQS event handler. Default is S3.
+	logFormat    string // Format of the log files, or auto to detect it. Default is auto.
+	dryRun       bool   // Write records to stdout instead of the configured sinks
 
 	awsSession *session.Session
 
+	awsKinesisStream        string   // Kinesis stream name
+	awsKinesisRegion        string   // Region the Kinesis stream lives in
+	awsKinesisRoleArn       string   // Optional Role to assume for Kinesis operations
+	awsKinesisBatchSize     int      // Number of records in a single PutRecords call
+	awsKinesisPartitionKeys []string // Record fields tried, in order, for the partition key
+
+	kinesisClient *kinesis.Kinesis
+
 	gcpProjectId       string // GCP Project Id for where the PubSub Topic or Stackdriver logger live
 	gcpTopicId         string // GCP PubSub Topic Id
 	gcpStackdriverName string // GCP Stackdriver name
 
+	gcpPubSubAttributes  []string // Record fields published as PubSub message attributes
+	gcpPubSubOrderingKey string   // Record field used as the PubSub ordering key, if set
+
+	gcpCredentials []byte // GCP credentials JSON, once read from its source
+
 	pubsubClient      *pubsub.Client
-	stackdriverClient *stackdriver.Client
+	stackdriverClient *stackdriver.Client // Shared by the Stackdriver sinks of every object
 
-	eventFilters []*EventFilter
-}
+	httpConfig   *httpSinkConfig // Optional generic HTTP sink
+	splunkConfig *splunkConfig   // Optional Splunk HTTP Event Collector sink
 
-func (c *Config) getGcpCredentials() ([]byte, error) {
-	// TODO: Set this as an env var?
-	path := "./gcp_credentials.json"
+	secretsManagerClient secretsmanageriface.SecretsManagerAPI // Created on first use
+	ssmClient            ssmiface.SSMAPI                       // Created on first use
 
-	log.Debugf("Accessing gcp credentials from %s", path)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
+	filters *FilterConfig
+	routes  *RouteConfig
 
-	credentials, err := decrypt.Data(data, "json")
-	if err != nil {
-		if err.Error() == sops.MetadataNotFound.Error() {
-			// not an encrypted file
-			credentials = data
-		} else {
-			return nil, err
-		}
-	}
+	ledger        Ledger         // Optional ledger of completely streamed log files
+	recordDeduper *recordDeduper // Optional dedup of records by eventID
+
+	enrichers []Enricher // Run on every record that is streamed
+	redactor  *Redactor  // Optional redaction of record fields
+
+	digestValidator *digestValidator // Optional validation of log files against CloudTrail digests
 
-	return credentials, nil
+	concurrency int // Maximum number of objects streamed at once
+
+	metrics *metricsConfig // Where metrics are written besides the summary log line
+
+	deadLetters DeadLetterStore // Optional store of objects and records that can't be streamed
+
+	detections *DetectionConfig // Optional detections run on every record
 }
 
 func (c *Config) init() error {
@@ -94,24 +111,127 @@ func (c *Config) init() error {
 	if eventType != "" {
 		c.eventType = eventType
 	}
-	if c.eventType != "S3" && c.eventType != "SNS" {
-		return fmt.Errorf("CT_EVENT_TYPE is set to an invalid value, %s, must be either 'S3' or 'SNS'", eventType)
+	if c.eventType != "S3" && c.eventType != "SNS" && c.eventType != "SQS" {
+		return fmt.Errorf("CT_EVENT_TYPE is set to an invalid value, %s, must be one of 'S3', 'SNS' or 'SQS'", eventType)
+	}
+
+	c.logFormat = LOG_FORMAT_AUTO
+	logFormat := os.Getenv("CT_LOG_FORMAT")
+	if logFormat != "" {
+		c.logFormat = logFormat
+	}
+	if _, ok := formatRegistry[c.logFormat]; !ok && c.logFormat != LOG_FORMAT_AUTO {
+		return fmt.Errorf("CT_LOG_FORMAT is set to an invalid value, %s, must be 'auto' or one of '%s'", logFormat, strings.Join(formatNames(), "', '"))
+	}
+
+	filters, err := loadFilterConfig()
+	if err != nil {
+		return err
+	}
+	if !filters.isEmpty() {
+		c.filters = filters
+	}
+
+	c.routes, err = loadRouteConfig()
+	if err != nil {
+		return err
+	}
+
+	// A dry run only writes records to stdout, so it neither skips objects recorded in the
+	// ledger nor records the objects it printed
+	if !c.dryRun {
+		err = c.initDedup()
+		if err != nil {
+			return err
+		}
+	}
+
+	c.enrichers, err = loadEnrichers()
+	if err != nil {
+		return err
+	}
+
+	c.redactor, err = loadRedactor()
+	if err != nil {
+		return err
+	}
+
+	c.digestValidator, err = loadDigestValidator()
+	if err != nil {
+		return err
+	}
+
+	c.concurrency = DEFAULT_CONCURRENCY
+	if v := os.Getenv("CT_CONCURRENCY"); v != "" {
+		c.concurrency, err = strconv.Atoi(v)
+		if err != nil || c.concurrency < 1 {
+			return fmt.Errorf("CT_CONCURRENCY is set to an invalid value, %s, must be a positive integer", v)
+		}
+	}
+
+	c.metrics = loadMetricsConfig()
+
+	c.detections, err = loadDetectionConfig()
+	if err != nil {
+		return err
 	}
 
-	filters := os.Getenv("CT_EVENT_FILTERS")
-	if filters != "" {
-		c.eventFilters = parseFilters(filters)
+	if c.dryRun {
+		// Records are only written to stdout, so none of the sinks are configured and
+		// metrics would be mixed in with the records
+		c.metrics.emf = false
+		return nil
 	}
 
+	c.awsKinesisStream = os.Getenv("CT_KINESIS_STREAM")
 	c.gcpTopicId = os.Getenv("CT_TOPIC_ID")
 	c.gcpStackdriverName = os.Getenv("CT_STACKDRIVER_NAME")
-	if c.gcpTopicId == "" && c.gcpStackdriverName == "" {
-		return fmt.Errorf("Either CT_TOPIC_ID or CT_STACKDRIVER_NAME must be set")
+
+	c.deadLetters, err = loadDeadLetterStore()
+	if err != nil {
+		return err
+	}
+	if c.digestValidator != nil && c.digestValidator.mode == DIGEST_VALIDATION_REJECT && c.deadLetters == nil {
+		// Digests are delivered after the log files they list, so without a store to hold
+		// log files until then, rejecting would stream nearly every one unvalidated
+		return fmt.Errorf("CT_DEAD_LETTER must be set when CT_DIGEST_VALIDATION is 'reject'")
+	}
+
+	c.httpConfig, err = loadHTTPConfig()
+	if err != nil {
+		return err
+	}
+	c.splunkConfig, err = loadSplunkConfig()
+	if err != nil {
+		return err
+	}
+
+	if c.awsKinesisStream == "" && c.gcpTopicId == "" && c.gcpStackdriverName == "" && c.httpConfig == nil && c.splunkConfig == nil {
+		return fmt.Errorf("One of CT_KINESIS_STREAM, CT_TOPIC_ID, CT_STACKDRIVER_NAME, CT_HTTP_URL or CT_SPLUNK_URL must be set")
+	}
+
+	// Routes may stream to destinations of a kind the default ones don't use
+	needKinesis := c.awsKinesisStream != ""
+	needPubSub := c.gcpTopicId != "" || c.detections != nil
+	needStackdriver := c.gcpStackdriverName != ""
+	for _, r := range c.routes.Routes {
+		if r.Action == ROUTE_STREAM {
+			needKinesis = needKinesis || r.KinesisStream != ""
+			needPubSub = needPubSub || r.Topic != ""
+			needStackdriver = needStackdriver || r.StackdriverName != ""
+		}
+	}
+
+	if needKinesis {
+		err := c.initKinesis()
+		if err != nil {
+			return err
+		}
 	}
 
 	c.gcpProjectId = os.Getenv("CT_PROJECT_ID")
 
-	if c.gcpTopicId != "" || c.gcpStackdriverName != "" {
+	if needPubSub || needStackdriver {
 		if c.gcpProjectId == "" {
 			return fmt.Errorf("CT_PROJECT_ID must be set")
 		}
@@ -121,14 +241,23 @@ func (c *Config) init() error {
 			log.Fatalf("Error getting GCP credentials. Err: %s", err)
 		}
 
-		if c.gcpTopicId != "" {
+		if needPubSub {
+			attributes, ok := os.LookupEnv("CT_PUBSUB_ATTRIBUTES")
+			if !ok {
+				attributes = DEFAULT_PUBSUB_ATTRIBUTES
+			}
+			if attributes != "" {
+				c.gcpPubSubAttributes = strings.Split(attributes, ",")
+			}
+			c.gcpPubSubOrderingKey = os.Getenv("CT_PUBSUB_ORDERING_KEY")
+
 			c.pubsubClient, err = pubsub.NewClient(context.Background(), c.gcpProjectId, option.WithCredentialsJSON(gcpPubSubCredentials))
 			if err != nil {
 				log.Fatalf("Error creating pubsubClient. Err: %s", err)
 			}
 		}
-		if c.gcpStackdriverName != "" {
-			c.stackdriverClient, err = stackdriver.NewClient(context.Background(), c.gcpProjectId, option.WithCredentialsJSON(gcpPubSubCredentials))
+		if needStackdriver {
+			c.stackdriverClient, err = newStackdriverClient(c.gcpProjectId, gcpPubSubCredentials)
 			if err != nil {
 				log.Fatalf("Error creating stackdriverClient. Err: %s", err)
 			}
@@ -141,45 +270,39 @@ func (c *Config) init() error {
 	return nil
 }
 
-type CloudTrailFile struct {
-	Records []map[string]interface{} `json:"Records"`
-}
-
-type EventFilter struct {
-	EventName   string
-	EventSource string
-}
-
-func parseFilters(filters string) []*EventFilter {
-	var eventFilters []*EventFilter
-	for _, filter := range strings.Split(filters, ",") {
-		event_filter := strings.Split(filter, ":")
-		if len(event_filter) != 2 {
-			continue
+func (c *Config) initKinesis() error {
+	c.awsKinesisRegion = os.Getenv("CT_KINESIS_REGION")
+	if c.awsKinesisRegion == "" {
+		return fmt.Errorf("CT_KINESIS_REGION must be set")
+	}
+	c.awsKinesisRoleArn = os.Getenv("CT_KINESIS_ROLE_ARN")
+
+	c.awsKinesisBatchSize = KINESIS_MAX_BATCH_COUNT
+	batchSize := os.Getenv("CT_KINESIS_BATCH_SIZE")
+	if batchSize != "" {
+		var err error
+		c.awsKinesisBatchSize, err = strconv.Atoi(batchSize)
+		if err != nil || c.awsKinesisBatchSize < 1 || c.awsKinesisBatchSize > KINESIS_MAX_BATCH_COUNT {
+			return fmt.Errorf("CT_KINESIS_BATCH_SIZE is set to an invalid value, %s, must be between 1 and %d", batchSize, KINESIS_MAX_BATCH_COUNT)
 		}
-		eventFilters = append(eventFilters, newEventFilter(event_filter[0], event_filter[1]))
 	}
-	return eventFilters
-}
-
-func newEventFilter(source, name string) *EventFilter {
-	return &EventFilter{EventName: name, EventSource: fmt.Sprintf("%s.amazonaws.com", source)}
-}
 
-func (ef *EventFilter) DoesMatch(record map[string]interface{}) bool {
-	return record["eventName"] == ef.EventName || record["eventSource"] == ef.EventSource
-}
+	partitionKeys := os.Getenv("CT_KINESIS_PARTITION_KEYS")
+	if partitionKeys == "" {
+		partitionKeys = DEFAULT_KINESIS_PARTITION_KEYS
+	}
+	c.awsKinesisPartitionKeys = strings.Split(partitionKeys, ",")
 
-func doFiltersMatch(record map[string]interface{}) bool {
-	for _, ef := range globalConfig.eventFilters {
-		if ef.DoesMatch(record) {
-			return true
-		}
+	kinesisClientConfig := aws.NewConfig().WithRegion(c.awsKinesisRegion)
+	if c.awsKinesisRoleArn != "" {
+		kinesisClientConfig.Credentials = stscreds.NewCredentials(c.awsSession, c.awsKinesisRoleArn)
 	}
-	return false
+	c.kinesisClient = kinesis.New(c.awsSession, kinesisClientConfig)
+
+	return nil
 }
 
-func fetchLogFromS3(s3Client *s3.S3, bucket string, objectKey string) (*s3.GetObjectOutput, error) {
+func fetchLogFromS3(s3Client s3iface.S3API, bucket string, objectKey string) (*s3.GetObjectOutput, error) {
 	logInput := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(objectKey),
@@ -198,175 +321,592 @@ func fetchLogFromS3(s3Client *s3.S3, bucket string, objectKey string) (*s3.GetOb
 	return object, nil
 }
 
-func readLogFile(object *s3.GetObjectOutput) (*CloudTrailFile, error) {
-	defer object.Body.Close()
-
-	var logFileBlob io.ReadCloser
+func (c *Config) initDedup() error {
 	var err error
-	if object.ContentType != nil && *object.ContentType == GZIP_CONTENT_TYPE {
-		logFileBlob, err = gzip.NewReader(object.Body)
+	ledgerType := os.Getenv("CT_LEDGER")
+	switch ledgerType {
+	case "":
+	case LEDGER_MEMORY:
+		c.ledger = NewMemoryLedger()
+	case LEDGER_FILE:
+		path := os.Getenv("CT_LEDGER_FILE")
+		if path == "" {
+			return fmt.Errorf("CT_LEDGER_FILE must be set when CT_LEDGER is %s", LEDGER_FILE)
+		}
+		c.ledger, err = NewFileLedger(path)
 		if err != nil {
-			log.Errorf("Error unzipping cloudtrail json file: %s", err)
-			return nil, err
+			return err
 		}
-		defer logFileBlob.Close()
-	} else {
-		logFileBlob = object.Body
+	case LEDGER_DYNAMODB:
+		table := os.Getenv("CT_LEDGER_TABLE")
+		if table == "" {
+			return fmt.Errorf("CT_LEDGER_TABLE must be set when CT_LEDGER is %s", LEDGER_DYNAMODB)
+		}
+		retention := DEFAULT_LEDGER_RETENTION
+		if v := os.Getenv("CT_LEDGER_RETENTION"); v != "" {
+			retention, err = time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("CT_LEDGER_RETENTION is set to an invalid value, %s: %s", v, err)
+			}
+		}
+		c.ledger = NewDynamoDBLedger(dynamodb.New(c.awsSession), table, retention)
+	case LEDGER_DATASTORE:
+		projectId := os.Getenv("CT_PROJECT_ID")
+		if projectId == "" {
+			return fmt.Errorf("CT_PROJECT_ID must be set when CT_LEDGER is %s", LEDGER_DATASTORE)
+		}
+		credentials, err := c.getGcpCredentials()
+		if err != nil {
+			return fmt.Errorf("Error getting GCP credentials. Err: %s", err)
+		}
+		client, err := datastore.NewClient(context.Background(), projectId, option.WithCredentialsJSON(credentials))
+		if err != nil {
+			return fmt.Errorf("Error creating datastoreClient. Err: %s", err)
+		}
+		c.ledger = NewDatastoreLedger(client)
+	default:
+		return fmt.Errorf("CT_LEDGER is set to an invalid value, %s, must be one of '%s', '%s', '%s' or '%s'",
+			ledgerType, LEDGER_MEMORY, LEDGER_FILE, LEDGER_DYNAMODB, LEDGER_DATASTORE)
 	}
 
-	blobBuf := new(bytes.Buffer)
-	_, err = blobBuf.ReadFrom(logFileBlob)
-	if err != nil {
-		log.Errorf("Error reading from logFileBlob: %s", err)
-		return nil, err
+	if v := os.Getenv("CT_DEDUP_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("CT_DEDUP_WINDOW is set to an invalid value, %s", v)
+		}
+		maxEvents := DEFAULT_DEDUP_MAX_EVENTS
+		if v := os.Getenv("CT_DEDUP_MAX_EVENTS"); v != "" {
+			maxEvents, err = strconv.Atoi(v)
+			if err != nil || maxEvents < 1 {
+				return fmt.Errorf("CT_DEDUP_MAX_EVENTS is set to an invalid value, %s", v)
+			}
+		}
+		c.recordDeduper = newRecordDeduper(window, maxEvents)
+	}
+
+	return nil
+}
+
+type Streamer struct {
+	sinks      sinkFactory // Opens the sinks of the default destinations
+	routes     *RouteConfig
+	routeSinks map[string]sinkFactory // Opens the sinks of routes with their own destinations, by route name
+
+	ledger          Ledger
+	recordDeduper   *recordDeduper
+	enrichers       []Enricher
+	redactor        *Redactor
+	digestValidator *digestValidator
+	s3ClientFor     func(awsRegion string) s3iface.S3API
+
+	concurrency int
+	slots       chan struct{} // Bounds the objects being streamed at once, if set
+
+	metrics       *Metrics // Counters of the records streamed, if set
+	metricsConfig *metricsConfig
+
+	deadLetters DeadLetterStore
+
+	detections *DetectionConfig     // Detections run on every record read, if set
+	alerts     func() (Sink, error) // Opens the sink alerts are published to, nil to only log them
+}
+
+type streamerSink struct {
+	name string
+	sink Sink
+}
+
+// sinkFactory opens the sinks the records of an object are streamed to. Every object
+// is streamed to sinks of its own, so flushing them only waits for the records of that
+// object, and only returns their errors.
+type sinkFactory func() ([]*streamerSink, error)
+
+// NewStreamer sets up the sinks that are enabled in the global config, and the sinks
+// of routes that have their own destinations. Each is opened once, so a sink that
+// can't be created fails here rather than for every object.
+func NewStreamer() (*Streamer, error) {
+	s := &Streamer{
+		routes:          globalConfig.routes,
+		routeSinks:      make(map[string]sinkFactory),
+		ledger:          globalConfig.ledger,
+		recordDeduper:   globalConfig.recordDeduper,
+		enrichers:       globalConfig.enrichers,
+		redactor:        globalConfig.redactor,
+		digestValidator: globalConfig.digestValidator,
+		s3ClientFor:     s3Clients.get,
+		concurrency:     globalConfig.concurrency,
+		deadLetters:     globalConfig.deadLetters,
+	}
+	if s.concurrency < 1 {
+		s.concurrency = 1
 	}
+	s.slots = make(chan struct{}, s.concurrency)
 
-	var logFile CloudTrailFile
-	err = json.Unmarshal(blobBuf.Bytes(), &logFile)
+	s.sinks = sinksOf(&globalConfig, "")
+	err := checkSinks(s.sinks)
 	if err != nil {
-		log.Errorf("Error unmarshalling s3 object to CloudTrailFile: %s", err)
 		return nil, err
 	}
 
-	return &logFile, nil
-}
+	if s.routes != nil && !globalConfig.dryRun {
+		for _, route := range s.routes.Routes {
+			if route.Action != ROUTE_STREAM || !route.hasDestination() {
+				continue
+			}
+			sinks := sinksOf(route.config(&globalConfig), route.Name+"/")
+			err = checkSinks(sinks)
+			if err != nil {
+				return nil, err
+			}
+			s.routeSinks[route.Name] = sinks
+		}
+	}
 
-type Streamer struct {
-	pubsubStreamer      *PubSubStreamer
-	stackdriverStreamer *StackdriverStreamer
+	if globalConfig.detections != nil {
+		s.detections = globalConfig.detections
+		// Alerts are only logged in dry runs
+		if !globalConfig.dryRun {
+			s.alerts = func() (Sink, error) {
+				return NewPubSubStreamer(globalConfig.pubsubClient, globalConfig.detections.topicId, nil, ""), nil
+			}
+		}
+	}
+
+	s.metrics = newMetrics()
+	s.metricsConfig = globalConfig.metrics
+	return s, nil
 }
 
-func NewStreamer() *Streamer {
-	s := &Streamer{}
+// sinksOf returns a sinkFactory opening the sinks enabled in c.
+func sinksOf(c *Config, namePrefix string) sinkFactory {
+	return func() ([]*streamerSink, error) {
+		return newSinks(c, namePrefix)
+	}
+}
 
-	if globalConfig.gcpTopicId != "" {
-		s.pubsubStreamer = NewPubSubStreamer(globalConfig.pubsubClient)
+// checkSinks opens the sinks of a factory, and closes them again.
+func checkSinks(open sinkFactory) error {
+	sinks, err := open()
+	if err != nil {
+		return err
 	}
+	closeSinks(sinks)
+	return nil
+}
 
-	if globalConfig.gcpStackdriverName != "" {
-		s.stackdriverStreamer = NewStackdriverStreamer(globalConfig.stackdriverClient)
+// closeSinks closes the sinks opened for an object. Their records have been flushed
+// and their errors returned by then, so errors closing them are only logged.
+func closeSinks(sinks []*streamerSink) {
+	for _, ss := range sinks {
+		err := ss.sink.Close()
+		if err != nil {
+			log.Errorf("Error closing %s sink: %s", ss.name, err)
+		}
 	}
+}
 
-	return s
+// newSinks creates the sinks enabled in c, prefixing their names so errors tell which
+// route they belong to.
+func newSinks(c *Config, namePrefix string) ([]*streamerSink, error) {
+	var sinks []*streamerSink
+	for _, r := range sinkRegistry {
+		if !r.enabled(c) {
+			continue
+		}
+		sink, err := r.new(c)
+		if err != nil {
+			for _, ss := range sinks {
+				ss.sink.Close()
+			}
+			return nil, fmt.Errorf("Error creating %s%s sink: %s", namePrefix, r.name, err)
+		}
+		sinks = append(sinks, &streamerSink{name: namePrefix + r.name, sink: sink})
+	}
+	return sinks, nil
 }
 
-func (s *Streamer) Close() {
-	log.Info("Closing streamers")
-	if s.pubsubStreamer != nil {
-		s.pubsubStreamer.Close()
+// sinksFor returns the factory opening the sinks the records of an object are streamed
+// to, or false if the object is skipped.
+func (s *Streamer) sinksFor(key string) (sinkFactory, bool) {
+	route := s.routes.Match(key)
+	if route == nil {
+		return s.sinks, true
+	}
+	if route.Action == ROUTE_SKIP {
+		log.Infof("Skipping %s, it matches route %s", key, route.Name)
+		return nil, false
 	}
-	if s.stackdriverStreamer != nil {
-		s.stackdriverStreamer.Close()
+	if sinks, ok := s.routeSinks[route.Name]; ok {
+		return sinks, true
 	}
-	log.Info("Streamers closed.")
+	return s.sinks, true
 }
 
-func (s *Streamer) Stream(awsRegion string, bucket string, objectKey string) error {
+// Close writes the metrics of everything streamed. The sinks of each object are closed
+// once it has been streamed.
+func (s *Streamer) Close() error {
+	if s.metrics != nil {
+		s.metrics.logSummary()
+		if s.metricsConfig != nil && s.metricsConfig.emf {
+			err := s.metrics.writeEMF(s.metricsConfig.output, s.metricsConfig.namespace, time.Now())
+			if err != nil {
+				log.Errorf("Error writing metrics: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func newS3Client(awsRegion string) *s3.S3 {
 	s3ClientConfig := aws.NewConfig().WithRegion(awsRegion)
 	if globalConfig.awsS3RoleArn != "" {
 		creds := stscreds.NewCredentials(globalConfig.awsSession, globalConfig.awsS3RoleArn)
 		s3ClientConfig.Credentials = creds
 	}
-	s3Client := s3.New(globalConfig.awsSession, s3ClientConfig)
+	return s3.New(globalConfig.awsSession, s3ClientConfig)
+}
+
+// Stream streams the records of an object to the sinks. eTag is the ETag of the object
+// given by the event or listing it came from, if any, so objects that are already in the
+// ledger are skipped without fetching them.
+func (s *Streamer) Stream(awsRegion string, bucket string, objectKey string, eTag string) error {
+	if s.slots != nil {
+		s.slots <- struct{}{}
+		defer func() { <-s.slots }()
+	}
+
+	log.Debugf("Reading %s from %s in %s", objectKey, bucket, awsRegion)
+
+	openSinks, ok := s.sinksFor(objectKey)
+	if !ok {
+		return nil
+	}
+
+	ref := objectRef{Bucket: bucket, Key: objectKey, ETag: normalizeETag(eTag)}
+	if ref.ETag != "" && s.isProcessed(ref) {
+		return nil
+	}
+
+	object, err := fetchLogFromS3(s.s3ClientFor(awsRegion), bucket, objectKey)
+	if err != nil {
+		return err
+	}
+	if fetched := normalizeETag(aws.StringValue(object.ETag)); fetched != ref.ETag {
+		// The ETag wasn't known, or the object has been replaced since
+		ref.ETag = fetched
+		if s.isProcessed(ref) {
+			object.Body.Close()
+			return nil
+		}
+	}
+
+	sinks, err := openSinks()
+	if err != nil {
+		object.Body.Close()
+		return err
+	}
+	defer closeSinks(sinks)
+
+	source := recordSource{Region: awsRegion, Bucket: bucket, Key: objectKey, ETag: ref.ETag}
+	format := s.formatFor(objectKey)
+	// Only CloudTrail log files have digests
+	if s.digestValidator != nil && (format == "" || format == LOG_FORMAT_CLOUDTRAIL) {
+		stream, err := s.validateLogFile(awsRegion, ref, object, sinks, &source)
+		if err != nil {
+			object.Body.Close()
+			log.Errorf("%s", err)
+			return err
+		}
+		if !stream {
+			object.Body.Close()
+			s.markProcessed(ref)
+			return nil
+		}
+	}
+
+	records, err := readLogFile(object, format)
+	if err != nil {
+		// Objects that can't be read are kept in the dead-letter store, if there is one,
+		// as retrying them won't help
+		err = s.deadLetterObject(source, err)
+		if err != nil {
+			return err
+		}
+		s.markProcessed(ref)
+		return nil
+	}
+	defer records.Close()
+
+	err = s.streamToServices(sinks, records, source)
+	if err != nil {
+		log.Errorf("Error streaming records from %s/%s: %s", bucket, objectKey, err)
+		return err
+	}
 
-	log.Debugf("Reading %s from %s with client config of %+v", objectKey, bucket, s3Client.Config)
+	s.markProcessed(ref)
+	return nil
+}
+
+// isProcessed returns whether a log file is in the ledger, if there is one. A log file is
+// streamed again when the ledger can't be checked, as that is better than dropping it.
+func (s *Streamer) isProcessed(ref objectRef) bool {
+	if s.ledger == nil {
+		return false
+	}
+	processed, err := s.ledger.IsProcessed(ref)
+	if err != nil {
+		log.Errorf("Error checking ledger for %s, streaming it anyway: %s", ref.id(), err)
+		return false
+	}
+	if processed {
+		log.Infof("Skipping %s, it has already been streamed", ref.id())
+	}
+	return processed
+}
+
+// markProcessed adds a log file to the ledger, if there is one.
+func (s *Streamer) markProcessed(ref objectRef) {
+	if s.ledger == nil {
+		return
+	}
+	err := s.ledger.MarkProcessed(ref)
+	if err != nil {
+		// The records have been streamed, so don't fail and have them streamed again now
+		log.Errorf("Error marking %s as streamed in ledger: %s", ref.id(), err)
+	}
+}
 
-	object, err := fetchLogFromS3(s3Client, bucket, objectKey)
+// StreamFile streams the records of a log file on the local filesystem.
+func (s *Streamer) StreamFile(path string) error {
+	openSinks, ok := s.sinksFor(path)
+	if !ok {
+		return nil
+	}
+	sinks, err := openSinks()
 	if err != nil {
 		return err
 	}
+	defer closeSinks(sinks)
 
-	logFile, err := readLogFile(object)
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 
-	s.streamToServices(logFile)
+	source := recordSource{Key: path}
+	records, err := newRecordReader(f, s.formatFor(path))
+	if err != nil {
+		return s.deadLetterObject(source, err)
+	}
+	defer records.Close()
+
+	err = s.streamToServices(sinks, records, source)
+	if err != nil {
+		log.Errorf("Error streaming records from %s: %s", path, err)
+		return err
+	}
 
 	return nil
 }
 
-func (s *Streamer) streamToServices(logfile *CloudTrailFile) {
-	for _, record := range logfile.Records {
+// openDetector returns a detector for the records of an object, publishing alerts to a
+// sink of its own, or nil if detections are disabled.
+func (s *Streamer) openDetector() (*Detector, error) {
+	if s.detections == nil {
+		return nil, nil
+	}
+	var alerts Sink
+	if s.alerts != nil {
+		var err error
+		alerts, err = s.alerts()
+		if err != nil {
+			return nil, fmt.Errorf("Error creating detections sink: %s", err)
+		}
+	}
+	return NewDetector(s.detections, alerts), nil
+}
+
+// streamToServices enriches and redacts every record that is not filtered out and sends
+// it to all of the given sinks, then flushes them. A failing sink does not stop records from being sent to the
+// others; the errors of all sinks are returned together.
+func (s *Streamer) streamToServices(sinks []*streamerSink, records RecordReader, source recordSource) error {
+	var (
+		errs     sinkErrors
+		readErr  error
+		eventIDs []string
+		pending  = make(map[string]bool)
+		counts   = newObjectMetrics()
+		dl       = newDeadLetter(source)
+	)
+
+	detector, err := s.openDetector()
+	if err != nil {
+		return err
+	}
+	if detector != nil {
+		defer func() {
+			err := detector.Close()
+			if err != nil {
+				log.Errorf("Error closing detections sink: %s", err)
+			}
+		}()
+	}
+
+	// Oversized records are truncated rather than have the sinks reject them
+	limit := maxRecordBytes(sinks)
+	if s.redactor != nil && s.redactor.maxRecordBytes > 0 && (limit == 0 || s.redactor.maxRecordBytes < limit) {
+		limit = s.redactor.maxRecordBytes
+	}
+
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("Error reading records: %s", err)
+			break
+		}
+
+		eventSource := eventSourceOf(record)
+		counts.source(eventSource).Read++
+
+		// Detections run on every record, including those that are filtered out
+		if detector != nil {
+			errs.add("detections", detector.Detect(record))
+		}
+
 		if doFiltersMatch(record) {
+			counts.source(eventSource).Filtered++
 			continue
 		}
 
+		if s.recordDeduper != nil {
+			if eventID, ok := record["eventID"].(string); ok {
+				if pending[eventID] || s.recordDeduper.contains(eventID) {
+					log.Debugf("Skipping duplicate record %s", eventID)
+					counts.source(eventSource).Duplicate++
+					continue
+				}
+				pending[eventID] = true
+				eventIDs = append(eventIDs, eventID)
+			}
+		}
+
+		if source.Validation != "" {
+			enrichmentFields(record)["logFileValidation"] = source.Validation
+		}
+		for _, e := range s.enrichers {
+			e.Enrich(record, source)
+		}
+		if s.redactor != nil {
+			s.redactor.Redact(record)
+		}
+
 		log.Debugf("Writing record to streams: %v", record)
 		encodedRecord, err := json.Marshal(record)
 		if err != nil {
 			log.Errorf("Error marshalling record (%v) to json: %s", record, err)
+			counts.source(eventSource).Dropped++
 			continue
 		}
-
-		if s.pubsubStreamer != nil {
-			s.pubsubStreamer.Send(encodedRecord)
+		fittedRecord, err := fitRecord(record, encodedRecord, limit)
+		if err != nil {
+			log.Errorf("Dropping record %v: %s", record["eventID"], err)
+			counts.source(eventSource).Dropped++
+			dl.Records = append(dl.Records, &deadLetterRecord{Reason: err.Error(), Record: encodedRecord})
+			continue
 		}
-		if s.stackdriverStreamer != nil {
-			s.stackdriverStreamer.Send(encodedRecord)
+		encodedRecord = fittedRecord
+
+		counts.pending[eventSource]++
+		for _, ss := range sinks {
+			err := ss.sink.Send(record, encodedRecord)
+			var rejected *recordRejectedError
+			if s.deadLetters != nil && errors.As(err, &rejected) {
+				counts.sink(ss.name, eventSource).Failed++
+				dl.Records = append(dl.Records, &deadLetterRecord{Sink: ss.name, Reason: err.Error(), Record: encodedRecord})
+				continue
+			}
+			errs.add(ss.name, err)
+			counts.sent(ss.name, eventSource)
 		}
 	}
-}
 
-type PubSubStreamer struct {
-	topic *pubsub.Topic
-}
-
-func NewPubSubStreamer(client *pubsub.Client) *PubSubStreamer {
-	t := client.Topic(globalConfig.gcpTopicId)
-	t.PublishSettings = pubsub.PublishSettings{CountThreshold: 300}
-	return &PubSubStreamer{topic: t}
-}
+	for _, ss := range sinks {
+		errs.add(ss.name, ss.sink.Flush())
+	}
+	if detector != nil {
+		errs.add("detections", detector.Flush())
+	}
 
-func (ps *PubSubStreamer) Send(record []byte) {
-	ps.topic.Publish(context.Background(), &pubsub.Message{Data: record})
-}
+	counts.flushed(&errs)
+	if s.metrics != nil {
+		s.metrics.merge(counts)
+	}
 
-func (ps *PubSubStreamer) Close() {
-	ps.topic.Stop()
-	log.Info("PubSub Streamer closed")
-}
+	if s.deadLetters != nil {
+		if readErr != nil {
+			dl.Reason = readErr.Error()
+		}
+		err := s.writeDeadLetter(dl)
+		if err != nil {
+			errs.add("dead-letter", err)
+		} else {
+			readErr = nil
+		}
+	}
 
-type StackdriverStreamer struct {
-	logger *stackdriver.Logger
-}
+	if readErr != nil {
+		if errs.err() != nil {
+			return fmt.Errorf("%s; %s", readErr, errs.err())
+		}
+		return readErr
+	}
+	if errs.err() != nil {
+		return errs.err()
+	}
 
-func NewStackdriverStreamer(client *stackdriver.Client) *StackdriverStreamer {
-	l := client.Logger(globalConfig.gcpStackdriverName)
-	return &StackdriverStreamer{logger: l}
+	if s.recordDeduper != nil {
+		s.recordDeduper.add(eventIDs)
+	}
+	return nil
 }
 
-func (s *StackdriverStreamer) Send(record []byte) {
-	s.logger.Log(stackdriver.Entry{Payload: json.RawMessage(record)})
-}
+func S3Handler(ctx context.Context, s3Event events.S3Event) (err error) {
+	log.Infof("Handling S3 event: %v", s3Event)
 
-func (s *StackdriverStreamer) Close() {
-	err := s.logger.Flush()
+	streamer, err := NewStreamer()
 	if err != nil {
-		log.Errorf("Error flushing stackdriver logger. Err: %s", err)
+		return err
 	}
-	log.Info("Stackdriver Streamer closed")
-}
-
-func S3Handler(ctx context.Context, s3Event events.S3Event) error {
-	log.Infof("Handling S3 event: %v", s3Event)
+	defer func() {
+		closeErr := streamer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
 
-	streamer := NewStreamer()
-	defer streamer.Close()
+	return streamS3Event(streamer, s3Event)
+}
 
-	for _, s3Record := range s3Event.Records {
+// streamS3Event streams the objects of an S3 event concurrently. Every object is
+// streamed even if others fail, and the errors are returned in the order of the event.
+func streamS3Event(streamer *Streamer, s3Event events.S3Event) error {
+	names := make([]string, len(s3Event.Records))
+	errs := forEachConcurrently(len(s3Event.Records), streamer.concurrency, func(i int) error {
+		s3Record := s3Event.Records[i]
+		names[i] = s3Record.S3.Bucket.Name + "/" + s3Record.S3.Object.Key
 		log.Infof("Streaming from bucket %s and key %s", s3Record.S3.Bucket.Name, s3Record.S3.Object.Key)
-		err := streamer.Stream(
+		return streamer.Stream(
 			s3Record.AWSRegion,
 			s3Record.S3.Bucket.Name,
 			s3Record.S3.Object.Key,
+			s3Record.S3.Object.ETag,
 		)
-		if err != nil {
-			return err
-		}
-	}
+	})
 
-	return nil
+	return combineErrors(names, errs)
 }
 
 func SNSHandler(ctx context.Context, snsEvent events.SNSEvent) error {
@@ -388,14 +928,96 @@ func SNSHandler(ctx context.Context, snsEvent events.SNSEvent) error {
 	return nil
 }
 
+// snsEnvelope is the JSON body of an SQS message delivered from an SNS subscription
+// without raw message delivery.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// s3EventFromSQSBody returns the S3 event in the body of an SQS message. The body is either
+// the S3 event itself, when S3 notifies SQS directly or through SNS with raw message
+// delivery, or an SNS notification wrapping the S3 event.
+func s3EventFromSQSBody(body string) (events.S3Event, error) {
+	var (
+		s3Event  events.S3Event
+		envelope snsEnvelope
+	)
+
+	err := json.Unmarshal([]byte(body), &envelope)
+	if err != nil {
+		return s3Event, err
+	}
+	if envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	err = json.Unmarshal([]byte(body), &s3Event)
+	return s3Event, err
+}
+
+// SQSHandler streams the objects of the S3 events in a batch of SQS messages. Rather than
+// failing the whole batch, each message whose objects could not all be streamed is reported
+// as a batch item failure, so SQS only redelivers those messages.
+func SQSHandler(ctx context.Context, sqsEvent events.SQSEvent) (response events.SQSEventResponse, err error) {
+	log.Infof("Handling SQS event with %d messages", len(sqsEvent.Records))
+
+	streamer, err := NewStreamer()
+	if err != nil {
+		return response, err
+	}
+	defer func() {
+		closeErr := streamer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	// Objects are streamed at most streamer.concurrency at once across all messages
+	errs := forEachConcurrently(len(sqsEvent.Records), len(sqsEvent.Records), func(i int) error {
+		s3Event, err := s3EventFromSQSBody(sqsEvent.Records[i].Body)
+		if err != nil {
+			return err
+		}
+		return streamS3Event(streamer, s3Event)
+	})
+	for i, message := range sqsEvent.Records {
+		if errs[i] != nil {
+			log.Errorf("Error handling SQS message %s: %s", message.MessageId, errs[i])
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+		}
+	}
+
+	return response, nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "redrive" {
+		err := runRedrive(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Redrive failed: %s", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := runReplay(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Replay failed: %s", err)
+		}
+		return
+	}
+
 	log.Info("Starting cloudtrail-streamer")
 	err := globalConfig.init()
 	if err != nil {
 		log.Fatalf("Invalid config (%v): %s", globalConfig, err)
 	}
 
-	log.Debugf("Running with filters: %v", globalConfig.eventFilters)
+	if globalConfig.filters != nil {
+		log.Debugf("Running with %d allow and %d deny filter rules", len(globalConfig.filters.Allow), len(globalConfig.filters.Deny))
+	}
 
 	if globalConfig.eventType == "S3" {
 		log.Debug("Starting S3Handler")
@@ -403,7 +1025,10 @@ func main() {
 	} else if globalConfig.eventType == "SNS" {
 		log.Debug("Starting SNSHandler")
 		lambda.Start(SNSHandler)
+	} else if globalConfig.eventType == "SQS" {
+		log.Debug("Starting SQSHandler")
+		lambda.Start(SQSHandler)
 	} else {
-		log.Fatalf("eventType (%s) is not set to either S3 or SNS.", globalConfig.eventType)
+		log.Fatalf("eventType (%s) is not set to one of S3, SNS or SQS.", globalConfig.eventType)
 	}
 }
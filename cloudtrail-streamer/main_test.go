@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"testing"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -38,16 +40,22 @@ func TestReadLogFile(t *testing.T) {
 	cntType := "application/x-gzip"
 	obj := &s3.GetObjectOutput{Body: buf, ContentType: &cntType}
 
-	logFile, err := readLogFile(obj)
+	reader, err := readLogFile(obj, "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer reader.Close()
 
-	if len(logFile.Records) != 2 {
-		t.Fatal("Parsing error, len(logFile.Records) != 2")
+	records, err := readAllRecords(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatal("Parsing error, len(records) != 2")
 	}
 
-	encodedRecord, err := json.Marshal(logFile.Records[0])
+	encodedRecord, err := json.Marshal(records[0])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,3 +92,53 @@ func TestParseFilters(t *testing.T) {
 		t.Fatal("Parsing error, eventFiltersWithBad[0].EventName != ListClusters")
 	}
 }
+
+var testS3Event = `{"Records": [{"awsRegion": "us-east-1", "s3": {"bucket": {"name": "bucket"}, "object": {"key": "key.json.gz"}}}]}`
+
+func TestS3EventFromSQSBody(t *testing.T) {
+	snsBody, err := json.Marshal(map[string]string{
+		"Type":     "Notification",
+		"TopicArn": "arn:aws:sns:us-east-1:111122223333:cloudtrail",
+		"Message":  testS3Event,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// S3 notifying SQS directly and SNS raw message delivery both deliver the bare event
+	for _, body := range []string{testS3Event, string(snsBody)} {
+		s3Event, err := s3EventFromSQSBody(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s3Event.Records) != 1 || s3Event.Records[0].S3.Object.Key != "key.json.gz" {
+			t.Fatalf("Unexpected S3 event %+v from %s", s3Event, body)
+		}
+	}
+
+	_, err = s3EventFromSQSBody(`{"Type": "Notification", "Message": "not json"}`)
+	if err == nil {
+		t.Fatal("Expected error from invalid SNS message")
+	}
+}
+
+func TestSQSHandlerReportsFailures(t *testing.T) {
+	saved := sinkRegistry
+	defer func() { sinkRegistry = saved }()
+	sinkRegistry = nil
+	registerSink("fake", func(c *Config) bool { return true }, func(c *Config) (Sink, error) { return &fakeSink{}, nil })
+
+	sqsEvent := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `{"Service": "Amazon S3", "Event": "s3:TestEvent"}`},
+		{MessageId: "2", Body: "not json"},
+		{MessageId: "3", Body: `{"Records": []}`},
+	}}
+
+	response, err := SQSHandler(context.Background(), sqsEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "2" {
+		t.Fatalf("Expected only message 2 to fail, got %+v", response.BatchItemFailures)
+	}
+}
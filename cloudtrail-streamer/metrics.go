@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_METRICS_NAMESPACE = "cloudtrail-streamer"
+
+	UNKNOWN_EVENT_SOURCE = "unknown"
+)
+
+// recordCounts holds the counters of the records of a single eventSource. A record
+// counts as failed if its object failed to stream to any sink, and so will be retried.
+type recordCounts struct {
+	Read      int64 `json:"read"`
+	Filtered  int64 `json:"filtered"`  // Dropped by the filter rules
+	Duplicate int64 `json:"duplicate"` // Dropped by the record dedup
+	Dropped   int64 `json:"dropped"`   // Could not be encoded or made to fit the sinks
+	Sent      int64 `json:"sent"`
+	Failed    int64 `json:"failed"`
+}
+
+// sinkCounts holds the counters of the records sent to a single sink.
+type sinkCounts struct {
+	Sent   int64 `json:"sent"`
+	Failed int64 `json:"failed"`
+}
+
+// Metrics counts the records streamed during an invocation, per eventSource and per sink.
+type Metrics struct {
+	mu      sync.Mutex
+	sources map[string]*recordCounts
+	sinks   map[string]map[string]*sinkCounts // By sink, then eventSource
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		sources: make(map[string]*recordCounts),
+		sinks:   make(map[string]map[string]*sinkCounts),
+	}
+}
+
+func eventSourceOf(record map[string]interface{}) string {
+	if eventSource, ok := record["eventSource"].(string); ok && eventSource != "" {
+		return eventSource
+	}
+	return UNKNOWN_EVENT_SOURCE
+}
+
+// source returns the counters of an eventSource. The caller must hold the lock, unless
+// the metrics are only used by a single goroutine.
+func (m *Metrics) source(eventSource string) *recordCounts {
+	rc, ok := m.sources[eventSource]
+	if !ok {
+		rc = &recordCounts{}
+		m.sources[eventSource] = rc
+	}
+	return rc
+}
+
+func (m *Metrics) sink(name string, eventSource string) *sinkCounts {
+	sources, ok := m.sinks[name]
+	if !ok {
+		sources = make(map[string]*sinkCounts)
+		m.sinks[name] = sources
+	}
+	sc, ok := sources[eventSource]
+	if !ok {
+		sc = &sinkCounts{}
+		sources[eventSource] = sc
+	}
+	return sc
+}
+
+// objectMetrics counts the records of a single object as they are streamed. Whether
+// records were delivered is only known once the sinks are flushed, so sent records are
+// held as pending until then.
+type objectMetrics struct {
+	*Metrics
+	pending     map[string]int64            // Records handed to the sinks, by eventSource
+	sinkPending map[string]map[string]int64 // Records handed to each sink, by sink then eventSource
+}
+
+func newObjectMetrics() *objectMetrics {
+	return &objectMetrics{
+		Metrics:     newMetrics(),
+		pending:     make(map[string]int64),
+		sinkPending: make(map[string]map[string]int64),
+	}
+}
+
+func (om *objectMetrics) sent(sink string, eventSource string) {
+	if om.sinkPending[sink] == nil {
+		om.sinkPending[sink] = make(map[string]int64)
+	}
+	om.sinkPending[sink][eventSource]++
+}
+
+// flushed counts pending records as sent, or as failed for the sinks that failed.
+func (om *objectMetrics) flushed(errs *sinkErrors) {
+	for eventSource, n := range om.pending {
+		if errs.err() != nil {
+			om.source(eventSource).Failed += n
+		} else {
+			om.source(eventSource).Sent += n
+		}
+	}
+	for name, sources := range om.sinkPending {
+		_, failed := errs.first[name]
+		for eventSource, n := range sources {
+			if failed {
+				om.sink(name, eventSource).Failed += n
+			} else {
+				om.sink(name, eventSource).Sent += n
+			}
+		}
+	}
+}
+
+// merge adds the counters of an object to the metrics of the invocation.
+func (m *Metrics) merge(om *objectMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for eventSource, c := range om.sources {
+		rc := m.source(eventSource)
+		rc.Read += c.Read
+		rc.Filtered += c.Filtered
+		rc.Duplicate += c.Duplicate
+		rc.Dropped += c.Dropped
+		rc.Sent += c.Sent
+		rc.Failed += c.Failed
+	}
+	for name, sources := range om.sinks {
+		for eventSource, c := range sources {
+			sc := m.sink(name, eventSource)
+			sc.Sent += c.Sent
+			sc.Failed += c.Failed
+		}
+	}
+}
+
+// logSummary writes the counters as a single log line, with totals for the invocation
+// and for each sink, and the counters of each eventSource.
+func (m *Metrics) logSummary() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total recordCounts
+	for _, c := range m.sources {
+		total.Read += c.Read
+		total.Filtered += c.Filtered
+		total.Duplicate += c.Duplicate
+		total.Dropped += c.Dropped
+		total.Sent += c.Sent
+		total.Failed += c.Failed
+	}
+	sinks := make(map[string]*sinkCounts)
+	for name, sources := range m.sinks {
+		sinks[name] = &sinkCounts{}
+		for _, c := range sources {
+			sinks[name].Sent += c.Sent
+			sinks[name].Failed += c.Failed
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"records_read":      total.Read,
+		"records_filtered":  total.Filtered,
+		"records_duplicate": total.Duplicate,
+		"records_dropped":   total.Dropped,
+		"records_sent":      total.Sent,
+		"records_failed":    total.Failed,
+		"sinks":             sinks,
+		"event_sources":     m.sources,
+	}).Info("Processing summary")
+}
+
+// emfDocument is a log event in the CloudWatch Embedded Metric Format, which CloudWatch
+// turns into metrics when it is written to the function's logs.
+type emfDocument map[string]interface{}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+func newEMFDocument(namespace string, timestamp time.Time, dimensions [][]string, values map[string]interface{}) emfDocument {
+	doc := emfDocument{}
+	var names []string
+	for name, value := range values {
+		doc[name] = value
+		if _, ok := value.(int64); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var metrics []emfMetric
+	for _, name := range names {
+		metrics = append(metrics, emfMetric{Name: name, Unit: "Count"})
+	}
+	doc["_aws"] = map[string]interface{}{
+		"Timestamp": timestamp.UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": dimensions,
+			"Metrics":    metrics,
+		}},
+	}
+	return doc
+}
+
+// writeEMF writes a document for every eventSource, and for every sink and eventSource.
+// Sink counters are also published by sink alone, so drops can be alarmed on per sink.
+func (m *Metrics) writeEMF(w io.Writer, namespace string, timestamp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var docs []emfDocument
+	for eventSource, c := range m.sources {
+		docs = append(docs, newEMFDocument(namespace, timestamp, [][]string{{"EventSource"}}, map[string]interface{}{
+			"EventSource":      eventSource,
+			"RecordsRead":      c.Read,
+			"RecordsFiltered":  c.Filtered,
+			"RecordsDuplicate": c.Duplicate,
+			"RecordsDropped":   c.Dropped,
+			"RecordsSent":      c.Sent,
+			"RecordsFailed":    c.Failed,
+		}))
+	}
+	for name, sources := range m.sinks {
+		for eventSource, c := range sources {
+			docs = append(docs, newEMFDocument(namespace, timestamp, [][]string{{"Sink"}, {"Sink", "EventSource"}}, map[string]interface{}{
+				"Sink":          name,
+				"EventSource":   eventSource,
+				"RecordsSent":   c.Sent,
+				"RecordsFailed": c.Failed,
+			}))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	for _, doc := range docs {
+		err := enc.Encode(doc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsConfig holds where metrics are written besides the summary log line.
+type metricsConfig struct {
+	emf       bool // Write metrics in the Embedded Metric Format
+	namespace string
+	output    io.Writer
+}
+
+func loadMetricsConfig() *metricsConfig {
+	mc := &metricsConfig{
+		emf:       os.Getenv("CT_METRICS_EMF") == "1",
+		namespace: os.Getenv("CT_METRICS_NAMESPACE"),
+		output:    os.Stdout,
+	}
+	if mc.namespace == "" {
+		mc.namespace = DEFAULT_METRICS_NAMESPACE
+	}
+	return mc
+}
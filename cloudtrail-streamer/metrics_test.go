@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamToServicesCountsRecords(t *testing.T) {
+	os.Setenv("CT_FILTER_RULES", `{"deny": [{"match": {"eventName": "ConsoleLogin"}}]}`)
+	defer os.Unsetenv("CT_FILTER_RULES")
+	filters, err := loadFilterConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := globalConfig.filters
+	globalConfig.filters = filters
+	defer func() { globalConfig.filters = saved }()
+
+	good := &fakeSink{}
+	bad := &fakeSink{flushErr: errors.New("flush failed")}
+	s := &Streamer{
+		sinks:         fixedSinks([]*streamerSink{{"good", good}, {"bad", bad}}),
+		recordDeduper: newRecordDeduper(time.Hour, 100),
+		metrics:       newMetrics(),
+	}
+
+	records := &sliceRecordReader{records: []map[string]interface{}{
+		{"eventID": "1", "eventSource": "s3.amazonaws.com", "eventName": "GetObject"},
+		{"eventID": "1", "eventSource": "s3.amazonaws.com", "eventName": "GetObject"},
+		{"eventID": "2", "eventSource": "signin.amazonaws.com", "eventName": "ConsoleLogin"},
+		{"eventID": "3", "eventName": "Unknown"},
+	}}
+	err = s.streamToServices(openSinks(t, s.sinks), records, recordSource{})
+	if err == nil {
+		t.Fatal("Expected an error from the failing sink")
+	}
+
+	expected := map[string]recordCounts{
+		"s3.amazonaws.com":     {Read: 2, Duplicate: 1, Failed: 1},
+		"signin.amazonaws.com": {Read: 1, Filtered: 1},
+		UNKNOWN_EVENT_SOURCE:   {Read: 1, Failed: 1},
+	}
+	if len(s.metrics.sources) != len(expected) {
+		t.Fatalf("Expected counters for %d event sources, got %d", len(expected), len(s.metrics.sources))
+	}
+	for eventSource, counts := range expected {
+		if *s.metrics.sources[eventSource] != counts {
+			t.Fatalf("Expected %s counters %+v, got %+v", eventSource, counts, *s.metrics.sources[eventSource])
+		}
+	}
+	if c := s.metrics.sinks["good"]["s3.amazonaws.com"]; c.Sent != 1 || c.Failed != 0 {
+		t.Fatalf("Unexpected good sink counters %+v", *c)
+	}
+	if c := s.metrics.sinks["bad"]["s3.amazonaws.com"]; c.Sent != 0 || c.Failed != 1 {
+		t.Fatalf("Unexpected bad sink counters %+v", *c)
+	}
+}
+
+func TestWriteEMF(t *testing.T) {
+	m := newMetrics()
+	om := newObjectMetrics()
+	om.source("s3.amazonaws.com").Read = 3
+	om.pending["s3.amazonaws.com"] = 3
+	for i := 0; i < 3; i++ {
+		om.sent("kinesis", "s3.amazonaws.com")
+	}
+	om.flushed(&sinkErrors{})
+	m.merge(om)
+	m.merge(om)
+
+	var buf bytes.Buffer
+	err := m.writeEMF(&buf, DEFAULT_METRICS_NAMESPACE, time.Unix(1577934245, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&buf)
+	var docs []map[string]interface{}
+	for dec.More() {
+		var doc map[string]interface{}
+		err := dec.Decode(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Expected a document for the event source and for the sink, got %d", len(docs))
+	}
+
+	source, sink := docs[0], docs[1]
+	if source["EventSource"] != "s3.amazonaws.com" || source["RecordsRead"] != float64(6) || source["RecordsSent"] != float64(6) {
+		t.Fatalf("Unexpected event source document %v", source)
+	}
+	if sink["Sink"] != "kinesis" || sink["RecordsSent"] != float64(6) || sink["RecordsFailed"] != float64(0) {
+		t.Fatalf("Unexpected sink document %v", sink)
+	}
+
+	aws := sink["_aws"].(map[string]interface{})
+	if aws["Timestamp"] != float64(1577934245000) {
+		t.Fatalf("Unexpected timestamp %v", aws["Timestamp"])
+	}
+	directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	if directive["Namespace"] != DEFAULT_METRICS_NAMESPACE {
+		t.Fatalf("Unexpected namespace %v", directive["Namespace"])
+	}
+	if len(directive["Dimensions"].([]interface{})) != 2 || len(directive["Metrics"].([]interface{})) != 2 {
+		t.Fatalf("Unexpected metric directive %v", directive)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_PUBSUB_ATTRIBUTES = "eventSource,eventName,awsRegion,recipientAccountId"
+
+	PUBSUB_MAX_ATTRIBUTE_BYTES    = 1024
+	PUBSUB_MAX_ORDERING_KEY_BYTES = 1024
+)
+
+func init() {
+	registerSink(
+		"pubsub",
+		func(c *Config) bool { return c.gcpTopicId != "" },
+		func(c *Config) (Sink, error) {
+			return NewPubSubStreamer(c.pubsubClient, c.gcpTopicId, c.gcpPubSubAttributes, c.gcpPubSubOrderingKey), nil
+		},
+	)
+}
+
+type PubSubStreamer struct {
+	topic       *pubsub.Topic
+	attributes  []string // Record fields published as message attributes
+	orderingKey string   // Record field used as the ordering key, if set
+
+	results      []*pubsub.PublishResult // Results of messages published since the last Flush
+	orderingKeys []string                // Ordering key of each result
+}
+
+func NewPubSubStreamer(client *pubsub.Client, topicId string, attributes []string, orderingKey string) *PubSubStreamer {
+	t := client.Topic(topicId)
+	t.PublishSettings = pubsub.DefaultPublishSettings
+	t.PublishSettings.CountThreshold = 300
+	t.EnableMessageOrdering = orderingKey != ""
+	return &PubSubStreamer{topic: t, attributes: attributes, orderingKey: orderingKey}
+}
+
+func truncate(value string, max int) string {
+	if len(value) > max {
+		return value[:max]
+	}
+	return value
+}
+
+func (ps *PubSubStreamer) Send(record map[string]interface{}, encodedRecord []byte) error {
+	msg := ps.message(record, encodedRecord)
+	ps.results = append(ps.results, ps.topic.Publish(context.Background(), msg))
+	ps.orderingKeys = append(ps.orderingKeys, msg.OrderingKey)
+	return nil
+}
+
+// message returns the message for a record, with the configured attributes and ordering key.
+func (ps *PubSubStreamer) message(record map[string]interface{}, encodedRecord []byte) *pubsub.Message {
+	msg := &pubsub.Message{Data: encodedRecord}
+
+	// Attributes let subscriptions filter messages without decoding them
+	for _, field := range ps.attributes {
+		value, ok := lookupField(record, strings.Split(field, "."))
+		if !ok || value == "" {
+			continue
+		}
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string)
+		}
+		msg.Attributes[field] = truncate(value, PUBSUB_MAX_ATTRIBUTE_BYTES)
+	}
+
+	if ps.orderingKey != "" {
+		value, _ := lookupField(record, strings.Split(ps.orderingKey, "."))
+		msg.OrderingKey = truncate(value, PUBSUB_MAX_ORDERING_KEY_BYTES)
+	}
+
+	return msg
+}
+
+func (ps *PubSubStreamer) MaxRecordBytes() int {
+	return PUBSUB_MAX_DATA_BYTES
+}
+
+// Flush waits for the result of every message published since the last Flush.
+func (ps *PubSubStreamer) Flush() error {
+	results, orderingKeys := ps.results, ps.orderingKeys
+	ps.results, ps.orderingKeys = nil, nil
+
+	var (
+		failed   int
+		firstErr error
+		paused   = make(map[string]bool)
+	)
+	for i, r := range results {
+		_, err := r.Get(context.Background())
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			if orderingKeys[i] != "" {
+				paused[orderingKeys[i]] = true
+			}
+		}
+	}
+	// Publishing stops for an ordering key after a failure. The failure is returned so
+	// the object is retried, which can only succeed once publishing is resumed.
+	for key := range paused {
+		ps.topic.ResumePublish(key)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages failed to publish to topic %s: %s", failed, len(results), ps.topic.ID(), firstErr)
+	}
+	return nil
+}
+
+func (ps *PubSubStreamer) Close() error {
+	err := ps.Flush()
+	ps.topic.Stop()
+	log.Debug("PubSub Streamer closed")
+	return err
+}
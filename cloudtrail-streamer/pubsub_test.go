@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func newTestPubSubClient(t *testing.T) (*pubsub.Client, *pstest.Server) {
+	srv := pstest.NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func TestPubSubMessage(t *testing.T) {
+	client, srv := newTestPubSubClient(t)
+	defer srv.Close()
+	defer client.Close()
+
+	ps := NewPubSubStreamer(client, "topic", []string{"eventSource", "eventName", "userIdentity.type", "readOnly"}, "recipientAccountId")
+	defer ps.topic.Stop()
+	if !ps.topic.EnableMessageOrdering {
+		t.Fatal("Expected message ordering to be enabled")
+	}
+
+	record := map[string]interface{}{
+		"eventSource":        "s3.amazonaws.com",
+		"eventName":          strings.Repeat("x", 2000),
+		"recipientAccountId": "111122223333",
+		"userIdentity":       map[string]interface{}{"type": "AssumedRole"},
+		"readOnly":           true,
+	}
+	msg := ps.message(record, []byte("{}"))
+	expected := map[string]string{
+		"eventSource":       "s3.amazonaws.com",
+		"eventName":         strings.Repeat("x", PUBSUB_MAX_ATTRIBUTE_BYTES),
+		"userIdentity.type": "AssumedRole",
+		"readOnly":          "true",
+	}
+	if !reflect.DeepEqual(msg.Attributes, expected) {
+		t.Fatalf("Unexpected attributes %v", msg.Attributes)
+	}
+	if msg.OrderingKey != "111122223333" {
+		t.Fatalf("Unexpected ordering key %s", msg.OrderingKey)
+	}
+
+	// Records without the fields are published without attributes or ordering key
+	msg = ps.message(map[string]interface{}{}, []byte("{}"))
+	if msg.Attributes != nil || msg.OrderingKey != "" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+}
+
+func TestPubSubStreamer(t *testing.T) {
+	client, srv := newTestPubSubClient(t)
+	defer srv.Close()
+	defer client.Close()
+
+	_, err := client.CreateTopic(context.Background(), "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := NewPubSubStreamer(client, "topic", []string{"eventName"}, "")
+	err = ps.Send(map[string]interface{}{"eventName": "GetObject"}, []byte(`{"eventName":"GetObject"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ps.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := srv.Messages()
+	if len(messages) != 1 || messages[0].Attributes["eventName"] != "GetObject" {
+		t.Fatalf("Unexpected messages %+v", messages)
+	}
+
+	// Publish failures are returned by Flush
+	ps = NewPubSubStreamer(client, "missing", nil, "")
+	ps.Send(map[string]interface{}{}, []byte("{}"))
+	err = ps.Close()
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 messages failed to publish to topic missing") {
+		t.Fatalf("Expected publish failure, got %v", err)
+	}
+}
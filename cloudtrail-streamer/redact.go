@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Budgets for the encoded record, leaving room for the rest of the message or entry
+	PUBSUB_MAX_DATA_BYTES         = 10*1000*1000 - 64*1024 // 10 MB message limit, minus attributes
+	STACKDRIVER_MAX_PAYLOAD_BYTES = 256*1024 - 8*1024      // 256 KB entry limit, minus labels and metadata
+	KINESIS_MAX_DATA_BYTES        = KINESIS_MAX_RECORD_BYTES - 256
+
+	// Truncated values are replaced with a marker that is always shorter than this
+	TRUNCATION_MARKER_BYTES = 32
+)
+
+// recordLimiter is implemented by sinks that reject records over a size.
+type recordLimiter interface {
+	MaxRecordBytes() int
+}
+
+// maxRecordBytes returns the smallest record size limit of the sinks, or 0 if none of
+// them have one.
+func maxRecordBytes(sinks []*streamerSink) int {
+	var limit int
+	for _, ss := range sinks {
+		if rl, ok := ss.sink.(recordLimiter); ok {
+			if l := rl.MaxRecordBytes(); l > 0 && (limit == 0 || l < limit) {
+				limit = l
+			}
+		}
+	}
+	return limit
+}
+
+// Redactor drops or hashes fields of records and truncates long strings before they
+// are sent to the sinks. Paths are dot separated and may use * to match any field;
+// arrays are passed through, so a path applies to each of their elements.
+type Redactor struct {
+	drop           [][]string
+	hash           [][]string
+	hashKey        []byte // Key for HMAC-SHA256 hashes, plain SHA-256 is used if empty
+	maxFieldBytes  int    // Strings longer than this are truncated, if set
+	maxRecordBytes int    // Limit on encoded records on top of the sinks' own limits, if set
+}
+
+func splitPaths(paths string) [][]string {
+	var split [][]string
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			split = append(split, strings.Split(path, "."))
+		}
+	}
+	return split
+}
+
+// loadRedactor returns the redactor configured in the environment, or nil if none of
+// its settings are set.
+func loadRedactor() (*Redactor, error) {
+	r := &Redactor{
+		drop:    splitPaths(os.Getenv("CT_REDACT_DROP")),
+		hash:    splitPaths(os.Getenv("CT_REDACT_HASH")),
+		hashKey: []byte(os.Getenv("CT_REDACT_HASH_KEY")),
+	}
+
+	for name, limit := range map[string]*int{
+		"CT_MAX_FIELD_BYTES":  &r.maxFieldBytes,
+		"CT_MAX_RECORD_BYTES": &r.maxRecordBytes,
+	} {
+		if v := os.Getenv(name); v != "" {
+			var err error
+			*limit, err = strconv.Atoi(v)
+			if err != nil || *limit <= TRUNCATION_MARKER_BYTES {
+				return nil, fmt.Errorf("%s is set to an invalid value, %s, must be an integer over %d", name, v, TRUNCATION_MARKER_BYTES)
+			}
+		}
+	}
+
+	if len(r.drop) == 0 && len(r.hash) == 0 && r.maxFieldBytes == 0 && r.maxRecordBytes == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Redact drops, hashes and truncates the configured fields of the record in place.
+func (r *Redactor) Redact(record map[string]interface{}) {
+	for _, path := range r.drop {
+		rewritePath(record, path, func(value interface{}) (interface{}, bool) {
+			return nil, false
+		})
+	}
+	for _, path := range r.hash {
+		rewritePath(record, path, func(value interface{}) (interface{}, bool) {
+			return r.hashValue(value), true
+		})
+	}
+	if r.maxFieldBytes > 0 {
+		truncateStrings(record, r.maxFieldBytes)
+	}
+}
+
+// hashValue hashes strings as they are and other values as JSON, so equal values can
+// still be correlated.
+func (r *Redactor) hashValue(value interface{}) string {
+	data, ok := value.(string)
+	if !ok {
+		encoded, _ := json.Marshal(value)
+		data = string(encoded)
+	}
+	var sum []byte
+	if len(r.hashKey) > 0 {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(data))
+		sum = mac.Sum(nil)
+	} else {
+		hash := sha256.Sum256([]byte(data))
+		sum = hash[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+// rewritePath replaces every value at path with the result of fn, or deletes it if fn
+// returns false.
+func rewritePath(value interface{}, path []string, fn func(value interface{}) (interface{}, bool)) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			rewritePath(element, path, fn)
+		}
+	case map[string]interface{}:
+		key, rest := path[0], path[1:]
+		for k, child := range v {
+			if key != "*" && k != key {
+				continue
+			}
+			if len(rest) > 0 {
+				rewritePath(child, rest, fn)
+				continue
+			}
+			replacement, keep := fn(child)
+			if keep {
+				v[k] = replacement
+			} else {
+				delete(v, k)
+			}
+		}
+	}
+}
+
+// truncateString shortens s to at most max bytes, marker included, without splitting
+// a UTF-8 character.
+func truncateString(s string, max int) string {
+	marker := fmt.Sprintf("...[truncated %d bytes]", len(s))
+	cut := max - len(marker)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + marker
+}
+
+// truncateStrings truncates every string in value that is longer than max bytes.
+func truncateStrings(value interface{}, max int) {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, element := range v {
+			if s, ok := element.(string); ok && len(s) > max {
+				v[i] = truncateString(s, max)
+			} else {
+				truncateStrings(element, max)
+			}
+		}
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && len(s) > max {
+				v[k] = truncateString(s, max)
+			} else {
+				truncateStrings(child, max)
+			}
+		}
+	}
+}
+
+// fitRecord returns the encoded record, truncating its largest values until it is at
+// most limit bytes. It returns an error if the record can't be made to fit.
+func fitRecord(record map[string]interface{}, encodedRecord []byte, limit int) ([]byte, error) {
+	size := len(encodedRecord)
+	for limit > 0 && len(encodedRecord) > limit {
+		if !truncateLargest(record, len(encodedRecord)-limit, true) {
+			return nil, fmt.Errorf("record is %d bytes, over the limit of %d bytes", size, limit)
+		}
+		var err error
+		encodedRecord, err = json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encodedRecord, nil
+}
+
+// truncateLargest replaces a value under container with a marker, freeing at least
+// excess bytes if possible. It descends into the largest value for as long as that
+// frees enough, so as little of the record as possible is lost. Below the top level it
+// returns false rather than free too little, so the caller replaces a larger value.
+func truncateLargest(container interface{}, excess int, top bool) bool {
+	var (
+		largest     interface{}
+		largestSize int
+		replace     func(marker string)
+	)
+	consider := func(value interface{}, set func(marker string)) {
+		encoded, _ := json.Marshal(value)
+		if len(encoded) > largestSize {
+			largest, largestSize, replace = value, len(encoded), set
+		}
+	}
+	switch v := container.(type) {
+	case []interface{}:
+		for i, element := range v {
+			i := i
+			consider(element, func(marker string) { v[i] = marker })
+		}
+	case map[string]interface{}:
+		for k, child := range v {
+			k := k
+			consider(child, func(marker string) { v[k] = marker })
+		}
+	}
+
+	if largestSize <= TRUNCATION_MARKER_BYTES || (!top && largestSize-TRUNCATION_MARKER_BYTES < excess) {
+		return false
+	}
+	if truncateLargest(largest, excess, false) {
+		return true
+	}
+	if s, ok := largest.(string); ok {
+		replace(truncateString(s, len(s)-excess))
+		return true
+	}
+	replace(fmt.Sprintf("[truncated %d bytes]", largestSize))
+	return true
+}
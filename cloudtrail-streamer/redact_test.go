@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeRecord(t *testing.T, data string) map[string]interface{} {
+	var record map[string]interface{}
+	err := json.Unmarshal([]byte(data), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestRedact(t *testing.T) {
+	r := &Redactor{
+		drop:          splitPaths("requestParameters.password, responseElements.credentials.*"),
+		hash:          splitPaths("userIdentity.accessKeyId,resources.ARN"),
+		maxFieldBytes: 80,
+	}
+	record := decodeRecord(t, `{
+		"userIdentity": {"accessKeyId": "AKIAEXAMPLE", "type": "IAMUser"},
+		"requestParameters": {"userName": "alice", "password": "hunter2"},
+		"responseElements": {"credentials": {"sessionToken": "token", "expiration": "soon"}},
+		"resources": [{"ARN": "arn:aws:iam::111122223333:user/alice"}, {"type": "AWS::IAM::User"}],
+		"errorMessage": "éééééééééééééééééééééééééééééééééééééééééééééééééé"
+	}`)
+	r.Redact(record)
+
+	expected := decodeRecord(t, `{
+		"userIdentity": {"accessKeyId": "", "type": "IAMUser"},
+		"requestParameters": {"userName": "alice"},
+		"responseElements": {"credentials": {}},
+		"resources": [{"ARN": ""}, {"type": "AWS::IAM::User"}],
+		"errorMessage": "éééééééééééééééééééééééééééé...[truncated 100 bytes]"
+	}`)
+	expected["userIdentity"].(map[string]interface{})["accessKeyId"] = r.hashValue("AKIAEXAMPLE")
+	expected["resources"].([]interface{})[0].(map[string]interface{})["ARN"] = r.hashValue("arn:aws:iam::111122223333:user/alice")
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("Unexpected record %v", record)
+	}
+	if len(record["errorMessage"].(string)) > 80 {
+		t.Fatalf("Expected errorMessage to be truncated to 80 bytes, got %d", len(record["errorMessage"].(string)))
+	}
+}
+
+func TestRedactHashKey(t *testing.T) {
+	plain := &Redactor{}
+	keyed := &Redactor{hashKey: []byte("secret")}
+	if plain.hashValue("value") == keyed.hashValue("value") {
+		t.Fatal("Expected keyed hashes to differ from plain ones")
+	}
+	if keyed.hashValue("value") != keyed.hashValue("value") {
+		t.Fatal("Expected hashes to be stable")
+	}
+}
+
+func TestFitRecord(t *testing.T) {
+	record := map[string]interface{}{
+		"eventID": "1",
+		"responseElements": map[string]interface{}{
+			"policy": strings.Repeat("x", 10000),
+			"name":   "example",
+		},
+	}
+	encoded, _ := json.Marshal(record)
+
+	encoded, err := fitRecord(record, encoded, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) > 2000 {
+		t.Fatalf("Expected record to fit in 2000 bytes, got %d", len(encoded))
+	}
+	// Only the oversized field is truncated
+	responseElements := record["responseElements"].(map[string]interface{})
+	if record["eventID"] != "1" || responseElements["name"] != "example" {
+		t.Fatalf("Unexpected record %v", record)
+	}
+	if !strings.HasSuffix(responseElements["policy"].(string), "...[truncated 10000 bytes]") {
+		t.Fatalf("Expected truncation marker, got %s", responseElements["policy"])
+	}
+
+	// Objects made of many small values are replaced as a whole
+	var items []interface{}
+	for i := 0; i < 500; i++ {
+		items = append(items, map[string]interface{}{"id": i})
+	}
+	record = map[string]interface{}{"eventID": "2", "requestParameters": map[string]interface{}{"items": items}}
+	encoded, _ = json.Marshal(record)
+	encoded, err = fitRecord(record, encoded, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"eventID":"2","requestParameters":{"items":"[truncated 5391 bytes]"}}` {
+		t.Fatalf("Unexpected record %s", encoded)
+	}
+
+	_, err = fitRecord(record, encoded, 10)
+	if err == nil {
+		t.Fatal("Expected error fitting a record into 10 bytes")
+	}
+}
+
+type limitedSink struct {
+	*fakeSink
+	limit int
+}
+
+func (ls *limitedSink) MaxRecordBytes() int {
+	return ls.limit
+}
+
+func TestStreamToServicesFitsRecords(t *testing.T) {
+	sink := &fakeSink{}
+	s := &Streamer{sinks: fixedSinks([]*streamerSink{{"limited", &limitedSink{sink, 1000}}, {"stdout", &fakeSink{}}})}
+
+	records := &sliceRecordReader{records: []map[string]interface{}{
+		{"eventID": "1", "responseElements": map[string]interface{}{"blob": strings.Repeat("x", 5000)}},
+	}}
+	err := s.streamToServices(openSinks(t, s.sinks), records, recordSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.sent) != 1 || len(sink.sent[0]) > 1000 {
+		t.Fatalf("Expected a record of at most 1000 bytes, got %q", sink.sent)
+	}
+}
+
+func TestLoadRedactor(t *testing.T) {
+	r, err := loadRedactor()
+	if err != nil || r != nil {
+		t.Fatalf("Expected no redactor by default, got %v, %v", r, err)
+	}
+
+	os.Setenv("CT_MAX_FIELD_BYTES", "10")
+	defer os.Unsetenv("CT_MAX_FIELD_BYTES")
+	_, err = loadRedactor()
+	if err == nil {
+		t.Fatal("Expected error with a field limit shorter than the marker")
+	}
+
+	os.Setenv("CT_MAX_FIELD_BYTES", "4096")
+	os.Setenv("CT_REDACT_DROP", "requestParameters.password")
+	defer os.Unsetenv("CT_REDACT_DROP")
+	r, err = loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.maxFieldBytes != 4096 || !reflect.DeepEqual(r.drop, [][]string{{"requestParameters", "password"}}) {
+		t.Fatalf("Unexpected redactor %+v", r)
+	}
+}
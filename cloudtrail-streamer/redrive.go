@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runRedrive implements the redrive command, which streams the dead letters in the
+// CT_DEAD_LETTER store again once whatever made them fail has been fixed. Dead letters
+// are deleted once they have been streamed, unless --keep is set.
+func runRedrive(args []string) (err error) {
+	// Keep stdout for records written by dry runs
+	log.SetOutput(os.Stderr)
+
+	flags := flag.NewFlagSet("redrive", flag.ContinueOnError)
+	keep := flags.Bool("keep", false, "Keep dead letters after they have been re-driven")
+	dryRun := flags.Bool("dry-run", false, "Write records to stdout instead of the configured sinks")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	store, err := loadDeadLetterStore()
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return fmt.Errorf("CT_DEAD_LETTER must be set to re-drive dead letters")
+	}
+
+	globalConfig.dryRun = *dryRun
+	err = globalConfig.init()
+	if err != nil {
+		return err
+	}
+
+	streamer, err := NewStreamer()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := streamer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	// Dead-lettered objects were marked as processed, so they aren't retried by Lambda
+	streamer.ledger = nil
+
+	names, err := store.List()
+	if err != nil {
+		return err
+	}
+	log.Infof("Re-driving %d dead letters", len(names))
+
+	del := !*keep && !*dryRun
+	errs := forEachConcurrently(len(names), streamer.concurrency, func(i int) error {
+		err := streamer.redrive(store, names[i], del)
+		if err != nil {
+			log.Errorf("Error re-driving %s: %s", names[i], err)
+		}
+		return err
+	})
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters failed to re-drive", failed, len(names))
+	}
+
+	return nil
+}
+
+// redrive streams a dead letter again. Objects that could not be read are streamed
+// again from the start, bypassing the ledger, while records that were rejected are sent
+// as they were stored to the sink that rejected them.
+func (s *Streamer) redrive(store DeadLetterStore, name string, del bool) error {
+	data, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	var dl deadLetter
+	err = json.Unmarshal(data, &dl)
+	if err != nil {
+		return fmt.Errorf("Error parsing dead letter: %s", err)
+	}
+
+	log.Infof("Re-driving %s/%s from %s", dl.Bucket, dl.Key, name)
+	switch {
+	case dl.Reason != "" && dl.Bucket != "":
+		err = s.Stream(dl.Region, dl.Bucket, dl.Key, dl.ETag)
+	case dl.Reason != "":
+		err = s.StreamFile(dl.Key)
+	default:
+		err = s.sendDeadLetterRecords(&dl)
+	}
+	if err != nil {
+		return err
+	}
+
+	if del {
+		return store.Delete(name)
+	}
+	return nil
+}
+
+// sendDeadLetterRecords sends the records of a dead letter to the sinks of its object.
+func (s *Streamer) sendDeadLetterRecords(dl *deadLetter) error {
+	openSinks, ok := s.sinksFor(dl.Key)
+	if !ok {
+		return nil
+	}
+	sinks, err := openSinks()
+	if err != nil {
+		return err
+	}
+	defer closeSinks(sinks)
+
+	var errs sinkErrors
+	for _, r := range dl.Records {
+		var record map[string]interface{}
+		err := json.Unmarshal(r.Record, &record)
+		if err != nil {
+			return fmt.Errorf("Error parsing dead-lettered record: %s", err)
+		}
+		for _, ss := range sinks {
+			// Dry runs write every record to stdout
+			if r.Sink != "" && r.Sink != ss.name && !globalConfig.dryRun {
+				continue
+			}
+			errs.add(ss.name, ss.sink.Send(record, r.Record))
+		}
+	}
+	for _, ss := range sinks {
+		errs.add(ss.name, ss.sink.Flush())
+	}
+	return errs.err()
+}
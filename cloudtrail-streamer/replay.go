@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CloudTrail log file names embed the time the file was delivered, e.g.
+// 111122223333_CloudTrail_us-east-1_20261016T2305Z_EXAMPLE.json.gz
+var logFileTimeRegex = regexp.MustCompile(`_(\d{8}T\d{4}Z)_`)
+
+const LOG_FILE_TIME_FORMAT = "20060102T1504Z"
+
+// timeWindow selects log files by time. A zero since or until leaves that end of
+// the window open.
+type timeWindow struct {
+	since time.Time // Inclusive
+	until time.Time // Exclusive
+}
+
+func (tw timeWindow) contains(t time.Time) bool {
+	if !tw.since.IsZero() && t.Before(tw.since) {
+		return false
+	}
+	if !tw.until.IsZero() && !t.Before(tw.until) {
+		return false
+	}
+	return true
+}
+
+// parseReplayTime accepts either an RFC3339 timestamp or a date.
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither an RFC3339 timestamp nor a YYYY-MM-DD date", value)
+	}
+	return t, nil
+}
+
+// logFileTime returns the delivery time from a CloudTrail log file name, falling
+// back to the time the object was last modified.
+func logFileTime(object *s3.Object) time.Time {
+	match := logFileTimeRegex.FindStringSubmatch(aws.StringValue(object.Key))
+	if match != nil {
+		t, err := time.Parse(LOG_FILE_TIME_FORMAT, match[1])
+		if err == nil {
+			return t
+		}
+	}
+	return aws.TimeValue(object.LastModified)
+}
+
+// listLogFiles returns the objects under prefix whose time is within window.
+func listLogFiles(s3Client s3iface.S3API, bucket, prefix string, window timeWindow) ([]objectRef, error) {
+	var objects []objectRef
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	err := s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if window.contains(logFileTime(object)) {
+				objects = append(objects, objectRef{
+					Bucket: bucket,
+					Key:    aws.StringValue(object.Key),
+					ETag:   aws.StringValue(object.ETag),
+				})
+			}
+		}
+		return true
+	})
+	return objects, err
+}
+
+// runReplay implements the replay command, which runs log files from S3 or the local
+// filesystem through the same filters and sinks as the Lambda handlers. It is used to
+// backfill records after an outage and to export records for investigations.
+func runReplay(args []string) (err error) {
+	// Keep stdout for records written by dry runs
+	log.SetOutput(os.Stderr)
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	bucket := flags.String("bucket", "", "S3 bucket to replay log files from")
+	prefix := flags.String("prefix", "", "Only replay objects with this key prefix")
+	region := flags.String("region", os.Getenv("AWS_REGION"), "Region of the S3 bucket")
+	since := flags.String("since", "", "Only replay log files delivered at or after this time (RFC3339 or YYYY-MM-DD)")
+	until := flags.String("until", "", "Only replay log files delivered before this time (RFC3339 or YYYY-MM-DD)")
+	file := flags.String("file", "", "Replay a local log file instead of objects from S3")
+	dryRun := flags.Bool("dry-run", false, "Write records to stdout instead of the configured sinks")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if (*bucket == "") == (*file == "") {
+		return fmt.Errorf("exactly one of --bucket or --file must be set")
+	}
+	if *bucket != "" && *region == "" {
+		return fmt.Errorf("--region or AWS_REGION must be set when replaying from a bucket")
+	}
+	var window timeWindow
+	window.since, err = parseReplayTime(*since)
+	if err != nil {
+		return fmt.Errorf("invalid --since: %s", err)
+	}
+	window.until, err = parseReplayTime(*until)
+	if err != nil {
+		return fmt.Errorf("invalid --until: %s", err)
+	}
+
+	globalConfig.dryRun = *dryRun
+	err = globalConfig.init()
+	if err != nil {
+		return err
+	}
+
+	streamer, err := NewStreamer()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := streamer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	if *file != "" {
+		log.Infof("Replaying %s", *file)
+		return streamer.StreamFile(*file)
+	}
+
+	objects, err := listLogFiles(s3Clients.get(*region), *bucket, *prefix, window)
+	if err != nil {
+		return err
+	}
+	log.Infof("Replaying %d log files from %s/%s", len(objects), *bucket, *prefix)
+
+	// Keep going after a failed log file, so a single bad object doesn't stop a backfill
+	errs := forEachConcurrently(len(objects), streamer.concurrency, func(i int) error {
+		log.Infof("Replaying %s", objects[i].Key)
+		return streamer.Stream(*region, *bucket, objects[i].Key, objects[i].ETag)
+	})
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d log files failed to replay", failed, len(objects))
+	}
+
+	return nil
+}
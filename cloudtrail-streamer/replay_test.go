@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+
+	pages    [][]*s3.Object
+	objects  map[string][]byte             // Object contents by key, for GetObject
+	metadata map[string]map[string]*string // Object metadata by key, for GetObject
+}
+
+func (fs *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := fs.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key %s", aws.StringValue(input.Key))
+	}
+	return &s3.GetObjectOutput{
+		Body:     BufferCloser{bytes.NewBuffer(data)},
+		ETag:     aws.String(fmt.Sprintf(`"%x"`, md5.Sum(data))),
+		Metadata: fs.metadata[aws.StringValue(input.Key)],
+	}, nil
+}
+
+func (fs *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	if fs.pages == nil {
+		// List the objects under the prefix in a single page
+		var page []*s3.Object
+		for key := range fs.objects {
+			if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+				page = append(page, &s3.Object{Key: aws.String(key)})
+			}
+		}
+		fn(&s3.ListObjectsV2Output{Contents: page}, true)
+		return nil
+	}
+	for i, page := range fs.pages {
+		if !fn(&s3.ListObjectsV2Output{Contents: page}, i == len(fs.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListLogFiles(t *testing.T) {
+	modified := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	fs := &fakeS3{pages: [][]*s3.Object{
+		{
+			{Key: aws.String("AWSLogs/1/CloudTrail/us-east-1/2026/10/14/1_CloudTrail_us-east-1_20261014T2355Z_a.json.gz"), ETag: aws.String(`"a"`), LastModified: &modified},
+			{Key: aws.String("AWSLogs/1/CloudTrail/us-east-1/2026/10/15/1_CloudTrail_us-east-1_20261015T0005Z_b.json.gz"), ETag: aws.String(`"b"`), LastModified: &modified},
+		},
+		{
+			{Key: aws.String("AWSLogs/1/CloudTrail/us-east-1/2026/10/16/1_CloudTrail_us-east-1_20261016T0000Z_c.json.gz"), ETag: aws.String(`"c"`), LastModified: &modified},
+			{Key: aws.String("exports/records.ndjson.gz"), ETag: aws.String(`"d"`), LastModified: &modified},
+		},
+	}}
+
+	since, err := parseReplayTime("2026-10-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	until, err := parseReplayTime("2026-10-16T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := listLogFiles(fs, "bucket", "", timeWindow{since: since, until: until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, []objectRef{{Bucket: "bucket", Key: "AWSLogs/1/CloudTrail/us-east-1/2026/10/15/1_CloudTrail_us-east-1_20261015T0005Z_b.json.gz", ETag: `"b"`}}) {
+		t.Fatalf("Unexpected objects %v", objects)
+	}
+
+	// Objects without a time in their name are selected by when they were last modified
+	objects, err = listLogFiles(fs, "bucket", "", timeWindow{since: modified})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, []objectRef{{Bucket: "bucket", Key: "exports/records.ndjson.gz", ETag: `"d"`}}) {
+		t.Fatalf("Unexpected objects %v", objects)
+	}
+}
+
+func TestParseReplayTime(t *testing.T) {
+	_, err := parseReplayTime("yesterday")
+	if err == nil {
+		t.Fatal("Expected error parsing invalid time")
+	}
+	tm, err := parseReplayTime("")
+	if err != nil || !tm.IsZero() {
+		t.Fatal("Expected empty time to leave the window open")
+	}
+}
+
+func TestStreamFileDryRun(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := &Streamer{sinks: fixedSinks([]*streamerSink{{"stdout", NewStdoutStreamer(buf)}})}
+
+	err := s.StreamFile("testdata/example.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !reflect.DeepEqual(lines, []string{`{"event":1}`, `{"event":2}`, `{"event":3}`}) {
+		t.Fatalf("Unexpected output %v", lines)
+	}
+
+	err = s.StreamFile("testdata/missing.json.gz")
+	if err == nil {
+		t.Fatal("Expected error streaming a missing file")
+	}
+}
+
+func TestRunReplayFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"--bucket", "b", "--file", "f"},
+		{"--file", "f", "--since", "yesterday"},
+	} {
+		if runReplay(args) == nil {
+			t.Errorf("Expected error running replay with %v", args)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mozilla-services/yaml"
+)
+
+const (
+	ROUTE_STREAM = "stream"
+	ROUTE_SKIP   = "skip"
+
+	ROUTE_INSIGHTS = "insights"
+)
+
+// RouteConfig holds the rules deciding where the records of an object are streamed,
+// based on its key. Rules are tried in order and the first matching rule wins.
+// Objects that match no rule are streamed to the default destinations.
+type RouteConfig struct {
+	Routes []*Route `yaml:"routes"`
+}
+
+// Route matches object keys with a glob or, when surrounded by slashes, a regex.
+// Records of matching objects are streamed to the destinations of the route, or to the
+// default destinations if it has none, unless the action is skip. Objects are read in
+// the format of the route, or in the format set with CT_LOG_FORMAT if it has none.
+type Route struct {
+	Name   string `yaml:"name"`
+	Key    string `yaml:"key"`
+	Action string `yaml:"action"`
+	Format string `yaml:"format"`
+
+	Topic           string `yaml:"topic"`
+	StackdriverName string `yaml:"stackdriverName"`
+	KinesisStream   string `yaml:"kinesisStream"`
+
+	pattern *regexp.Regexp
+}
+
+// defaultRoutes skips the objects CloudTrail and Config write alongside log files,
+// and sends CloudTrail Insights events, which have their own schema, to their own
+// destinations, or to the default destinations if none are set for them.
+// Other AWS logs delivered to their default prefixes are read in their own format.
+func defaultRoutes() []*Route {
+	return []*Route{
+		{Name: "digest", Key: "*/CloudTrail-Digest/*", Action: ROUTE_SKIP},
+		{Name: "config-writability-check", Key: "*ConfigWritabilityCheckFile", Action: ROUTE_SKIP},
+		{
+			Name:            ROUTE_INSIGHTS,
+			Key:             "*/CloudTrail-Insight/*",
+			Action:          ROUTE_STREAM,
+			Topic:           os.Getenv("CT_INSIGHTS_TOPIC_ID"),
+			StackdriverName: os.Getenv("CT_INSIGHTS_STACKDRIVER_NAME"),
+			KinesisStream:   os.Getenv("CT_INSIGHTS_KINESIS_STREAM"),
+		},
+		{Name: LOG_FORMAT_VPC_FLOW, Key: "*/vpcflowlogs/*", Action: ROUTE_STREAM, Format: LOG_FORMAT_VPC_FLOW},
+		{Name: LOG_FORMAT_ALB, Key: "*/elasticloadbalancing/*_app.*", Action: ROUTE_STREAM, Format: LOG_FORMAT_ALB},
+		{Name: LOG_FORMAT_GUARDDUTY, Key: "*/GuardDuty/*", Action: ROUTE_STREAM, Format: LOG_FORMAT_GUARDDUTY},
+	}
+}
+
+// loadRouteConfig reads routes from CT_ROUTES_FILE and CT_ROUTES, which are tried
+// before the default routes.
+func loadRouteConfig() (*RouteConfig, error) {
+	rc := &RouteConfig{}
+
+	if path := os.Getenv("CT_ROUTES_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = rc.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_ROUTES_FILE %s: %s", path, err)
+		}
+	}
+
+	if routes := os.Getenv("CT_ROUTES"); routes != "" {
+		err := rc.parse([]byte(routes))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CT_ROUTES: %s", err)
+		}
+	}
+
+	rc.Routes = append(rc.Routes, defaultRoutes()...)
+
+	err := rc.compile()
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *RouteConfig) parse(data []byte) error {
+	var parsed RouteConfig
+	err := yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		return err
+	}
+	rc.Routes = append(rc.Routes, parsed.Routes...)
+	return nil
+}
+
+func (rc *RouteConfig) compile() error {
+	var routes []*Route
+	seen := make(map[string]bool)
+	for i, r := range rc.Routes {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route-%d", i)
+		}
+		// A configured route overrides the default route with the same name
+		if seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+
+		if r.Key == "" {
+			return fmt.Errorf("Route %s has no key pattern", r.Name)
+		}
+		if r.Action == "" {
+			r.Action = ROUTE_STREAM
+		}
+		if r.Action != ROUTE_STREAM && r.Action != ROUTE_SKIP {
+			return fmt.Errorf("Route %s has an invalid action, %s, must be one of '%s' or '%s'", r.Name, r.Action, ROUTE_STREAM, ROUTE_SKIP)
+		}
+		if _, ok := formatRegistry[r.Format]; r.Format != "" && !ok {
+			return fmt.Errorf("Route %s has an invalid format, %s, must be one of '%s'", r.Name, r.Format, strings.Join(formatNames(), "', '"))
+		}
+		pattern, err := compilePattern(r.Key)
+		if err != nil {
+			return fmt.Errorf("Route %s has an invalid key pattern %s: %s", r.Name, r.Key, err)
+		}
+		r.pattern = pattern
+		routes = append(routes, r)
+	}
+	rc.Routes = routes
+	return nil
+}
+
+// formatFor returns the format of the objects with the key, or an empty string if
+// they are read in the configured format.
+func (s *Streamer) formatFor(key string) string {
+	if route := s.routes.Match(key); route != nil {
+		return route.Format
+	}
+	return ""
+}
+
+// Match returns the first route matching the key, or nil if none match.
+func (rc *RouteConfig) Match(key string) *Route {
+	if rc == nil {
+		return nil
+	}
+	for _, r := range rc.Routes {
+		if r.pattern.MatchString(key) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Route) hasDestination() bool {
+	return r.Topic != "" || r.StackdriverName != "" || r.KinesisStream != ""
+}
+
+// config returns a copy of c with the destinations of the route, for creating its sinks.
+// The HTTP sinks only receive records streamed to the default destinations.
+func (r *Route) config(c *Config) *Config {
+	rc := *c
+	rc.gcpTopicId = r.Topic
+	rc.gcpStackdriverName = r.StackdriverName
+	rc.awsKinesisStream = r.KinesisStream
+	rc.httpConfig = nil
+	rc.splunkConfig = nil
+	return &rc
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestDefaultRoutes(t *testing.T) {
+	rc, err := loadRouteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{
+		"AWSLogs/111122223333/CloudTrail-Digest/us-east-1/2026/10/16/111122223333_CloudTrail-Digest_us-east-1_trail_us-east-1_20261016T230000Z.json.gz": ROUTE_SKIP,
+		"AWSLogs/111122223333/CloudTrail/ConfigWritabilityCheckFile":                                                                                    ROUTE_SKIP,
+		"AWSLogs/111122223333/CloudTrail-Insight/us-east-1/2026/10/16/111122223333_CloudTrail-Insight_us-east-1_20261016T2305Z_abc.json.gz":             ROUTE_STREAM,
+	} {
+		route := rc.Match(key)
+		if route == nil || route.Action != expected {
+			t.Errorf("Expected %s to be routed with action %s, got %+v", key, expected, route)
+		}
+	}
+
+	if route := rc.Match(testLogKey); route != nil {
+		t.Errorf("Expected log files to match no route, got %+v", route)
+	}
+	// Without CT_INSIGHTS_* destinations, Insights events go to the default destinations
+	if route := rc.Match("AWSLogs/1/CloudTrail-Insight/x.json.gz"); route == nil || route.hasDestination() {
+		t.Errorf("Expected Insights events to be streamed to the default destinations, got %+v", route)
+	}
+}
+
+func TestConfiguredRoutes(t *testing.T) {
+	os.Setenv("CT_ROUTES", `
+routes:
+  - name: exports
+    key: /^exports/.*\.ndjson(\.gz)?$/
+    topic: exports
+  - name: insights
+    key: "*/CloudTrail-Insight/*"
+    topic: insights
+  - key: "*.tmp"
+    action: skip
+`)
+	defer os.Unsetenv("CT_ROUTES")
+
+	rc, err := loadRouteConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 configured routes and the default routes, less the overridden insights route
+	if len(rc.Routes) != 3+len(defaultRoutes())-1 {
+		t.Fatalf("Expected the insights default route to be overridden, got %d routes", len(rc.Routes))
+	}
+	if route := rc.Match("exports/records.ndjson.gz"); route == nil || route.Topic != "exports" {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+	if route := rc.Match("AWSLogs/1/CloudTrail-Insight/x.json.gz"); route == nil || route.Action != ROUTE_STREAM || route.Topic != "insights" {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+	if route := rc.Match("upload.tmp"); route == nil || route.Action != ROUTE_SKIP {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+
+	os.Setenv("CT_ROUTES", `{"routes": [{"key": "*", "action": "drop"}]}`)
+	_, err = loadRouteConfig()
+	if err == nil {
+		t.Fatal("Expected error loading a route with an invalid action")
+	}
+}
+
+func TestStreamRoutes(t *testing.T) {
+	insightsKey := "AWSLogs/111122223333/CloudTrail-Insight/us-east-1/2026/10/16/111122223333_CloudTrail-Insight_us-east-1_20261016T2305Z_abc.json.gz"
+	fs := &fakeS3{objects: map[string][]byte{
+		testLogKey:  []byte(`{"Records":[{"eventID":"1"}]}`),
+		insightsKey: []byte(`{"Records":[{"eventID":"2","eventCategory":"Insight"}]}`),
+	}}
+	rc := &RouteConfig{Routes: []*Route{
+		{Name: ROUTE_INSIGHTS, Key: "*/CloudTrail-Insight/*", Topic: "insights"},
+		{Name: "digest", Key: "*/CloudTrail-Digest/*", Action: ROUTE_SKIP},
+	}}
+	err := rc.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultSink, insights := &fakeSink{}, &fakeSink{}
+	s := &Streamer{
+		sinks:       fixedSinks([]*streamerSink{{"fake", defaultSink}}),
+		routes:      rc,
+		routeSinks:  map[string]sinkFactory{ROUTE_INSIGHTS: fixedSinks([]*streamerSink{{"insights/fake", insights}})},
+		s3ClientFor: func(awsRegion string) s3iface.S3API { return fs },
+	}
+
+	for _, key := range []string{testLogKey, insightsKey, testDigestKey} {
+		// The digest file is not in the bucket, so streaming it would fail
+		err = s.Stream("us-east-1", "bucket", key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(defaultSink.sent) != 1 || string(defaultSink.sent[0]) != `{"eventID":"1"}` {
+		t.Fatalf("Unexpected records sent to the default sinks %q", defaultSink.sent)
+	}
+	if len(insights.sent) != 1 || string(insights.sent[0]) != `{"eventCategory":"Insight","eventID":"2"}` {
+		t.Fatalf("Unexpected records sent to the insights sinks %q", insights.sent)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sink is a destination that CloudTrail records are streamed to.
+//
+// Sinks may buffer records, so an error caused by an earlier record can be
+// returned from a later call to Send or from Flush.
+type Sink interface {
+	// Send queues a single record for delivery. The decoded record is passed
+	// along with its JSON encoding so sinks can derive keys or attributes from it.
+	Send(record map[string]interface{}, encodedRecord []byte) error
+	// Flush blocks until every queued record has been delivered or has failed.
+	Flush() error
+	// Close flushes any queued records and releases the sink's resources.
+	Close() error
+}
+
+// recordRejectedError is returned from Send for a record the sink will never accept,
+// such as one over its size limit, so the record is dead-lettered rather than retried.
+type recordRejectedError struct {
+	reason string
+}
+
+func (e *recordRejectedError) Error() string {
+	return e.reason
+}
+
+type sinkRegistration struct {
+	name    string
+	enabled func(c *Config) bool
+	new     func(c *Config) (Sink, error)
+}
+
+var sinkRegistry []sinkRegistration
+
+// registerSink makes a sink available to the streamer. Sinks register themselves from an
+// init function; enabled reports whether the sink is configured, and new creates it.
+func registerSink(name string, enabled func(c *Config) bool, new func(c *Config) (Sink, error)) {
+	for _, r := range sinkRegistry {
+		if r.name == name {
+			panic(fmt.Sprintf("sink %s registered twice", name))
+		}
+	}
+	sinkRegistry = append(sinkRegistry, sinkRegistration{name: name, enabled: enabled, new: new})
+}
+
+// sinkErrors collects the errors returned by each sink. Only the first error of each sink
+// is kept, along with a count of how many errors the sink returned.
+type sinkErrors struct {
+	names  []string
+	first  map[string]error
+	counts map[string]int
+}
+
+func (se *sinkErrors) add(sink string, err error) {
+	if err == nil {
+		return
+	}
+	if se.first == nil {
+		se.first = make(map[string]error)
+		se.counts = make(map[string]int)
+	}
+	if _, ok := se.first[sink]; !ok {
+		se.names = append(se.names, sink)
+		se.first[sink] = err
+	}
+	se.counts[sink]++
+}
+
+// err returns the collected errors as a single error, or nil if no sink failed.
+func (se *sinkErrors) err() error {
+	if len(se.names) == 0 {
+		return nil
+	}
+	return se
+}
+
+func (se *sinkErrors) Error() string {
+	var msgs []string
+	for _, name := range se.names {
+		msgs = append(msgs, fmt.Sprintf("%s sink failed %d time(s), first error: %s", name, se.counts[name], se.first[name]))
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type fakeSink struct {
+	sendErr  error
+	flushErr error
+
+	sent    [][]byte
+	flushed int
+	closed  bool
+}
+
+func (fs *fakeSink) Send(record map[string]interface{}, encodedRecord []byte) error {
+	fs.sent = append(fs.sent, encodedRecord)
+	return fs.sendErr
+}
+
+func (fs *fakeSink) Flush() error {
+	fs.flushed++
+	return fs.flushErr
+}
+
+func (fs *fakeSink) Close() error {
+	fs.closed = true
+	return nil
+}
+
+// fixedSinks returns a sinkFactory opening the same sinks for every object, so tests can
+// check what was sent to them.
+func fixedSinks(sinks []*streamerSink) sinkFactory {
+	return func() ([]*streamerSink, error) {
+		return sinks, nil
+	}
+}
+
+func openSinks(t *testing.T, open sinkFactory) []*streamerSink {
+	sinks, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sinks
+}
+
+func TestStreamToServicesAggregatesErrors(t *testing.T) {
+	good := &fakeSink{}
+	bad := &fakeSink{sendErr: errors.New("send failed"), flushErr: errors.New("flush failed")}
+	s := &Streamer{sinks: fixedSinks([]*streamerSink{{"bad", bad}, {"good", good}})}
+
+	records := &sliceRecordReader{records: []map[string]interface{}{{"foo": "bar"}, {"foo": "baz"}}}
+	err := s.streamToServices(openSinks(t, s.sinks), records, recordSource{})
+	if err == nil {
+		t.Fatal("Expected an error from the failing sink")
+	}
+	if !strings.Contains(err.Error(), "bad sink failed 3 time(s), first error: send failed") {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+	if strings.Contains(err.Error(), "good") {
+		t.Fatalf("Error should only mention failing sinks: %s", err)
+	}
+
+	// The failing sink must not stop records from reaching the others
+	if len(good.sent) != 2 || good.flushed != 1 {
+		t.Fatalf("Expected 2 records sent and 1 flush to the good sink, got %d and %d", len(good.sent), good.flushed)
+	}
+
+	// The sinks of an object are closed once it has been streamed
+	err = s.StreamFile("testdata/example.json.gz")
+	if err == nil {
+		t.Fatal("Expected an error from the failing sink")
+	}
+	if !good.closed || !bad.closed {
+		t.Fatal("Expected all sinks to be closed")
+	}
+}
+
+func TestNewStreamerUsesRegistry(t *testing.T) {
+	saved := sinkRegistry
+	defer func() { sinkRegistry = saved }()
+
+	enabled := &fakeSink{}
+	sinkRegistry = nil
+	registerSink("enabled", func(c *Config) bool { return true }, func(c *Config) (Sink, error) { return enabled, nil })
+	registerSink("disabled", func(c *Config) bool { return false }, func(c *Config) (Sink, error) { return &fakeSink{}, nil })
+
+	s, err := NewStreamer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled.closed {
+		t.Fatal("Expected the sinks opened to check them to be closed")
+	}
+	sinks := openSinks(t, s.sinks)
+	if len(sinks) != 1 || sinks[0].sink != enabled {
+		t.Fatal("Expected only the enabled sink to be created")
+	}
+	enabled.closed = false
+
+	registerSink("broken", func(c *Config) bool { return true }, func(c *Config) (Sink, error) { return nil, errors.New("no client") })
+	_, err = NewStreamer()
+	if err == nil {
+		t.Fatal("Expected error creating broken sink")
+	}
+	if !enabled.closed {
+		t.Fatal("Expected sinks created before the error to be closed")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	SPLUNK_HEC_EVENT_PATH = "/services/collector/event"
+
+	DEFAULT_SPLUNK_SOURCETYPE = "aws:cloudtrail"
+)
+
+func init() {
+	registerSink(
+		"splunk",
+		func(c *Config) bool { return c.splunkConfig != nil },
+		func(c *Config) (Sink, error) { return NewSplunkStreamer(c.splunkConfig), nil },
+	)
+}
+
+// splunkConfig holds the settings of the Splunk HTTP Event Collector sink. Events are
+// posted with the HTTP sink, so they are batched and retried the same way.
+type splunkConfig struct {
+	*httpSinkConfig
+
+	index      string // Index events are written to, the token's default index if empty
+	source     string
+	sourcetype string
+}
+
+// loadSplunkConfig returns the configuration of the Splunk sink, or nil if
+// CT_SPLUNK_URL is not set.
+func loadSplunkConfig() (*splunkConfig, error) {
+	hc, err := loadHTTPSinkConfig("CT_SPLUNK")
+	if err != nil || hc == nil {
+		return nil, err
+	}
+
+	token := os.Getenv("CT_SPLUNK_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("CT_SPLUNK_TOKEN must be set when CT_SPLUNK_URL is set")
+	}
+	hc.header.Set("Authorization", "Splunk "+token)
+	hc.header.Set("Content-Type", "application/json")
+
+	// The collector endpoint is used if the URL is only the address of the HEC
+	u, _ := url.Parse(hc.url)
+	if u.Path == "" || u.Path == "/" {
+		u.Path = SPLUNK_HEC_EVENT_PATH
+		hc.url = u.String()
+	}
+
+	sc := &splunkConfig{
+		httpSinkConfig: hc,
+		index:          os.Getenv("CT_SPLUNK_INDEX"),
+		source:         os.Getenv("CT_SPLUNK_SOURCE"),
+		sourcetype:     os.Getenv("CT_SPLUNK_SOURCETYPE"),
+	}
+	if sc.sourcetype == "" {
+		sc.sourcetype = DEFAULT_SPLUNK_SOURCETYPE
+	}
+	return sc, nil
+}
+
+// splunkEvent is the envelope of an event sent to the HTTP Event Collector.
+type splunkEvent struct {
+	Time       *float64        `json:"time,omitempty"`
+	Index      string          `json:"index,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	Sourcetype string          `json:"sourcetype,omitempty"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// NewSplunkStreamer returns an HTTP streamer that wraps each record in a HEC event.
+func NewSplunkStreamer(sc *splunkConfig) *HTTPStreamer {
+	hs := NewHTTPStreamer(sc.httpSinkConfig, func(record map[string]interface{}, encodedRecord []byte) ([]byte, error) {
+		return json.Marshal(sc.event(record, encodedRecord))
+	})
+	// Leave room for the envelope, timestamp included, so records still fit once wrapped
+	envelope, _ := json.Marshal(sc.event(nil, nil))
+	hs.maxRecordBytes -= len(envelope) + len(`"time":0000000000.000,`)
+	return hs
+}
+
+// event returns the HEC event for a record, timestamped with the time of the event
+// rather than the time it was received.
+func (sc *splunkConfig) event(record map[string]interface{}, encodedRecord []byte) *splunkEvent {
+	event := &splunkEvent{
+		Index:      sc.index,
+		Source:     sc.source,
+		Sourcetype: sc.sourcetype,
+		Event:      json.RawMessage(encodedRecord),
+	}
+	if eventTime, ok := record["eventTime"].(string); ok {
+		t, err := time.Parse(time.RFC3339, eventTime)
+		if err == nil {
+			seconds := float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+			event.Time = &seconds
+		}
+	}
+	return event
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSplunkStreamer(t *testing.T) {
+	server := newFakeHTTPServer()
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"CT_SPLUNK_URL":   server.URL,
+		"CT_SPLUNK_TOKEN": "00000000-0000-0000-0000-000000000000",
+		"CT_SPLUNK_INDEX": "cloudtrail",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	sc, err := loadSplunkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.url != server.URL+SPLUNK_HEC_EVENT_PATH {
+		t.Fatalf("Expected the collector endpoint to be used, got %s", sc.url)
+	}
+
+	ss := NewSplunkStreamer(sc)
+	if ss.MaxRecordBytes() >= DEFAULT_HTTP_BATCH_BYTES-1 {
+		t.Fatal("Expected room to be left for the event envelope")
+	}
+	records := []string{
+		`{"eventID":"1","eventTime":"2020-01-02T03:04:05Z"}`,
+		`{"eventID":"2","eventTime":"not a time"}`,
+	}
+	for _, r := range records {
+		var record map[string]interface{}
+		json.Unmarshal([]byte(r), &record)
+		err = ss.Send(record, []byte(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ss.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.bodies) != 1 {
+		t.Fatalf("Expected a single request, got %d", len(server.bodies))
+	}
+	if auth := server.headers[0].Get("Authorization"); auth != "Splunk 00000000-0000-0000-0000-000000000000" {
+		t.Fatalf("Unexpected Authorization header %s", auth)
+	}
+	expected := `{"time":1577934245,"index":"cloudtrail","sourcetype":"aws:cloudtrail","event":{"eventID":"1","eventTime":"2020-01-02T03:04:05Z"}}
+{"index":"cloudtrail","sourcetype":"aws:cloudtrail","event":{"eventID":"2","eventTime":"not a time"}}
+`
+	if server.bodies[0] != expected {
+		t.Fatalf("Expected body %s, got %s", expected, server.bodies[0])
+	}
+}
+
+func TestLoadSplunkConfigRequiresToken(t *testing.T) {
+	os.Setenv("CT_SPLUNK_URL", "https://splunk.example.com:8088/services/collector")
+	defer os.Unsetenv("CT_SPLUNK_URL")
+
+	_, err := loadSplunkConfig()
+	if err == nil || !strings.Contains(err.Error(), "CT_SPLUNK_TOKEN") {
+		t.Fatalf("Expected an error without CT_SPLUNK_TOKEN, got %v", err)
+	}
+
+	os.Setenv("CT_SPLUNK_TOKEN", "token")
+	defer os.Unsetenv("CT_SPLUNK_TOKEN")
+	sc, err := loadSplunkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.url != "https://splunk.example.com:8088/services/collector" || sc.sourcetype != DEFAULT_SPLUNK_SOURCETYPE {
+		t.Fatalf("Unexpected config %s %s", sc.url, sc.sourcetype)
+	}
+}
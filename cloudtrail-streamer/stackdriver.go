@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	stackdriver "cloud.google.com/go/logging"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	registerSink(
+		"stackdriver",
+		func(c *Config) bool { return c.gcpStackdriverName != "" },
+		func(c *Config) (Sink, error) {
+			return NewStackdriverStreamer(c.stackdriverClient, c.gcpStackdriverName), nil
+		},
+	)
+}
+
+// newStackdriverClient returns the logging client shared by the sinks of every object.
+// The client reports the errors of all of its loggers together, so the error of each
+// write is also recorded with the stackdriverErrors of the logger that made it.
+func newStackdriverClient(projectId string, credentials []byte) (*stackdriver.Client, error) {
+	return stackdriver.NewClient(context.Background(), projectId,
+		option.WithCredentialsJSON(credentials),
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(recordStackdriverErrors)),
+	)
+}
+
+// stackdriverErrorsKey is the context key of the stackdriverErrors of the logger making a
+// write.
+type stackdriverErrorsKey struct{}
+
+// stackdriverErrors holds the errors of the writes of a logger since it was last flushed.
+type stackdriverErrors struct {
+	mu   sync.Mutex
+	n    int
+	last error
+}
+
+func (e *stackdriverErrors) add(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.n++
+	e.last = err
+}
+
+// take returns an error summarizing the errors held, if any, and clears them.
+func (e *stackdriverErrors) take() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.last == nil {
+		return nil
+	}
+	err := fmt.Errorf("saw %d errors; last: %s", e.n, e.last)
+	e.n, e.last = 0, nil
+	return err
+}
+
+// recordStackdriverErrors records the error of a call with the stackdriverErrors of the
+// logger that made it.
+func recordStackdriverErrors(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if errs, ok := ctx.Value(stackdriverErrorsKey{}).(*stackdriverErrors); err != nil && ok {
+		errs.add(err)
+	}
+	return err
+}
+
+type StackdriverStreamer struct {
+	logger *stackdriver.Logger
+	errors *stackdriverErrors
+}
+
+// NewStackdriverStreamer returns a sink writing to the log logName with client, whose
+// Flush only reports the errors of its own writes.
+func NewStackdriverStreamer(client *stackdriver.Client, logName string) *StackdriverStreamer {
+	errs := &stackdriverErrors{}
+	l := client.Logger(logName, stackdriver.ContextFunc(func() (context.Context, func()) {
+		return context.WithValue(context.Background(), stackdriverErrorsKey{}, errs), nil
+	}))
+	return &StackdriverStreamer{logger: l, errors: errs}
+}
+
+func (s *StackdriverStreamer) Send(record map[string]interface{}, encodedRecord []byte) error {
+	s.logger.Log(stackdriverEntry(record, encodedRecord))
+	return nil
+}
+
+// stackdriverEntry returns the log entry for a record. The entry is timestamped with the
+// time of the event rather than the time it was streamed, and its insert ID is the event
+// ID so Stackdriver drops records that are streamed again.
+func stackdriverEntry(record map[string]interface{}, encodedRecord []byte) stackdriver.Entry {
+	entry := stackdriver.Entry{
+		Payload:  json.RawMessage(encodedRecord),
+		Severity: stackdriverSeverity(record),
+	}
+
+	if eventTime, ok := record["eventTime"].(string); ok {
+		t, err := time.Parse(time.RFC3339, eventTime)
+		if err == nil {
+			entry.Timestamp = t
+		}
+	}
+	if eventID, ok := record["eventID"].(string); ok {
+		entry.InsertID = eventID
+	}
+
+	for label, field := range map[string]string{
+		"account":      "recipientAccountId",
+		"region":       "awsRegion",
+		"event_source": "eventSource",
+	} {
+		if value, ok := record[field].(string); ok && value != "" {
+			if entry.Labels == nil {
+				entry.Labels = make(map[string]string)
+			}
+			entry.Labels[label] = value
+		}
+	}
+
+	return entry
+}
+
+// stackdriverSeverity returns Error for calls that failed, Notice for calls that
+// may have changed resources and Info for read only calls.
+func stackdriverSeverity(record map[string]interface{}) stackdriver.Severity {
+	if errorCode, ok := record["errorCode"].(string); ok && errorCode != "" {
+		return stackdriver.Error
+	}
+	readOnly, ok := lookupField(record, []string{"readOnly"})
+	if !ok {
+		return stackdriver.Default
+	}
+	if readOnly == "true" {
+		return stackdriver.Info
+	}
+	return stackdriver.Notice
+}
+
+func (s *StackdriverStreamer) MaxRecordBytes() int {
+	return STACKDRIVER_MAX_PAYLOAD_BYTES
+}
+
+// Flush sends any buffered entries. The error the logger returns is that of every logger
+// of the client, so only the errors recorded for this one are returned.
+func (s *StackdriverStreamer) Flush() error {
+	s.logger.Flush()
+	return s.errors.take()
+}
+
+func (s *StackdriverStreamer) Close() error {
+	log.Debug("Stackdriver Streamer closed")
+	return nil
+}
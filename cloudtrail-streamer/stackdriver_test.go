@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	stackdriver "cloud.google.com/go/logging"
+	"google.golang.org/grpc"
+)
+
+func TestStackdriverEntry(t *testing.T) {
+	record := map[string]interface{}{
+		"eventID":            "c2b3a1f0-0000-4000-8000-000000000000",
+		"eventTime":          "2026-10-16T23:05:12Z",
+		"eventSource":        "iam.amazonaws.com",
+		"awsRegion":          "us-east-1",
+		"recipientAccountId": "111122223333",
+		"readOnly":           false,
+	}
+	entry := stackdriverEntry(record, []byte("{}"))
+
+	if !entry.Timestamp.Equal(time.Date(2026, 10, 16, 23, 5, 12, 0, time.UTC)) {
+		t.Fatalf("Unexpected timestamp %s", entry.Timestamp)
+	}
+	if entry.InsertID != "c2b3a1f0-0000-4000-8000-000000000000" {
+		t.Fatalf("Unexpected insert ID %s", entry.InsertID)
+	}
+	expected := map[string]string{"account": "111122223333", "region": "us-east-1", "event_source": "iam.amazonaws.com"}
+	if !reflect.DeepEqual(entry.Labels, expected) {
+		t.Fatalf("Unexpected labels %v", entry.Labels)
+	}
+	if entry.Severity != stackdriver.Notice {
+		t.Fatalf("Expected Notice severity for a write, got %s", entry.Severity)
+	}
+
+	// Records without the fields are logged at ingestion time, without labels
+	entry = stackdriverEntry(map[string]interface{}{"eventTime": "yesterday"}, []byte("{}"))
+	if !entry.Timestamp.IsZero() || entry.InsertID != "" || entry.Labels != nil || entry.Severity != stackdriver.Default {
+		t.Fatalf("Unexpected entry %+v", entry)
+	}
+}
+
+func TestStackdriverSeverity(t *testing.T) {
+	for _, tc := range []struct {
+		record   map[string]interface{}
+		severity stackdriver.Severity
+	}{
+		{map[string]interface{}{"readOnly": true}, stackdriver.Info},
+		{map[string]interface{}{"readOnly": false}, stackdriver.Notice},
+		{map[string]interface{}{"readOnly": true, "errorCode": "AccessDenied"}, stackdriver.Error},
+		{map[string]interface{}{}, stackdriver.Default},
+	} {
+		if severity := stackdriverSeverity(tc.record); severity != tc.severity {
+			t.Errorf("Expected severity %s for %v, got %s", tc.severity, tc.record, severity)
+		}
+	}
+}
+
+func TestStackdriverErrors(t *testing.T) {
+	failing := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return errors.New("unavailable")
+	}
+	errs := &stackdriverErrors{}
+	ctx := context.WithValue(context.Background(), stackdriverErrorsKey{}, errs)
+
+	// Only the errors of writes made by the logger are recorded with it
+	recordStackdriverErrors(ctx, "write", nil, nil, nil, failing)
+	recordStackdriverErrors(ctx, "write", nil, nil, nil, failing)
+	recordStackdriverErrors(context.Background(), "write", nil, nil, nil, failing)
+	err := errs.take()
+	if err == nil || err.Error() != "saw 2 errors; last: unavailable" {
+		t.Fatalf("Expected the errors of the logger, got %v", err)
+	}
+	if err := errs.take(); err != nil {
+		t.Fatalf("Expected errors to be cleared once taken, got %s", err)
+	}
+}
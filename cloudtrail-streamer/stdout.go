@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+const STDOUT_BUFFER_BYTES = 64 * 1024
+
+func init() {
+	registerSink(
+		"stdout",
+		func(c *Config) bool { return c.dryRun },
+		func(c *Config) (Sink, error) { return NewStdoutStreamer(os.Stdout), nil },
+	)
+}
+
+// stdoutMu serializes writes of the StdoutStreamers of objects streamed at once, so
+// their records are never interleaved within a line.
+var stdoutMu sync.Mutex
+
+// StdoutStreamer writes records as NDJSON, and is used for dry runs of the replay command.
+type StdoutStreamer struct {
+	w   io.Writer
+	buf bytes.Buffer // Records sent since the last write, as complete lines
+}
+
+func NewStdoutStreamer(w io.Writer) *StdoutStreamer {
+	return &StdoutStreamer{w: w}
+}
+
+func (s *StdoutStreamer) Send(record map[string]interface{}, encodedRecord []byte) error {
+	s.buf.Write(encodedRecord)
+	s.buf.WriteByte('\n')
+	if s.buf.Len() >= STDOUT_BUFFER_BYTES {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *StdoutStreamer) Flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	_, err := s.buf.WriteTo(s.w)
+	return err
+}
+
+func (s *StdoutStreamer) Close() error {
+	return s.Flush()
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -36,9 +37,34 @@ const (
 var debug = debugOff
 
 const (
-	ADMIN_ENDPOINT     = "/admin/v1/logs/administrator"
-	AUTH_ENDPOINT      = "/admin/v2/logs/authentication"
-	TELEPHONY_ENDPOINT = "/admin/v1/logs/telephony"
+	ADMIN_ENDPOINT              = "/admin/v1/logs/administrator"
+	AUTH_ENDPOINT               = "/admin/v2/logs/authentication"
+	TELEPHONY_ENDPOINT          = "/admin/v1/logs/telephony"
+	OFFLINE_ENROLLMENT_ENDPOINT = "/admin/v1/logs/offline_enrollment"
+	TRUST_MONITOR_ENDPOINT      = "/admin/v1/trust_monitor/events"
+	ACTIVITY_ENDPOINT           = "/admin/v2/logs/activity"
+	USERS_ENDPOINT              = "/admin/v1/users"
+	PHONES_ENDPOINT             = "/admin/v1/phones"
+	ADMINS_ENDPOINT             = "/admin/v1/admins"
+
+	V1_LOG_PAGE_SIZE        = 1000 // Maximum number of events returned by a request to a v1 log endpoint
+	AUTH_V2_PAGE_SIZE       = 1000 // Number of events requested per page of auth v2 logs, the maximum allowed
+	ACTIVITY_PAGE_SIZE      = 1000 // Number of events requested per page of activity logs, the maximum allowed
+	TRUST_MONITOR_PAGE_SIZE = 200  // Number of events requested per page of trust monitor events, the maximum allowed
+	USERS_PAGE_SIZE         = 300  // Number of records requested per page of users, the maximum allowed
+	PHONES_PAGE_SIZE        = 500  // Number of records requested per page of phones, the maximum allowed
+	ADMINS_PAGE_SIZE        = 300  // Number of records requested per page of administrators, the maximum allowed
+
+	DEFAULT_REQUEST_INTERVAL  = 5 * time.Second
+	DEFAULT_MAX_PAGES         = 20
+	DEFAULT_MAX_RETRIES       = 5
+	DEFAULT_SNAPSHOT_INTERVAL = 24 * time.Hour
+	DEFAULT_RUN_TIMEOUT       = 45 * time.Second
+
+	RUN_WRITE_TIME = 10 * time.Second // Time left before the deadline of a run to write logs and save state
+
+	RETRY_INITIAL_BACKOFF = time.Second
+	RETRY_MAX_BACKOFF     = 32 * time.Second
 
 	LOGGER_NAME = "duopull"
 
@@ -91,6 +117,14 @@ type config struct {
 	duoIKey    string // Duo API ikey
 	duoSKey    string // Duo API skey
 
+	requestInterval time.Duration // Minimum time between requests to the Duo API
+	maxPages        int           // Maximum pages requested per run from each log source
+	maxRetries      int           // Maximum retries of a failed request to the Duo API
+	runTimeout      time.Duration // Time after which a run starts no more requests
+
+	sources          []*logSource  // Sources logs are requested from, in order
+	snapshotInterval time.Duration // Time between snapshots of users, phones and administrators
+
 	// Allocated during initialization
 	duo               *duoInterface // Duo authorization header generator
 	stackdriverClient *stackdriver.Client
@@ -118,6 +152,49 @@ func (c *config) init() error {
 		log.Fatalf("Could not decrypt duopull skey. Err: %s", err)
 	}
 
+	c.requestInterval = DEFAULT_REQUEST_INTERVAL
+	if v := os.Getenv("DUOPULL_REQUEST_INTERVAL"); v != "" {
+		c.requestInterval, err = time.ParseDuration(v)
+		if err != nil || c.requestInterval < 0 {
+			return fmt.Errorf("DUOPULL_REQUEST_INTERVAL must be a duration, e.g. 5s")
+		}
+	}
+	c.maxPages = DEFAULT_MAX_PAGES
+	if v := os.Getenv("DUOPULL_MAX_PAGES"); v != "" {
+		c.maxPages, err = strconv.Atoi(v)
+		if err != nil || c.maxPages < 1 {
+			return fmt.Errorf("DUOPULL_MAX_PAGES must be a positive integer")
+		}
+	}
+
+	c.maxRetries = DEFAULT_MAX_RETRIES
+	if v := os.Getenv("DUOPULL_MAX_RETRIES"); v != "" {
+		c.maxRetries, err = strconv.Atoi(v)
+		if err != nil || c.maxRetries < 0 {
+			return fmt.Errorf("DUOPULL_MAX_RETRIES must be a non-negative integer")
+		}
+	}
+
+	c.runTimeout = DEFAULT_RUN_TIMEOUT
+	if v := os.Getenv("DUOPULL_RUN_TIMEOUT"); v != "" {
+		c.runTimeout, err = time.ParseDuration(v)
+		if err != nil || c.runTimeout <= 0 {
+			return fmt.Errorf("DUOPULL_RUN_TIMEOUT must be a duration, e.g. 45s")
+		}
+	}
+
+	c.sources, err = parseSources(os.Getenv("DUOPULL_SOURCES"))
+	if err != nil {
+		return err
+	}
+	c.snapshotInterval = DEFAULT_SNAPSHOT_INTERVAL
+	if v := os.Getenv("DUOPULL_SNAPSHOT_INTERVAL"); v != "" {
+		c.snapshotInterval, err = time.ParseDuration(v)
+		if err != nil || c.snapshotInterval <= 0 {
+			return fmt.Errorf("DUOPULL_SNAPSHOT_INTERVAL must be a duration, e.g. 24h")
+		}
+	}
+
 	err = c.validate()
 	if err != nil {
 		return err
@@ -136,9 +213,12 @@ func (c *config) init() error {
 
 	if debug != debugGCP {
 		c.duo = &duoInterface{
-			apiHost: cfg.duoAPIHost,
-			iKey:    cfg.duoIKey,
-			sKey:    cfg.duoSKey,
+			apiHost:    cfg.duoAPIHost,
+			iKey:       cfg.duoIKey,
+			sKey:       cfg.duoSKey,
+			interval:   cfg.requestInterval,
+			maxRetries: cfg.maxRetries,
+			backoff:    RETRY_INITIAL_BACKOFF,
 		}
 	}
 
@@ -166,6 +246,24 @@ type duoInterface struct {
 	apiHost string
 	iKey    string
 	sKey    string
+
+	client *http.Client // Client requests are sent with, http.DefaultClient if nil
+
+	interval time.Duration // Minimum time between requests, to stay within Duo's rate limits
+	last     time.Time     // Time the last request was sent
+
+	maxRetries int           // Maximum retries of a failed request
+	backoff    time.Duration // Initial wait before retrying a failed request, doubled on each retry
+}
+
+// pace waits until interval has passed since the last request was sent
+func (d *duoInterface) pace() {
+	if !d.last.IsZero() {
+		if wait := d.interval - time.Since(d.last); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	d.last = time.Now()
 }
 
 // getAuthHeader returns an authentication header and date string header for use in a request
@@ -205,17 +303,54 @@ type logRecords struct {
 	Response []interface{} `json:"response"`
 }
 
-// authV2Records represents a response for an auth log request from the V2 Duo API.
+// v2Records represents a response for a log request from an endpoint paged by offset,
+// such as the V2 Duo API. The logs are held under a key that differs between endpoints,
+// e.g. authlogs for authentication logs, along with metadata used to request the next
+// page of logs.
 //
 // See also https://duo.com/docs/adminapi#authentication-logs
-type authV2Records struct {
-	Stat     string                `json:"stat"`
-	Response authV2RecordsResponse `json:"response"`
+type v2Records struct {
+	Stat     string                     `json:"stat"`
+	Response map[string]json.RawMessage `json:"response"`
 }
 
-// authV2RecordsResponse functions exactly like logRecords.Response
-type authV2RecordsResponse struct {
-	Authlogs []interface{} `json:"authlogs"`
+// v2RecordsMetadata holds the offset of the next page of logs, or null on the last page.
+// For authentication logs it is a list of a timestamp in milliseconds and a transaction
+// id, other endpoints return the same joined by a comma.
+type v2RecordsMetadata struct {
+	NextOffset json.RawMessage `json:"next_offset"`
+}
+
+// nextOffset returns the offset of the next page as the comma separated value passed
+// to the next_offset parameter, or an empty string if there is no next page
+func (m *v2RecordsMetadata) nextOffset() string {
+	var offset string
+	if err := json.Unmarshal(m.NextOffset, &offset); err == nil {
+		return offset
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(m.NextOffset, &raws); err != nil {
+		return ""
+	}
+	var parts []string
+	for _, raw := range raws {
+		var part string
+		if err := json.Unmarshal(raw, &part); err != nil {
+			// Numeric parts are used as they are
+			part = string(raw)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// offsetTimestamp returns the timestamp in seconds of the log an offset points to
+func offsetTimestamp(offset string) (int, error) {
+	ms, err := strconv.ParseInt(strings.Split(offset, ",")[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %v", offset)
+	}
+	return int(ms / 1000), nil
 }
 
 // emitEvent is an event which will be submitted to Stackdriver
@@ -224,8 +359,9 @@ type authV2RecordsResponse struct {
 // administrator, etc) the path used to request the log is included here so the event types
 // can be differentiated by the stream consumer.
 type emitEvent struct {
-	Path  string      `json:"path"`  // The request path (e.g., /api/v1/logs/telephony)
-	Event interface{} `json:"event"` // The actual event
+	Path     string      `json:"path"`               // The request path (e.g., /api/v1/logs/telephony)
+	Event    interface{} `json:"event"`              // The actual event
+	Snapshot int64       `json:"snapshot,omitempty"` // Time of the snapshot a record is part of, for inventory endpoints
 }
 
 func (e *emitEvent) toInterface() (map[string]interface{}, error) {
@@ -321,22 +457,15 @@ func (e *emitter) emit() error {
 	return nil
 }
 
-// minTime stores state related to the mintime parameter for the Duo API logging
-// endpoints
-type minTime struct {
-	Administrator  int `json:"administrator"`  // mintime for administrator logs
-	Authentication int `json:"authentication"` // mintime for authentication logs
-	Telephony      int `json:"telephony"`      // mintime for telephony logs
-}
-
 // load pulls mintime state information from datastore
 func (m *minTime) load(ctx context.Context) error {
 	if debug == debugDuo {
 		// Duo debug, just set an offset timestamp from current time for testing
 		// purposes instead of loading it
-		m.Administrator = int(time.Now().Add(-1 * (time.Minute * 60)).Unix())
-		m.Authentication = m.Administrator
-		m.Telephony = m.Administrator
+		mintime := int(time.Now().Add(-1 * (time.Minute * 60)).Unix())
+		for _, s := range cfg.sources {
+			(*m)[s.stateKey] = sourceState{Mintime: mintime}
+		}
 		return nil
 	}
 	var sf common.StateField
@@ -464,61 +593,168 @@ func toMozLog(in interface{}) (interface{}, error) {
 	return ret, err
 }
 
-// sendLogRequest is a small helper function for sending requests to Duo's API and
-// returning the response body.
-func sendLogRequest(req *http.Request) ([]byte, error) {
-	client := &http.Client{}
+// sendLogRequest is a small helper function for sending a signed GET request with the
+// given parameters to Duo's API and returning the response body.
+//
+// Requests that fail with a network error, or with a 429 or 5xx status, are retried up to
+// maxRetries times with exponential backoff and jitter. A 429 means a rate limit was hit,
+// so the wait is at least as long as any Retry-After header returned asks for. Retries
+// that would wait past the deadline of ctx are not made.
+func sendLogRequest(ctx context.Context, d *duoInterface, path string, params map[string]string) ([]byte, error) {
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		b, retry, err := sendLogRequestOnce(d, path, params)
+		if err == nil {
+			return b, nil
+		}
+		if retry < 0 || attempt >= d.maxRetries {
+			return nil, err
+		}
+
+		// Wait between half and all of the backoff, so retries from concurrent
+		// runs don't line up
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if retry > wait {
+			wait = retry
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		log.Warnf("request to %v failed, retrying in %v: %s", path, wait, err)
+		time.Sleep(wait)
+
+		backoff *= 2
+		if backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+// sendLogRequestOnce sends a single request to Duo's API. If the request failed, the
+// minimum wait before retrying it is returned along with the error, or a negative
+// duration if it should not be retried.
+func sendLogRequestOnce(d *duoInterface, path string, params map[string]string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequest("GET", "https://"+d.apiHost+path, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	q := req.URL.Query()
+	for k, v := range params {
+		q.Add(k, v)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	authhdr, datehdr := d.getAuthHeader("GET", path, params)
+	req.Header.Set("Authorization", authhdr)
+	req.Header.Set("Date", datehdr)
+
+	client := d.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	d.pace()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("API returned code %v with body %s", resp.StatusCode, b)
+		err = fmt.Errorf("API returned code %v with body %s", resp.StatusCode, b)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			var retry time.Duration
+			if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && secs > 0 {
+				retry = time.Duration(secs) * time.Second
+			}
+			return nil, retry, err
+		}
+		return nil, -1, err
 	}
-	return b, nil
+	return b, 0, nil
 }
 
-// logRequest makes a request for logs from the Duo API from mintime onwards, using the
-// specified API endpoint path for the request
-func logRequest(d *duoInterface, mintime int, path string) ([]emitEvent, error) {
-	mintimes := strconv.Itoa(mintime)
-
-	if debug == debugGCP {
-		// GCP debug, make an ad-hoc GET request to test outbound
-		// connectivity and then just return a test event
-		log.Info("making ad-hoc request")
-		resp, err := http.Get("https://www.mozilla.org")
+// logRequest makes requests for logs from the Duo API from mintime onwards, using the
+// specified v1 API endpoint path for the requests
+//
+// The v1 endpoints return at most V1_LOG_PAGE_SIZE events per request, oldest first, so
+// requests are repeated from the latest timestamp returned until a page is not full. As
+// events with that timestamp may be split across pages, the next page starts at that
+// timestamp rather than after it, and the events already returned are skipped.
+//
+// At most maxPages pages are requested, or every page if maxPages is 0, and no more are
+// requested once ctx is done. Whether events remain to be requested from the latest
+// timestamp returned is returned along with them.
+func logRequest(ctx context.Context, d *duoInterface, mintime int, maxPages int, path string) ([]emitEvent, bool, error) {
+	var (
+		ret  = make([]emitEvent, 0)
+		seen = make(map[string]bool) // Events returned with the timestamp the next page starts at
+	)
+	for pages := 1; ; pages++ {
+		page, err := logPageRequest(ctx, d, mintime, path)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		log.Infof("ad-hoc request returned status code %v\n", resp.StatusCode)
-		resp.Body.Close()
-		return []emitEvent{
-			{"/gcp/test", map[string]interface{}{
-				"gcp":       "test",
-				"timestamp": time.Now().Unix(),
-			}},
-		}, nil
-	}
 
-	req, err := http.NewRequest("GET", "https://"+d.apiHost+path, nil)
-	if err != nil {
-		return nil, err
+		next := mintime
+		var added int
+		keys := make([]string, len(page))
+		stamps := make([]int, len(page))
+		for i, v := range page {
+			e := emitEvent{Path: path, Event: v}
+			stamps[i], err = e.getTimestamp()
+			if err != nil {
+				return nil, false, err
+			}
+			buf, err := json.Marshal(v)
+			if err != nil {
+				return nil, false, err
+			}
+			keys[i] = string(buf)
+			if stamps[i] == mintime && seen[keys[i]] {
+				continue
+			}
+			ret = append(ret, e)
+			added++
+			if stamps[i] > next {
+				next = stamps[i]
+			}
+		}
+
+		if len(page) < V1_LOG_PAGE_SIZE {
+			break
+		}
+		if added == 0 {
+			// A full page of events all with the same timestamp, any more with that
+			// timestamp can't be requested
+			log.Warnf("%v returned more than %v events with timestamp %v, some were skipped", path, V1_LOG_PAGE_SIZE, mintime)
+			break
+		}
+
+		if next != mintime {
+			seen = make(map[string]bool)
+		}
+		for i := range page {
+			if stamps[i] == next {
+				seen[keys[i]] = true
+			}
+		}
+		mintime = next
+		if (maxPages > 0 && pages == maxPages) || ctx.Err() != nil {
+			log.Infof("requested %v pages of %v, resuming from %v next run\n", pages, path, mintime)
+			return ret, true, nil
+		}
+		log.Infof("requesting next page of %v from %v\n", path, mintime)
 	}
-	q := req.URL.Query()
-	q.Add("mintime", mintimes)
-	req.URL.RawQuery = q.Encode()
 
-	authhdr, datehdr := d.getAuthHeader("GET", path, map[string]string{"mintime": mintimes})
-	req.Header.Set("Authorization", authhdr)
-	req.Header.Set("Date", datehdr)
+	return ret, false, nil
+}
 
-	b, err := sendLogRequest(req)
+// logPageRequest makes a single request for logs from a v1 endpoint from mintime onwards
+func logPageRequest(ctx context.Context, d *duoInterface, mintime int, path string) ([]interface{}, error) {
+	b, err := sendLogRequest(ctx, d, path, map[string]string{"mintime": strconv.Itoa(mintime)})
 	if err != nil {
 		return nil, err
 	}
@@ -531,85 +767,169 @@ func logRequest(d *duoInterface, mintime int, path string) ([]emitEvent, error)
 	if l.Stat != "OK" {
 		return nil, fmt.Errorf("%v invalid stat, got %v", path, l.Stat)
 	}
-	ret := make([]emitEvent, 0)
-	for _, v := range l.Response {
-		ret = append(ret, emitEvent{Path: path, Event: v})
-	}
 
-	return ret, nil
+	return l.Response, nil
 }
 
-// authV2Request makes a request for auth v2 logs using both a mintime and a maxtime.
-func authV2Request(d *duoInterface, mintime int, path string) ([]emitEvent, error) {
+// offsetRequest makes requests for logs from an endpoint paged by offset using both a
+// mintime and a maxtime, following the offset of the next page of each response until
+// every log has been returned, maxPages pages have been requested or ctx is done. If
+// offset is set, the logs are requested from that offset onwards.
+//
+// The offset to resume from is returned if logs remain to be requested, otherwise an
+// empty string is returned.
+func offsetRequest(ctx context.Context, d *duoInterface, p *offsetPaging, mintime int, offset string, maxPages int, path string) ([]emitEvent, string, error) {
 	mintimes := strconv.Itoa(mintime * 1000)
 	// Set "maxtime" as a minute from now in milliseconds since epoch.
 	maxtime := fmt.Sprintf("%d", time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond))
 
-	if debug == debugGCP {
-		// GCP debug, make an ad-hoc GET request to test outbound
-		// connectivity and then just return a test event
-		log.Info("making ad-hoc request")
-		resp, err := http.Get("https://www.mozilla.org")
+	ret := make([]emitEvent, 0)
+	for page := 1; ; page++ {
+		params := map[string]string{
+			"mintime": mintimes,
+			"maxtime": maxtime,
+			"limit":   strconv.Itoa(p.pageSize),
+		}
+		if p.sort {
+			params["sort"] = "ts:asc"
+		}
+		if offset != "" {
+			params[p.offsetParam] = offset
+		}
+
+		b, err := sendLogRequest(ctx, d, path, params)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		log.Infof("ad-hoc request returned status code %v\n", resp.StatusCode)
-		resp.Body.Close()
-		return []emitEvent{
-			{"/gcp/test", map[string]interface{}{
-				"gcp":       "test",
-				"timestamp": time.Now().Unix(),
-			}},
-		}, nil
-	}
 
-	req, err := http.NewRequest("GET", "https://"+d.apiHost+path, nil)
-	if err != nil {
-		return nil, err
+		var l v2Records
+		err = json.Unmarshal(b, &l)
+		if err != nil {
+			return nil, "", err
+		}
+		if l.Stat != "OK" {
+			return nil, "", fmt.Errorf("%v invalid stat, got %v", path, l.Stat)
+		}
+		var (
+			logs     []interface{}
+			metadata v2RecordsMetadata
+		)
+		if raw, ok := l.Response[p.recordsKey]; ok {
+			err = json.Unmarshal(raw, &logs)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		if raw, ok := l.Response["metadata"]; ok {
+			err = json.Unmarshal(raw, &metadata)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		for _, v := range logs {
+			ret = append(ret, emitEvent{Path: path, Event: v})
+		}
+
+		offset = metadata.nextOffset()
+		if offset == "" || len(logs) == 0 {
+			return ret, "", nil
+		}
+		if (maxPages > 0 && page == maxPages) || ctx.Err() != nil {
+			log.Infof("requested %v pages of %v, resuming from offset %v next run\n", page, path, offset)
+			return ret, offset, nil
+		}
 	}
-	q := req.URL.Query()
-	q.Add("mintime", mintimes)
-	q.Add("maxtime", maxtime)
-	req.URL.RawQuery = q.Encode()
+}
 
-	authhdr, datehdr := d.getAuthHeader("GET", path, map[string]string{"mintime": mintimes, "maxtime": maxtime})
-	req.Header.Set("Authorization", authhdr)
-	req.Header.Set("Date", datehdr)
+// snapshotRecords represents a response for a request of records from an inventory
+// endpoint of the Duo API, such as users, along with metadata used to request the next
+// page of records.
+//
+// See also https://duo.com/docs/adminapi#retrieve-users
+type snapshotRecords struct {
+	Stat     string        `json:"stat"`
+	Response []interface{} `json:"response"`
+	Metadata struct {
+		NextOffset *int `json:"next_offset"`
+	} `json:"metadata"`
+}
 
-	b, err := sendLogRequest(req)
-	if err != nil {
-		return nil, err
-	}
+// snapshotRequest requests every record of an inventory endpoint, pageSize records at
+// a time, following the next_offset of each response until there is no next page.
+//
+// The records are marked with the time of the snapshot, so the records of a snapshot
+// can be told apart from those of earlier ones by the stream consumer. A snapshot is only
+// of use once complete, so every page is requested even once ctx is done.
+func snapshotRequest(ctx context.Context, d *duoInterface, pageSize int, path string) ([]emitEvent, error) {
+	var (
+		ret      = make([]emitEvent, 0)
+		snapshot = time.Now().Unix()
+		offset   int
+	)
+	for {
+		b, err := sendLogRequest(ctx, d, path, map[string]string{
+			"limit":  strconv.Itoa(pageSize),
+			"offset": strconv.Itoa(offset),
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	var l authV2Records
-	err = json.Unmarshal(b, &l)
-	if err != nil {
-		return nil, err
-	}
-	if l.Stat != "OK" {
-		return nil, fmt.Errorf("%v invalid stat, got %v", path, l.Stat)
-	}
-	ret := make([]emitEvent, 0)
-	for _, v := range l.Response.Authlogs {
-		ret = append(ret, emitEvent{Path: path, Event: v})
-	}
+		var l snapshotRecords
+		err = json.Unmarshal(b, &l)
+		if err != nil {
+			return nil, err
+		}
+		if l.Stat != "OK" {
+			return nil, fmt.Errorf("%v invalid stat, got %v", path, l.Stat)
+		}
+		for _, v := range l.Response {
+			ret = append(ret, emitEvent{Path: path, Event: encodeComplexSlices(v), Snapshot: snapshot})
+		}
 
-	return ret, nil
+		if l.Metadata.NextOffset == nil || len(l.Response) == 0 {
+			return ret, nil
+		}
+		offset = *l.Metadata.NextOffset
+	}
 }
 
-// logRequestAuth returns all authentication logs from the Duo API from mintime onwards
-func logRequestAuth(d *duoInterface, mintime int) ([]emitEvent, error) {
-	return authV2Request(d, mintime, AUTH_ENDPOINT)
+// encodeComplexSlices replaces the lists of objects or lists in a record, such as the
+// phones of a user, with their JSON encoding, as flatten can't handle them
+func encodeComplexSlices(in interface{}) interface{} {
+	m, ok := in.(map[string]interface{})
+	if !ok {
+		return in
+	}
+	for k, v := range m {
+		switch t0 := v.(type) {
+		case map[string]interface{}:
+			m[k] = encodeComplexSlices(t0)
+		case []interface{}:
+			for _, x := range t0 {
+				kind := reflect.ValueOf(x).Kind()
+				if kind == reflect.Map || kind == reflect.Slice || kind == reflect.Array {
+					if buf, err := json.Marshal(t0); err == nil {
+						m[k] = string(buf)
+					}
+					break
+				}
+			}
+		}
+	}
+	return m
 }
 
 // logRequestAdmin returns all administrator logs from the Duo API from mintime onwards
 func logRequestAdmin(d *duoInterface, mintime int) ([]emitEvent, error) {
-	return logRequest(d, mintime, ADMIN_ENDPOINT)
+	e, _, err := logRequest(context.Background(), d, mintime, 0, ADMIN_ENDPOINT)
+	return e, err
 }
 
 // logRequestTele returns all telephony logs from the Duo API from mintime onwards
 func logRequestTele(d *duoInterface, mintime int) ([]emitEvent, error) {
-	return logRequest(d, mintime, TELEPHONY_ENDPOINT)
+	e, _, err := logRequest(context.Background(), d, mintime, 0, TELEPHONY_ENDPOINT)
+	return e, err
 }
 
 // PubSubMessage is used for the function signature of the main function (Duopull())
@@ -621,9 +941,8 @@ type PubSubMessage struct {
 
 func Duopull(ctx context.Context, psmsg PubSubMessage) error {
 	var (
-		m    minTime
-		emit emitter
-		err  error
+		m   = make(minTime)
+		err error
 	)
 
 	log.Info("loading mintime state")
@@ -633,90 +952,60 @@ func Duopull(ctx context.Context, psmsg PubSubMessage) error {
 		return err
 	}
 
-	// Define a helper function for extraction of the maximum timestamp from a
-	// set of events returned from the API. If we get valid data back for a given
-	// event type, the state will be adjusted so the next query starts from that
-	// maximum event time + 1.
-	//
-	// See also https://duo.com/docs/adminapi#authentication-logs
-	fh := func(es []emitEvent) (int, error) {
-		var max int
-		for _, x := range es {
-			ts, err := x.getTimestamp()
-			if err != nil {
-				return 0, err
-			}
-			if ts > max {
-				max = ts
-			}
-		}
-		return max, nil
-	}
+	// Requests stop at the deadline of the run, and the logs of each source are written
+	// and the state saved as soon as it has been requested, so every run makes progress
+	// even if the function times out
+	reqCtx, cancel := context.WithDeadline(ctx, runDeadline(ctx))
+	defer cancel()
 
-	// Request administrator logs and adjust mintime
-	log.Infof("requesting admin logs from %v\n", m.Administrator)
-	e, err := logRequestAdmin(cfg.duo, m.Administrator)
-	if err != nil {
-		log.Errorf("Error requesting admin logs: %s", err)
-		return err
-	}
-	nm, err := fh(e)
-	if err != nil {
-		log.Errorf("Error extracting timestamp from admin logs: %s", err)
-		return err
-	}
-	if nm != 0 {
-		m.Administrator = nm + 1
-	}
-	emit.events = append(emit.events, e...)
+	// Each source is requested independently, so if requesting one fails, the logs of
+	// the others are still written and their state saved. The state of the failed
+	// source is left as it was, so its logs are requested again on the next run.
+	var failed []string
+	for _, s := range cfg.sources {
+		if reqCtx.Err() != nil {
+			log.Warnf("run deadline reached, requesting %v logs next run", s.name)
+			continue
+		}
+		st := m[s.stateKey]
+		log.Infof("requesting %v logs from %v\n", s.name, st.Mintime)
+		e, next, err := s.request(reqCtx, cfg.duo, st)
+		if err != nil {
+			log.Errorf("Error requesting %v logs: %s", s.name, err)
+			failed = append(failed, s.name)
+			continue
+		}
 
-	// Request authentication logs and adjust mintime
-	log.Infof("requesting authentication logs from %v\n", m.Authentication)
-	e, err = logRequestAuth(cfg.duo, m.Authentication)
-	if err != nil {
-		log.Errorf("Error requesting auth logs: %s", err)
-		return err
-	}
-	nm, err = fh(e)
-	if err != nil {
-		log.Errorf("Error extracting timestamp from auth logs: %s", err)
-		return err
-	}
-	if nm != 0 {
-		m.Authentication = nm + 1
-	}
-	emit.events = append(emit.events, e...)
+		log.Infof("writing %v events", s.name)
+		emit := emitter{events: e}
+		err = emit.emit()
+		if err != nil {
+			log.Errorf("Error writing events: %s", err)
+			return err
+		}
 
-	// Request telephony logs and adjust mintime
-	log.Infof("requesting telephony logs from %v\n", m.Telephony)
-	e, err = logRequestTele(cfg.duo, m.Telephony)
-	if err != nil {
-		log.Errorf("Error requesting telephony logs: %s", err)
-		return err
-	}
-	nm, err = fh(e)
-	if err != nil {
-		log.Errorf("Error extracting timestamp from telephony logs: %s", err)
-		return err
-	}
-	if nm != 0 {
-		m.Telephony = nm + 1
+		log.Info("saving mintime state")
+		m[s.stateKey] = next
+		err = m.save(ctx)
+		if err != nil {
+			log.Errorf("Error saving mintime: %s", err)
+			return err
+		}
 	}
-	emit.events = append(emit.events, e...)
 
-	log.Info("writing events")
-	err = emit.emit()
-	if err != nil {
-		log.Errorf("Error writing events: %s", err)
-		return err
+	if len(failed) > 0 {
+		return fmt.Errorf("Error requesting %v logs", strings.Join(failed, ", "))
 	}
+	return nil
+}
 
-	log.Info("saving mintime state")
-	err = m.save(ctx)
-	if err != nil {
-		log.Errorf("Error saving mintime: %s", err)
-		return err
+// runDeadline returns the time after which a run starts no more requests: once
+// DUOPULL_RUN_TIMEOUT has passed, or RUN_WRITE_TIME before the deadline of ctx if that
+// is sooner, leaving time to write the logs requested and save the state
+func runDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(cfg.runTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Add(-RUN_WRITE_TIME).Before(deadline) {
+		deadline = d.Add(-RUN_WRITE_TIME)
 	}
-
-	return nil
+	return deadline
 }
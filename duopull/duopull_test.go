@@ -1,8 +1,16 @@
 package duopull
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var sample = []string{
@@ -74,3 +82,673 @@ func TestFlatten(t *testing.T) {
 		}
 	}
 }
+
+// fakeDuo is a fake Duo Admin API serving v1 logs from events, which are sorted by
+// timestamp, in pages of V1_LOG_PAGE_SIZE, v2 authentication and activity logs in pages
+// following next_offset, and users in pages following offset
+type fakeDuo struct {
+	events   map[string][]map[string]interface{} // Events by endpoint path
+	requests map[string]int                      // Requests by endpoint path
+	statuses map[string][]int                    // Statuses returned by the next requests to each path instead of events
+}
+
+func newFakeDuo(t *testing.T) (*fakeDuo, *duoInterface, func()) {
+	fd := &fakeDuo{
+		events:   make(map[string][]map[string]interface{}),
+		requests: make(map[string]int),
+		statuses: make(map[string][]int),
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" || r.Header.Get("Date") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fd.requests[r.URL.Path]++
+		if statuses := fd.statuses[r.URL.Path]; len(statuses) > 0 {
+			fd.statuses[r.URL.Path] = statuses[1:]
+			if statuses[0] == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(statuses[0])
+			return
+		}
+		switch r.URL.Path {
+		case AUTH_ENDPOINT:
+			fd.serveV2(w, r, "authlogs")
+			return
+		case ACTIVITY_ENDPOINT:
+			fd.serveV2(w, r, "items")
+			return
+		case USERS_ENDPOINT:
+			fd.serveUsers(w, r)
+			return
+		}
+		mintime, err := strconv.Atoi(r.URL.Query().Get("mintime"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page := make([]interface{}, 0)
+		for _, e := range fd.events[r.URL.Path] {
+			if e["timestamp"].(int) >= mintime && len(page) < V1_LOG_PAGE_SIZE {
+				page = append(page, e)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"stat": "OK", "response": page})
+	}))
+	d := &duoInterface{
+		apiHost: strings.TrimPrefix(srv.URL, "https://"),
+		iKey:    "ikey",
+		sKey:    "skey",
+		client:  srv.Client(),
+	}
+	return fd, d, srv.Close
+}
+
+// serveV2 serves a page of v2 logs, which are identified by their timestamp in
+// milliseconds and txid. The offset of the next page is a list for authentication logs,
+// and a comma separated string for other logs.
+func (fd *fakeDuo) serveV2(w http.ResponseWriter, r *http.Request, recordsKey string) {
+	q := r.URL.Query()
+	mintime, err := strconv.Atoi(q.Get("mintime"))
+	if err != nil || q.Get("sort") != "ts:asc" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit > 1000 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	after := q.Get("next_offset")
+
+	var (
+		page       = make([]interface{}, 0)
+		nextOffset []string
+	)
+	for _, e := range fd.events[r.URL.Path] {
+		offset := fmt.Sprintf("%v,%v", e["timestamp"].(int)*1000, e["txid"])
+		if e["timestamp"].(int)*1000 < mintime {
+			continue
+		}
+		if after != "" {
+			if offset == after {
+				after = ""
+			}
+			continue
+		}
+		if len(page) == limit {
+			// More logs remain, the offset of the next page is that of the last log of this page
+			last := page[len(page)-1].(map[string]interface{})
+			nextOffset = []string{strconv.Itoa(last["timestamp"].(int) * 1000), last["txid"].(string)}
+			break
+		}
+		page = append(page, e)
+	}
+	var metadata interface{} = nextOffset
+	if recordsKey != "authlogs" && nextOffset != nil {
+		metadata = strings.Join(nextOffset, ",")
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat": "OK",
+		"response": map[string]interface{}{
+			recordsKey: page,
+			"metadata": map[string]interface{}{"next_offset": metadata},
+		},
+	})
+}
+
+// serveUsers serves a page of users, limit users from offset
+func (fd *fakeDuo) serveUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, err := strconv.Atoi(q.Get("offset"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit > USERS_PAGE_SIZE {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	users := fd.events[USERS_ENDPOINT]
+	page := make([]interface{}, 0)
+	for i := offset; i < len(users) && len(page) < limit; i++ {
+		page = append(page, users[i])
+	}
+	metadata := map[string]interface{}{"total_objects": len(users)}
+	if offset+len(page) < len(users) {
+		metadata["next_offset"] = offset + len(page)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"stat": "OK", "response": page, "metadata": metadata})
+}
+
+// addEvents adds n events to path, with perSecond events sharing each timestamp from start
+func (fd *fakeDuo) addEvents(path string, n int, perSecond int, start int) {
+	for i := 0; i < n; i++ {
+		fd.events[path] = append(fd.events[path], map[string]interface{}{
+			"timestamp": start + i/perSecond,
+			"id":        i,
+			"txid":      fmt.Sprintf("tx-%v", i),
+		})
+	}
+}
+
+// sourcePaging returns the paging of the registered source with the given name
+func sourcePaging(t *testing.T, name string) pager {
+	s := findSource(name)
+	if s == nil {
+		t.Fatalf("no source %v", name)
+	}
+	return s.paging
+}
+
+func eventIds(t *testing.T, events []emitEvent) []int {
+	var ids []int
+	for _, e := range events {
+		id, ok := e.Event.(map[string]interface{})["id"].(float64)
+		if !ok {
+			t.Fatalf("event has no id: %v", e.Event)
+		}
+		ids = append(ids, int(id))
+	}
+	return ids
+}
+
+func TestLogRequestPages(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	// Three events per second, so a second is split across the first and second pages
+	fd.addEvents(ADMIN_ENDPOINT, 2500, 3, 1000)
+	fd.addEvents(TELEPHONY_ENDPOINT, 10, 1, 1000)
+
+	events, err := logRequestAdmin(d, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := eventIds(t, events)
+	if len(ids) != 2500 {
+		t.Fatalf("expected 2500 admin events, got %v", len(ids))
+	}
+	for i, id := range ids {
+		if id != i {
+			t.Fatalf("expected event %v at %v, got %v", i, i, id)
+		}
+	}
+	if fd.requests[ADMIN_ENDPOINT] != 3 {
+		t.Fatalf("expected 3 admin requests, got %v", fd.requests[ADMIN_ENDPOINT])
+	}
+	for _, e := range events {
+		if e.Path != ADMIN_ENDPOINT {
+			t.Fatalf("unexpected event path %v", e.Path)
+		}
+	}
+
+	events, err = logRequestTele(d, 1005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 || fd.requests[TELEPHONY_ENDPOINT] != 1 {
+		t.Fatalf("expected 5 telephony events from 1 request, got %v from %v", len(events), fd.requests[TELEPHONY_ENDPOINT])
+	}
+}
+
+func TestMintimePagingMaxPages(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(ADMIN_ENDPOINT, 2500, 3, 1000)
+
+	orig := cfg.maxPages
+	cfg.maxPages = 2
+	defer func() { cfg.maxPages = orig }()
+
+	p := sourcePaging(t, "admin")
+	events, st, err := p.request(context.Background(), d, ADMIN_ENDPOINT, sourceState{Mintime: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := eventIds(t, events)
+	if fd.requests[ADMIN_ENDPOINT] != 2 || len(ids) >= 2500 || st.Mintime != 1000+ids[len(ids)-1]/3 {
+		t.Fatalf("expected 2 requests and state at the latest timestamp, got %v events from %v and %+v",
+			len(ids), fd.requests[ADMIN_ENDPOINT], st)
+	}
+
+	// The next run resumes from the latest timestamp, so no events are skipped
+	events, st, err = p.request(context.Background(), d, ADMIN_ENDPOINT, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range eventIds(t, events) {
+		seen[id] = true
+	}
+	if len(seen) != 2500 || st != (sourceState{Mintime: 1000 + 2499/3 + 1}) {
+		t.Fatalf("expected every event and state past them, got %v and %+v", len(seen), st)
+	}
+}
+
+func TestLogRequestFullPageOneTimestamp(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	// More events in a single second than fit in a page can't be paged through
+	fd.addEvents(ADMIN_ENDPOINT, V1_LOG_PAGE_SIZE+10, V1_LOG_PAGE_SIZE+10, 1000)
+	fd.addEvents(ADMIN_ENDPOINT, 1, 1, 2000)
+
+	events, err := logRequestAdmin(d, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != V1_LOG_PAGE_SIZE || fd.requests[ADMIN_ENDPOINT] != 2 {
+		t.Fatalf("expected %v events from 2 requests, got %v from %v", V1_LOG_PAGE_SIZE, len(events), fd.requests[ADMIN_ENDPOINT])
+	}
+}
+
+func TestLogRequestError(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.statuses[ADMIN_ENDPOINT] = []int{http.StatusInternalServerError}
+	_, err := logRequestAdmin(d, 1000)
+	if err == nil {
+		t.Fatal("expected an error when the API fails")
+	}
+}
+
+func TestSendLogRequestRetries(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(ADMIN_ENDPOINT, 10, 1, 1000)
+	d.maxRetries = 3
+	d.backoff = time.Millisecond
+
+	// Rate limits and server errors are retried
+	fd.statuses[ADMIN_ENDPOINT] = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInternalServerError}
+	events, err := logRequestAdmin(d, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 || fd.requests[ADMIN_ENDPOINT] != 4 {
+		t.Fatalf("expected 10 events after 4 requests, got %v after %v", len(events), fd.requests[ADMIN_ENDPOINT])
+	}
+
+	// Up to maxRetries times
+	fd.requests[ADMIN_ENDPOINT] = 0
+	fd.statuses[ADMIN_ENDPOINT] = []int{500, 500, 500, 500, 500}
+	_, err = logRequestAdmin(d, 1000)
+	if err == nil || fd.requests[ADMIN_ENDPOINT] != 4 {
+		t.Fatalf("expected an error after 4 requests, got %v after %v", err, fd.requests[ADMIN_ENDPOINT])
+	}
+
+	// Other errors are not retried
+	fd.requests[ADMIN_ENDPOINT] = 0
+	fd.statuses[ADMIN_ENDPOINT] = []int{http.StatusBadRequest}
+	_, err = logRequestAdmin(d, 1000)
+	if err == nil || fd.requests[ADMIN_ENDPOINT] != 1 {
+		t.Fatalf("expected an error after 1 request, got %v after %v", err, fd.requests[ADMIN_ENDPOINT])
+	}
+
+	// Nor are network errors retried past maxRetries
+	d.apiHost = "127.0.0.1:1"
+	start := time.Now()
+	_, err = logRequestAdmin(d, 1000)
+	if err == nil {
+		t.Fatal("expected an error from an unreachable API")
+	}
+	if time.Since(start) < 3*time.Millisecond/2 {
+		t.Fatal("expected network errors to be retried with backoff")
+	}
+}
+
+func TestRequestsStopAtDeadline(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(AUTH_ENDPOINT, 2500, 4, 1000)
+	fd.addEvents(ADMIN_ENDPOINT, 2500, 3, 1000)
+
+	// Once the run is done, the page being requested is the last
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	events, offset, err := offsetRequest(ctx, d, sourcePaging(t, "auth").(*offsetPaging), 1000, "", 0, AUTH_ENDPOINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1000 || offset == "" || fd.requests[AUTH_ENDPOINT] != 1 {
+		t.Fatalf("expected 1000 events from 1 request and an offset to resume from, got %v from %v and %q",
+			len(events), fd.requests[AUTH_ENDPOINT], offset)
+	}
+	events, st, err := sourcePaging(t, "admin").request(ctx, d, ADMIN_ENDPOINT, sourceState{Mintime: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1000 || fd.requests[ADMIN_ENDPOINT] != 1 || st != (sourceState{Mintime: 1000 + 999/3}) {
+		t.Fatalf("expected 1000 events from 1 request and state at the latest, got %v from %v and %+v",
+			len(events), fd.requests[ADMIN_ENDPOINT], st)
+	}
+
+	// Failed requests aren't retried past the deadline
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	d.maxRetries = 3
+	d.backoff = time.Minute
+	fd.requests[ADMIN_ENDPOINT] = 0
+	fd.statuses[ADMIN_ENDPOINT] = []int{http.StatusServiceUnavailable}
+	_, _, err = logRequest(ctx, d, 1000, 0, ADMIN_ENDPOINT)
+	if err == nil || fd.requests[ADMIN_ENDPOINT] != 1 {
+		t.Fatalf("expected an error after 1 request, got %v after %v", err, fd.requests[ADMIN_ENDPOINT])
+	}
+}
+
+func TestDuopullStopsAtDeadline(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	orig := cfg.duo
+	cfg.duo = d
+	defer func() { cfg.duo = orig }()
+
+	// Without time left to write logs, no sources are requested
+	ctx, cancel := context.WithTimeout(context.Background(), RUN_WRITE_TIME)
+	defer cancel()
+	err := Duopull(ctx, PubSubMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fd.requests) != 0 {
+		t.Fatalf("expected no requests, got %v", fd.requests)
+	}
+
+	deadline := runDeadline(context.Background())
+	if time.Until(deadline) > cfg.runTimeout || time.Until(deadline) < cfg.runTimeout-time.Second {
+		t.Fatalf("expected the run to stop after %v, got %v", cfg.runTimeout, time.Until(deadline))
+	}
+}
+
+func TestDuopullIsolatesEndpoints(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	orig := cfg.duo
+	cfg.duo = d
+	defer func() { cfg.duo = orig }()
+
+	now := int(time.Now().Unix())
+	fd.addEvents(AUTH_ENDPOINT, 10, 1, now-100)
+	fd.addEvents(TELEPHONY_ENDPOINT, 10, 1, now-100)
+	fd.statuses[ADMIN_ENDPOINT] = []int{http.StatusBadRequest}
+
+	err := Duopull(context.Background(), PubSubMessage{})
+	if err == nil || !strings.Contains(err.Error(), "admin") {
+		t.Fatalf("expected an error for admin logs, got %v", err)
+	}
+	if fd.requests[AUTH_ENDPOINT] != 1 || fd.requests[TELEPHONY_ENDPOINT] != 1 {
+		t.Fatalf("expected auth and telephony logs to be requested after admin logs failed, got %v", fd.requests)
+	}
+}
+
+func TestAuthV2RequestPages(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(AUTH_ENDPOINT, 2500, 4, 1000)
+
+	events, offset, err := offsetRequest(context.Background(), d, sourcePaging(t, "auth").(*offsetPaging), 1000, "", 0, AUTH_ENDPOINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2500 || offset != "" || fd.requests[AUTH_ENDPOINT] != 3 {
+		t.Fatalf("expected 2500 events from 3 requests, got %v from %v", len(events), fd.requests[AUTH_ENDPOINT])
+	}
+	for i, id := range eventIds(t, events) {
+		if id != i {
+			t.Fatalf("expected event %v at %v, got %v", i, i, id)
+		}
+	}
+}
+
+func TestAuthV2RequestResume(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	// Four events per second, so the second page ends partway through a second
+	fd.addEvents(AUTH_ENDPOINT, 2500, 4, 1000)
+
+	p := sourcePaging(t, "auth").(*offsetPaging)
+	st := sourceState{Mintime: 1000}
+	var ids []int
+	for run := 0; run < 3; run++ {
+		events, offset, err := offsetRequest(context.Background(), d, p, st.Mintime, st.Offset, 2, AUTH_ENDPOINT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, eventIds(t, events)...)
+
+		var latest int
+		for _, e := range events {
+			ts, err := e.getTimestamp()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ts > latest {
+				latest = ts
+			}
+		}
+		st = st.next(latest, offset)
+
+		if run == 0 && (st.Offset == "" || st.Mintime != 1000+1999/4) {
+			t.Fatalf("expected the first run to stop within the second of its last event, got %+v", st)
+		}
+	}
+
+	if len(ids) != 2500 {
+		t.Fatalf("expected 2500 events over the runs, got %v", len(ids))
+	}
+	for i, id := range ids {
+		if id != i {
+			t.Fatalf("expected event %v at %v, got %v", i, i, id)
+		}
+	}
+	if st.Offset != "" || st.Mintime != 1000+2499/4+1 {
+		t.Fatalf("expected state past the last event, got %+v", st)
+	}
+}
+
+func TestSourceStateNext(t *testing.T) {
+	st := sourceState{Mintime: 1000}
+	if st.next(0, "") != (sourceState{Mintime: 1000}) {
+		t.Fatal("expected mintime to stay the same without new logs")
+	}
+	if st.next(1500, "") != (sourceState{Mintime: 1501}) {
+		t.Fatal("expected mintime past the latest log once all were requested")
+	}
+	if st.next(1500, "1500123,txid") != (sourceState{Mintime: 1500, Offset: "1500123,txid"}) {
+		t.Fatal("expected mintime at the latest log while logs remain")
+	}
+	st.Offset = "1500123,txid"
+	if st.next(0, "") != (sourceState{Mintime: 1501}) {
+		t.Fatal("expected mintime past the offset once no logs remain after it")
+	}
+}
+
+func TestSourceStateNextUnsorted(t *testing.T) {
+	st := sourceState{Mintime: 1000}
+	if st.nextUnsorted(1500, "200") != (sourceState{Mintime: 1000, Offset: "200"}) {
+		t.Fatal("expected mintime to stay the same while logs remain")
+	}
+	st.Offset = "200"
+	if st.nextUnsorted(1200, "400") != (sourceState{Mintime: 1000, Offset: "400"}) {
+		t.Fatal("expected mintime to stay the same while logs remain after resuming")
+	}
+	if st.nextUnsorted(1200, "") != (sourceState{Mintime: 1201}) {
+		t.Fatal("expected mintime past the latest log once all were requested")
+	}
+	if st.nextUnsorted(0, "") != (sourceState{Mintime: 1000}) {
+		t.Fatal("expected mintime to stay the same without new logs")
+	}
+}
+
+func TestMinTimeState(t *testing.T) {
+	// State saved before sources were configurable
+	m := make(minTime)
+	err := json.Unmarshal([]byte(`{"administrator":1000,"authentication":2000,"authentication_offset":"2000123,txid","telephony":3000}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := minTime{
+		"administrator":  {Mintime: 1000},
+		"authentication": {Mintime: 2000, Offset: "2000123,txid"},
+		"telephony":      {Mintime: 3000},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected state %+v, got %+v", expected, m)
+	}
+
+	m["activity"] = sourceState{Mintime: 4000}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != `{"activity":4000,"administrator":1000,"authentication":2000,"authentication_offset":"2000123,txid","telephony":3000}` {
+		t.Fatalf("unexpected state %s", buf)
+	}
+
+	if json.Unmarshal([]byte(`{"administrator":"x"}`), &m) == nil {
+		t.Fatal("expected an error loading an invalid mintime")
+	}
+}
+
+func TestParseSources(t *testing.T) {
+	names := func(sources []*logSource) string {
+		var ret []string
+		for _, s := range sources {
+			ret = append(ret, s.name)
+		}
+		return strings.Join(ret, ",")
+	}
+
+	sources, err := parseSources("")
+	if err != nil || names(sources) != "admin,auth,telephony" {
+		t.Fatalf("expected the default sources, got %v, %v", names(sources), err)
+	}
+	sources, err = parseSources("users, activity,auth")
+	if err != nil || names(sources) != "auth,activity,users" {
+		t.Fatalf("expected the sources in the order registered, got %v, %v", names(sources), err)
+	}
+	_, err = parseSources("auth,unknown")
+	if err == nil {
+		t.Fatal("expected an error parsing an unknown source")
+	}
+
+	keys := make(map[string]bool)
+	for _, s := range sourceRegistry {
+		if keys[s.stateKey] || strings.HasSuffix(s.stateKey, "_offset") {
+			t.Fatalf("source %v has an invalid state key %v", s.name, s.stateKey)
+		}
+		keys[s.stateKey] = true
+	}
+}
+
+func TestActivityRequest(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(ACTIVITY_ENDPOINT, 2500, 4, 1000)
+	for _, e := range fd.events[ACTIVITY_ENDPOINT] {
+		e["ts"] = time.Unix(int64(e["timestamp"].(int)), 123000000).UTC().Format(time.RFC3339Nano)
+	}
+
+	orig := cfg.maxPages
+	cfg.maxPages = 2
+	defer func() { cfg.maxPages = orig }()
+
+	p := sourcePaging(t, "activity")
+	events, st, err := p.request(context.Background(), d, ACTIVITY_ENDPOINT, sourceState{Mintime: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2000 || st != (sourceState{Mintime: 1000 + 1999/4, Offset: fmt.Sprintf("%v,tx-1999", (1000+1999/4)*1000)}) {
+		t.Fatalf("expected 2000 events and an offset to resume from, got %v and %+v", len(events), st)
+	}
+
+	events, st, err = p.request(context.Background(), d, ACTIVITY_ENDPOINT, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 500 || st != (sourceState{Mintime: 1000 + 2499/4 + 1}) {
+		t.Fatalf("expected the remaining 500 events and state past them, got %v and %+v", len(events), st)
+	}
+}
+
+func TestSnapshotRequest(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	for i := 0; i < 700; i++ {
+		fd.events[USERS_ENDPOINT] = append(fd.events[USERS_ENDPOINT], map[string]interface{}{
+			"id":       i,
+			"username": fmt.Sprintf("user%v", i),
+			"phones":   []interface{}{map[string]interface{}{"number": "000-000-0000"}},
+			"aliases":  map[string]interface{}{"alias1": fmt.Sprintf("alias%v", i)},
+		})
+	}
+
+	p := sourcePaging(t, "users")
+	events, st, err := p.request(context.Background(), d, USERS_ENDPOINT, sourceState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 700 || fd.requests[USERS_ENDPOINT] != 3 {
+		t.Fatalf("expected 700 users from 3 requests, got %v from %v", len(events), fd.requests[USERS_ENDPOINT])
+	}
+	for i, id := range eventIds(t, events) {
+		if id != i {
+			t.Fatalf("expected user %v at %v, got %v", i, i, id)
+		}
+	}
+	if st.Mintime < int(time.Now().Add(cfg.snapshotInterval).Unix())-60 {
+		t.Fatalf("expected the next snapshot to be due after the snapshot interval, got %+v", st)
+	}
+
+	// Users have lists of phones, which are encoded so the users can be flattened
+	cv, err := events[0].toInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = toMozLog(cv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cv["snapshot"] == nil {
+		t.Fatal("expected users to have the time of the snapshot")
+	}
+
+	events, _, err = p.request(context.Background(), d, USERS_ENDPOINT, st)
+	if err != nil || len(events) != 0 || fd.requests[USERS_ENDPOINT] != 3 {
+		t.Fatalf("expected no snapshot before the next is due, got %v users", len(events))
+	}
+}
+
+func TestRequestPacing(t *testing.T) {
+	fd, d, done := newFakeDuo(t)
+	defer done()
+
+	fd.addEvents(AUTH_ENDPOINT, 2500, 4, 1000)
+	d.interval = 50 * time.Millisecond
+
+	start := time.Now()
+	_, _, err := offsetRequest(context.Background(), d, sourcePaging(t, "auth").(*offsetPaging), 1000, "", 0, AUTH_ENDPOINT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected 3 requests to take at least 100ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,381 @@
+package duopull
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logSource is an endpoint of the Duo API that logs, or snapshots of records such as
+// users, are requested from. To request logs from another endpoint, add a source for it
+// to sourceRegistry.
+type logSource struct {
+	name     string // Name of the source in DUOPULL_SOURCES and in errors
+	path     string // Request path of the endpoint
+	stateKey string // Key the state of the source is saved under in the mintime state
+	enabled  bool   // Whether the source is requested when DUOPULL_SOURCES is not set
+	paging   pager  // How logs are requested from the endpoint
+}
+
+// sourceRegistry holds every source logs can be requested from, in the order they are
+// requested. The state keys of the administrator, authentication and telephony logs
+// are those used before sources were configurable, so their state carries over.
+var sourceRegistry = []*logSource{
+	{
+		name:     "admin",
+		path:     ADMIN_ENDPOINT,
+		stateKey: "administrator",
+		enabled:  true,
+		paging:   &mintimePaging{},
+	},
+	{
+		name:     "auth",
+		path:     AUTH_ENDPOINT,
+		stateKey: "authentication",
+		enabled:  true,
+		paging: &offsetPaging{
+			recordsKey:  "authlogs",
+			offsetParam: "next_offset",
+			pageSize:    AUTH_V2_PAGE_SIZE,
+			sort:        true,
+			timestamp:   (*emitEvent).getTimestamp,
+		},
+	},
+	{
+		name:     "telephony",
+		path:     TELEPHONY_ENDPOINT,
+		stateKey: "telephony",
+		enabled:  true,
+		paging:   &mintimePaging{},
+	},
+	{
+		name:     "offline_enrollment",
+		path:     OFFLINE_ENROLLMENT_ENDPOINT,
+		stateKey: "offline_enrollment",
+		paging:   &mintimePaging{},
+	},
+	{
+		name:     "trust_monitor",
+		path:     TRUST_MONITOR_ENDPOINT,
+		stateKey: "trust_monitor",
+		paging: &offsetPaging{
+			recordsKey:  "events",
+			offsetParam: "offset",
+			pageSize:    TRUST_MONITOR_PAGE_SIZE,
+			timestamp:   millisecondTimestamp("surfaced_timestamp"),
+		},
+	},
+	{
+		name:     "activity",
+		path:     ACTIVITY_ENDPOINT,
+		stateKey: "activity",
+		paging: &offsetPaging{
+			recordsKey:  "items",
+			offsetParam: "next_offset",
+			pageSize:    ACTIVITY_PAGE_SIZE,
+			sort:        true,
+			timestamp:   rfc3339Timestamp("ts"),
+		},
+	},
+	{
+		name:     "users",
+		path:     USERS_ENDPOINT,
+		stateKey: "users_snapshot",
+		paging:   &snapshotPaging{pageSize: USERS_PAGE_SIZE},
+	},
+	{
+		name:     "phones",
+		path:     PHONES_ENDPOINT,
+		stateKey: "phones_snapshot",
+		paging:   &snapshotPaging{pageSize: PHONES_PAGE_SIZE},
+	},
+	{
+		name:     "admins",
+		path:     ADMINS_ENDPOINT,
+		stateKey: "admins_snapshot",
+		paging:   &snapshotPaging{pageSize: ADMINS_PAGE_SIZE},
+	},
+}
+
+// findSource returns the registered source with the given name, or nil if there is none
+func findSource(name string) *logSource {
+	for _, s := range sourceRegistry {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// parseSources returns the sources named in the comma separated list v, in the order
+// they are registered, or the sources enabled by default if v is empty
+func parseSources(v string) ([]*logSource, error) {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if findSource(name) == nil {
+			var names []string
+			for _, s := range sourceRegistry {
+				names = append(names, s.name)
+			}
+			return nil, fmt.Errorf("DUOPULL_SOURCES has unknown source %v, must be from %v", name, strings.Join(names, ", "))
+		}
+		enabled[name] = true
+	}
+
+	var ret []*logSource
+	for _, s := range sourceRegistry {
+		if (len(enabled) == 0 && s.enabled) || enabled[s.name] {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+// request returns the logs of the source from the state left by the last run, along
+// with the state for the next run
+func (s *logSource) request(ctx context.Context, d *duoInterface, st sourceState) ([]emitEvent, sourceState, error) {
+	if debug == debugGCP {
+		// GCP debug, make an ad-hoc GET request to test outbound
+		// connectivity and then just return a test event
+		log.Info("making ad-hoc request")
+		resp, err := http.Get("https://www.mozilla.org")
+		if err != nil {
+			return nil, st, err
+		}
+		log.Infof("ad-hoc request returned status code %v\n", resp.StatusCode)
+		resp.Body.Close()
+		now := time.Now().Unix()
+		return []emitEvent{
+			{Path: "/gcp/test", Event: map[string]interface{}{
+				"gcp":       "test",
+				"timestamp": now,
+			}},
+		}, sourceState{Mintime: int(now) + 1}, nil
+	}
+	return s.paging.request(ctx, d, s.path, st)
+}
+
+// pager requests the logs of an endpoint from the state left by the last run, returning
+// them along with the state for the next run. Once ctx is done, no more pages are
+// requested and the next run resumes from where the last page left off.
+type pager interface {
+	request(ctx context.Context, d *duoInterface, path string, st sourceState) ([]emitEvent, sourceState, error)
+}
+
+// mintimePaging requests logs from v1 log endpoints, which are paged by mintime. At most
+// DUOPULL_MAX_PAGES pages are requested per run, and the next run requests logs from after
+// the latest timestamp returned, or from that timestamp if logs remain, as more logs with
+// it may be on the next page. Those returned already are then written again.
+type mintimePaging struct{}
+
+func (p *mintimePaging) request(ctx context.Context, d *duoInterface, path string, st sourceState) ([]emitEvent, sourceState, error) {
+	e, more, err := logRequest(ctx, d, st.Mintime, cfg.maxPages, path)
+	if err != nil {
+		return nil, st, err
+	}
+	latest, err := latestTimestamp(e, (*emitEvent).getTimestamp)
+	if err != nil {
+		return nil, st, err
+	}
+	switch {
+	case more:
+		st.Mintime = latest
+	case latest != 0:
+		st.Mintime = latest + 1
+	}
+	return e, st, nil
+}
+
+// offsetPaging requests logs from endpoints paged by offset, such as v2 log endpoints,
+// which take a mintime and maxtime in milliseconds and return the offset of the next page
+// with each page. At most DUOPULL_MAX_PAGES pages are requested per run, and the next
+// run resumes from the offset logs remain at, if any.
+type offsetPaging struct {
+	recordsKey  string // Key the logs are held under in the response
+	offsetParam string // Parameter the offset of the next page is passed in
+	pageSize    int
+	sort        bool                            // Whether logs are requested oldest first with the sort parameter
+	timestamp   func(e *emitEvent) (int, error) // Returns the timestamp in seconds of a log
+}
+
+func (p *offsetPaging) request(ctx context.Context, d *duoInterface, path string, st sourceState) ([]emitEvent, sourceState, error) {
+	e, offset, err := offsetRequest(ctx, d, p, st.Mintime, st.Offset, cfg.maxPages, path)
+	if err != nil {
+		return nil, st, err
+	}
+	latest, err := latestTimestamp(e, p.timestamp)
+	if err != nil {
+		return nil, st, err
+	}
+	if !p.sort {
+		return e, st.nextUnsorted(latest, offset), nil
+	}
+	return e, st.next(latest, offset), nil
+}
+
+// snapshotPaging requests every record of an inventory endpoint, such as users, once
+// every DUOPULL_SNAPSHOT_INTERVAL. The mintime of its state is the time the next
+// snapshot is due at.
+type snapshotPaging struct {
+	pageSize int
+}
+
+func (p *snapshotPaging) request(ctx context.Context, d *duoInterface, path string, st sourceState) ([]emitEvent, sourceState, error) {
+	now := time.Now()
+	if int(now.Unix()) < st.Mintime {
+		log.Infof("next snapshot of %v due at %v\n", path, st.Mintime)
+		return nil, st, nil
+	}
+	e, err := snapshotRequest(ctx, d, p.pageSize, path)
+	if err != nil {
+		return nil, st, err
+	}
+	st.Mintime = int(now.Add(cfg.snapshotInterval).Unix())
+	return e, st, nil
+}
+
+// latestTimestamp returns the latest timestamp of a set of events returned from the
+// API, or 0 if there are none
+func latestTimestamp(es []emitEvent, timestamp func(e *emitEvent) (int, error)) (int, error) {
+	var max int
+	for i := range es {
+		ts, err := timestamp(&es[i])
+		if err != nil {
+			return 0, err
+		}
+		if ts > max {
+			max = ts
+		}
+	}
+	return max, nil
+}
+
+// millisecondTimestamp returns a function extracting the timestamp of an event from a
+// field holding milliseconds since epoch
+func millisecondTimestamp(field string) func(e *emitEvent) (int, error) {
+	return func(e *emitEvent) (int, error) {
+		ev, ok := e.Event.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("type assertion failed on event")
+		}
+		ms, ok := ev[field].(float64)
+		if !ok || ms == 0 {
+			return 0, fmt.Errorf("event had no %v", field)
+		}
+		return int(ms / 1000), nil
+	}
+}
+
+// rfc3339Timestamp returns a function extracting the timestamp of an event from a field
+// holding an RFC 3339 time
+func rfc3339Timestamp(field string) func(e *emitEvent) (int, error) {
+	return func(e *emitEvent) (int, error) {
+		ev, ok := e.Event.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("type assertion failed on event")
+		}
+		v, ok := ev[field].(string)
+		if !ok {
+			return 0, fmt.Errorf("event had no %v", field)
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, err
+		}
+		return int(t.Unix()), nil
+	}
+}
+
+// sourceState is the state of a source saved between runs
+type sourceState struct {
+	Mintime int    // Time logs are requested from, or a snapshot is next due at
+	Offset  string // Offset to resume logs from, if the last run stopped before all were requested
+}
+
+// next returns the state for the next request of logs paged by offset, given the latest
+// timestamp of the logs requested and the offset to resume from, if any remain to be
+// requested
+func (st sourceState) next(latest int, offset string) sourceState {
+	switch {
+	case offset != "" && latest != 0:
+		// Later logs with the same timestamp as the latest may remain, so the next
+		// run resumes from the offset within that second
+		return sourceState{Mintime: latest, Offset: offset}
+	case latest != 0:
+		return sourceState{Mintime: latest + 1}
+	case st.Offset != "":
+		// Resumed from an offset and found no more logs, so every log up to the
+		// offset has been requested
+		ts, err := offsetTimestamp(st.Offset)
+		if err == nil {
+			return sourceState{Mintime: ts + 1}
+		}
+	}
+	return sourceState{Mintime: st.Mintime, Offset: offset}
+}
+
+// nextUnsorted returns the state for the next request of logs paged by offset that can't
+// be requested oldest first. Logs remaining at the offset may be older than those
+// requested, so the mintime is kept until every log has been requested, and only then
+// advances past the latest log of the last run. Logs of earlier runs later than that may
+// be requested again, but none are skipped.
+func (st sourceState) nextUnsorted(latest int, offset string) sourceState {
+	if offset == "" && latest != 0 {
+		return sourceState{Mintime: latest + 1}
+	}
+	return sourceState{Mintime: st.Mintime, Offset: offset}
+}
+
+// minTime stores the state of each source by its state key. It is saved as a JSON object
+// holding the mintime of each source under its state key, and its offset, if any, under
+// its state key with an _offset suffix.
+type minTime map[string]sourceState
+
+func (m minTime) MarshalJSON() ([]byte, error) {
+	ret := make(map[string]interface{})
+	for k, st := range m {
+		ret[k] = st.Mintime
+		if st.Offset != "" {
+			ret[k+"_offset"] = st.Offset
+		}
+	}
+	return json.Marshal(ret)
+}
+
+func (m *minTime) UnmarshalJSON(buf []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(buf, &fields)
+	if err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = make(minTime)
+	}
+	for k, raw := range fields {
+		if strings.HasSuffix(k, "_offset") {
+			continue
+		}
+		var st sourceState
+		err = json.Unmarshal(raw, &st.Mintime)
+		if err != nil {
+			return fmt.Errorf("invalid mintime for %v: %s", k, err)
+		}
+		if raw, ok := fields[k+"_offset"]; ok {
+			err = json.Unmarshal(raw, &st.Offset)
+			if err != nil {
+				return fmt.Errorf("invalid offset for %v: %s", k, err)
+			}
+		}
+		(*m)[k] = st
+	}
+	return nil
+}